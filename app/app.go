@@ -1,17 +1,37 @@
 package app
 
 import (
+	"cmp"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"os"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
 
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/joho/godotenv"
 	"github.com/ofjangra/sqsURLProducer/config"
-	"github.com/ofjangra/sqsURLProducer/models"
 	"gorm.io/gorm"
 )
 
-var db *gorm.DB
+// db is swapped by Reconnect while the HTTP handlers and the producer read
+// it from other goroutines.
+var db atomic.Pointer[gorm.DB]
+
+// replica is the pool of the DB_REPLICA_DSN replica behind db, nil without
+// one. Closing db's pool leaves it open, so Reconnect and CloseDB close it
+// as well.
+var replica atomic.Pointer[sql.DB]
+var dbConfig *config.DBConfig
+var autoMigrate bool
 
 func InitApp() {
 	envLoadErr := godotenv.Load(".env")
@@ -19,24 +39,183 @@ func InitApp() {
 	if envLoadErr != nil {
 		log.Fatal("Failed to load environment variables")
 	}
-	var err error
-	db, err = config.DBConnection(&config.DBConfig{
+	dbConfig = &config.DBConfig{
 		Host:     os.Getenv("DB_HOST"),
 		DBName:   os.Getenv("DB_NAME"),
 		Port:     os.Getenv("DB_PORT"),
 		Password: os.Getenv("DB_PASSWORD"),
 		User:     os.Getenv("DB_USER"),
-	})
+
+		ReplicaDSN: os.Getenv("DB_REPLICA_DSN"),
+
+		TablePrefix: os.Getenv("DB_TABLE_PREFIX"),
+	}
+	dbConfig.SingularTable = envBool("DB_SINGULAR_TABLES", false)
+	if dbConfig.ApplicationName = os.Getenv("DB_APPLICATION_NAME"); dbConfig.ApplicationName == "" {
+		dbConfig.ApplicationName = "sqsURLProducer"
+	}
+	wait, err := time.ParseDuration(cmp.Or(os.Getenv("WAIT_FOR_DEPS"), "0s"))
+	if err != nil {
+		log.Fatalf("Environment variable WAIT_FOR_DEPS must be a duration such as 2m, got %q", os.Getenv("WAIT_FOR_DEPS"))
+	}
+	conn, replicaDB, err := connectDB(wait)
 
 	if err != nil {
-		fmt.Println("Db connection error:", err)
+		log.Fatalf("Db connection error: %v", err)
 	}
+	db.Store(conn)
+	replica.Store(replicaDB)
 
 	fmt.Println("Database connected")
 
-	db.AutoMigrate(&models.URLs{})
+	// A table tracked by PROCESSED_MARKER=bool or timestamp keeps its marker
+	// column, which may well be the processed column of earlier versions,
+	// and is not expected to have a status column.
+	statusMarker := cmp.Or(os.Getenv("PROCESSED_MARKER"), "status") == "status"
+
+	autoMigrate = envBool("AUTO_MIGRATE", true)
+	if !autoMigrate {
+		if err := verifySchema(conn, statusMarker); err != nil {
+			log.Fatalf("AUTO_MIGRATE is off and the schema does not match: %v", err)
+		}
+		if envBool("URL_UNIQUE_INDEX", false) {
+			log.Println("URL_UNIQUE_INDEX has no effect with AUTO_MIGRATE off, create the index yourself")
+		}
+		return
+	}
+
+	// Carrying on with a schema that failed to migrate only turns this into
+	// a confusing query error on every poll, so stop here instead.
+	if err := migrateSchema(conn, statusMarker, envBool("URL_UNIQUE_INDEX", false)); err != nil {
+		log.Fatalf("Failed to migrate the schema: %v", err)
+	}
+}
+
+// AutoMigrate reports whether InitApp migrated the schema, as opposed to
+// only verifying it with AUTO_MIGRATE=false.
+func AutoMigrate() bool {
+	return autoMigrate
+}
+
+// envBool parses the boolean environment variable key, exiting when it is
+// set to something else.
+func envBool(key string, fallback bool) bool {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Fatalf("Environment variable %s must be true or false, got %q", key, value)
+	}
+	return b
+}
+
+// MaxWaitBackoff caps the delay between connection attempts while waiting
+// for a dependency at startup.
+const MaxWaitBackoff = 30 * time.Second
+
+// connectDB opens the database, retrying with exponential backoff for up to
+// wait so that an orchestrated rollout can start the app before the database
+// accepts connections instead of crash-looping. A zero wait tries once.
+func connectDB(wait time.Duration) (*gorm.DB, *sql.DB, error) {
+	deadline := time.Now().Add(wait)
+	backoff := time.Second
+	for {
+		conn, replicaDB, err := config.DBConnection(dbConfig)
+		if err == nil || time.Now().Add(backoff).After(deadline) {
+			return conn, replicaDB, err
+		}
+		log.Printf("Database not reachable yet, retrying in %s: %v", backoff, err)
+		time.Sleep(backoff)
+		backoff = min(backoff*2, MaxWaitBackoff)
+	}
 }
 
 func GetDB() *gorm.DB {
-	return db
+	return db.Load()
+}
+
+// HasReplica reports whether reads are served by a DB_REPLICA_DSN replica.
+func HasReplica() bool {
+	return dbConfig != nil && dbConfig.ReplicaDSN != ""
+}
+
+// Reconnect replaces the connection pools, of the primary and any replica,
+// with freshly opened ones and closes the old pools. It is used after
+// IsConnectionError reports that the database went away.
+func Reconnect() (*gorm.DB, error) {
+	newDB, newReplica, err := config.DBConnection(dbConfig)
+	if err != nil {
+		return nil, err
+	}
+	if sqlDB, err := db.Swap(newDB).DB(); err == nil {
+		sqlDB.Close()
+	}
+	if old := replica.Swap(newReplica); old != nil {
+		old.Close()
+	}
+	return newDB, nil
+}
+
+// Ping checks that the database answers on the current pool.
+func Ping(ctx context.Context) error {
+	sqlDB, err := GetDB().DB()
+	if err != nil {
+		return err
+	}
+	return sqlDB.PingContext(ctx)
+}
+
+// CloseDB closes the connection pools of the primary and any replica.
+// Queries made afterwards fail with database/sql's "sql: database is
+// closed".
+func CloseDB() error {
+	var replicaErr error
+	if r := replica.Load(); r != nil {
+		replicaErr = r.Close()
+	}
+	conn := db.Load()
+	if conn == nil {
+		return replicaErr
+	}
+	sqlDB, err := conn.DB()
+	if err != nil {
+		return errors.Join(err, replicaErr)
+	}
+	return errors.Join(sqlDB.Close(), replicaErr)
+}
+
+// IsConnectionError reports whether err means the connection to the
+// database was lost or could not be established, as opposed to the query
+// itself failing.
+func IsConnectionError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, sql.ErrConnDone) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+
+	var connectErr *pgconn.ConnectError
+	if errors.As(err, &connectErr) {
+		return true
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		// Class 08 is "connection exception"; 57P01-57P03 mean the server
+		// is shutting down or not accepting connections.
+		return pgErr.Code[:2] == "08" || pgErr.Code == "57P01" || pgErr.Code == "57P02" || pgErr.Code == "57P03"
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// IsLockTimeout reports whether err is Postgres giving up on a lock after
+// lock_timeout (SQLSTATE 55P03, lock_not_available).
+func IsLockTimeout(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "55P03"
 }
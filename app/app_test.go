@@ -0,0 +1,87 @@
+package app
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"gorm.io/gorm"
+)
+
+func TestIsConnectionError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"bad connection", driver.ErrBadConn, true},
+		{"connection already closed", sql.ErrConnDone, true},
+		{"wrapped EOF", fmt.Errorf("reading result: %w", io.EOF), true},
+		{"unexpected EOF", io.ErrUnexpectedEOF, true},
+		{"connection refused", &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}, true},
+		{"connection reset", syscall.ECONNRESET, true},
+		{"broken pipe", syscall.EPIPE, true},
+		{"connect error", &pgconn.ConnectError{}, true},
+		{"network timeout", &net.DNSError{Err: "timeout", IsTimeout: true}, true},
+		{"connection failure", &pgconn.PgError{Code: "08006"}, true},
+		{"admin shutdown", &pgconn.PgError{Code: "57P01"}, true},
+		{"cannot connect now", &pgconn.PgError{Code: "57P03"}, true},
+		{"query canceled", &pgconn.PgError{Code: "57014"}, false},
+		{"undefined column", &pgconn.PgError{Code: "42703"}, false},
+		{"lock timeout", &pgconn.PgError{Code: "55P03"}, false},
+		{"record not found", gorm.ErrRecordNotFound, false},
+		{"other", errors.New("boom"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsConnectionError(tt.err); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsLockTimeout(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"lock_not_available", &pgconn.PgError{Code: "55P03"}, true},
+		{"wrapped", fmt.Errorf("claiming: %w", &pgconn.PgError{Code: "55P03"}), true},
+		{"deadlock", &pgconn.PgError{Code: "40P01"}, false},
+		{"connection lost", driver.ErrBadConn, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsLockTimeout(tt.err); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCloseDB(t *testing.T) {
+	conn := testDB(t)
+	old := db.Swap(conn)
+	t.Cleanup(func() { db.Store(old) })
+
+	if err := conn.Exec("SELECT 1").Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := CloseDB(); err != nil {
+		t.Fatalf("CloseDB: %v", err)
+	}
+	if err := conn.Exec("SELECT 1").Error; err == nil || !strings.Contains(err.Error(), "database is closed") {
+		t.Errorf("got %v from a query after CloseDB, want the database closed", err)
+	}
+}
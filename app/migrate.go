@@ -0,0 +1,101 @@
+package app
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/ofjangra/sqsURLProducer/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// migrateSchema brings the urls table up to date for AUTO_MIGRATE: it
+// creates the table or adds missing columns, converts the columns of
+// earlier versions and, with uniqueIndex, adds the unique index on url.
+// Without statusMarker the processed column is left alone, see InitApp.
+func migrateSchema(db *gorm.DB, statusMarker, uniqueIndex bool) error {
+	if err := migrateRetryAfterColumn(db); err != nil {
+		return fmt.Errorf("renaming retry_after to next_attempt_at: %w", err)
+	}
+	if err := db.AutoMigrate(&models.URLs{}); err != nil {
+		return fmt.Errorf("migrating the urls table, check the database user's privileges and any conflicting column types: %w", err)
+	}
+	if statusMarker {
+		if err := migrateProcessedColumn(db); err != nil {
+			return fmt.Errorf("migrating the processed column to status: %w", err)
+		}
+	}
+	if uniqueIndex {
+		if err := migrateURLUniqueIndex(db); err != nil {
+			return fmt.Errorf("creating a unique index on urls.url, remove duplicate URLs first: %w", err)
+		}
+	}
+	return nil
+}
+
+// migrateProcessedColumn converts tables created before the status column
+// existed. Rows with processed = true become sent, unprocessed rows that were
+// claimed become claimed (and are picked up by the stale-claim recovery), and
+// everything else stays pending. The processed column is dropped afterwards.
+// It runs after AutoMigrate has added the status column and is a no-op once
+// processed is gone.
+func migrateProcessedColumn(db *gorm.DB) error {
+	if !db.Migrator().HasColumn(&models.URLs{}, "processed") {
+		return nil
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		sent := tx.Model(&models.URLs{}).Where("processed = ?", true).Update("status", models.StatusSent)
+		if sent.Error != nil {
+			return sent.Error
+		}
+		claimed := tx.Model(&models.URLs{}).
+			Where("processed = ? AND claimed_at IS NOT NULL", false).
+			Update("status", models.StatusClaimed)
+		if claimed.Error != nil {
+			return claimed.Error
+		}
+		if err := tx.Migrator().DropColumn(&models.URLs{}, "processed"); err != nil {
+			return err
+		}
+		log.Printf("Migrated processed column: %d rows sent, %d rows claimed", sent.RowsAffected, claimed.RowsAffected)
+		return nil
+	})
+}
+
+// migrateRetryAfterColumn renames the retry_after column of earlier versions
+// to next_attempt_at, keeping the scheduled retries. It runs before
+// AutoMigrate, which would otherwise add next_attempt_at next to it.
+func migrateRetryAfterColumn(db *gorm.DB) error {
+	m := db.Migrator()
+	if !m.HasTable(&models.URLs{}) || !m.HasColumn(&models.URLs{}, "retry_after") || m.HasColumn(&models.URLs{}, "next_attempt_at") {
+		return nil
+	}
+	if err := m.RenameColumn(&models.URLs{}, "retry_after", "next_attempt_at"); err != nil {
+		return err
+	}
+	log.Println("Renamed column retry_after to next_attempt_at")
+	return nil
+}
+
+// urlsTable is the name the naming strategy gives the urls table.
+func urlsTable(db *gorm.DB) string {
+	return models.URLs{}.TableName(db.NamingStrategy)
+}
+
+// migrateURLUniqueIndex creates a unique index on urls.url, so that inserts
+// of a URL already in the table can be skipped with ON CONFLICT DO NOTHING.
+// It fails while the table holds duplicate URLs, which have to be removed
+// first. The index is left in place when the option is turned off again.
+func migrateURLUniqueIndex(db *gorm.DB) error {
+	table := urlsTable(db)
+	index := "idx_" + table + "_url_unique"
+	if db.Migrator().HasIndex(&models.URLs{}, index) {
+		return nil
+	}
+	if err := db.Exec("CREATE UNIQUE INDEX ? ON ? (url)", clause.Table{Name: index}, clause.Table{Name: table}).Error; err != nil {
+		return err
+	}
+	log.Printf("Created unique index %s on %s.url", index, table)
+	return nil
+}
@@ -0,0 +1,104 @@
+package app
+
+import (
+	"os"
+	"slices"
+	"testing"
+
+	"github.com/ofjangra/sqsURLProducer/models"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// testDB connects to the Postgres database in TEST_DATABASE_URL, skipping
+// the test when it is not set, and drops the urls table.
+func testDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	conn, err := gorm.Open(postgres.Open(dsn), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Migrator().DropTable(&models.URLs{}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if sqlDB, err := conn.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	return conn
+}
+
+func TestMigrateSchema(t *testing.T) {
+	tests := []struct {
+		name string
+		// legacy creates the table of an earlier version, if any.
+		legacy []string
+		want   []models.URLStatus
+	}{
+		{
+			name: "fresh table",
+			want: nil,
+		},
+		{
+			name: "processed column",
+			legacy: []string{
+				"CREATE TABLE urls (id bigserial PRIMARY KEY, url text NOT NULL, processed boolean NOT NULL DEFAULT false, claimed_at timestamptz)",
+				"INSERT INTO urls (id, url, processed, claimed_at) VALUES (1, 'url-1', true, NULL), (2, 'url-2', false, now()), (3, 'url-3', false, NULL)",
+			},
+			want: []models.URLStatus{models.StatusSent, models.StatusClaimed, models.StatusPending},
+		},
+		{
+			name: "retry_after column",
+			legacy: []string{
+				"CREATE TABLE urls (id bigserial PRIMARY KEY, url text NOT NULL, status varchar(16) NOT NULL DEFAULT 'pending', claimed_at timestamptz, retry_after timestamptz)",
+				"INSERT INTO urls (id, url, retry_after) VALUES (1, 'url-1', now())",
+			},
+			want: []models.URLStatus{models.StatusPending},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := testDB(t)
+			for _, stmt := range tt.legacy {
+				if err := conn.Exec(stmt).Error; err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := migrateSchema(conn, true, false); err != nil {
+				t.Fatal(err)
+			}
+			m := conn.Migrator()
+			for _, column := range []string{"processed", "retry_after"} {
+				if m.HasColumn(&models.URLs{}, column) {
+					t.Errorf("the %s column is still there", column)
+				}
+			}
+			for column := range expectedURLColumns {
+				if !m.HasColumn(&models.URLs{}, column) {
+					t.Errorf("the %s column is missing", column)
+				}
+			}
+			var got []models.URLStatus
+			if err := conn.Model(&models.URLs{}).Order("id").Pluck("status", &got).Error; err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got statuses %v, want %v", got, tt.want)
+			}
+			if err := verifySchema(conn, true); err != nil {
+				t.Errorf("the migrated schema does not verify: %v", err)
+			}
+			// A second start finds nothing left to migrate.
+			if err := migrateSchema(conn, true, false); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
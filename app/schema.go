@@ -0,0 +1,81 @@
+package app
+
+import (
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/ofjangra/sqsURLProducer/models"
+	"gorm.io/gorm"
+)
+
+// columnKinds groups the Postgres type names that are compatible with each
+// kind of model field.
+var columnKinds = map[string][]string{
+	"integer":   {"int2", "int4", "int8", "smallint", "integer", "bigint"},
+	"text":      {"text", "varchar", "bpchar", "character varying", "character"},
+	"timestamp": {"timestamp", "timestamptz", "timestamp without time zone", "timestamp with time zone"},
+}
+
+// expectedURLColumns is the kind of every column the producer reads or
+// writes on the urls table.
+var expectedURLColumns = map[string]string{
+	"id":              "integer",
+	"url":             "text",
+	"status":          "text",
+	"claimed_at":      "timestamp",
+	"group_key":       "text",
+	"next_attempt_at": "timestamp",
+	"scheduled_at":    "timestamp",
+}
+
+// verifySchema checks, with AUTO_MIGRATE=false, that the urls table has every
+// column the producer uses with a compatible type. Each difference is
+// logged; missing columns or incompatible types fail startup with an error
+// naming them, since every poll would otherwise fail on them. Without
+// statusMarker the status and claimed_at columns are not used and not
+// checked.
+func verifySchema(db *gorm.DB, statusMarker bool) error {
+	m := db.Migrator()
+	if !m.HasTable(&models.URLs{}) {
+		return fmt.Errorf("table %s does not exist", urlsTable(db))
+	}
+	columnTypes, err := m.ColumnTypes(&models.URLs{})
+	if err != nil {
+		return err
+	}
+	actual := make(map[string]string, len(columnTypes))
+	for _, c := range columnTypes {
+		actual[c.Name()] = strings.ToLower(c.DatabaseTypeName())
+	}
+
+	var problems []string
+	expected := maps.Clone(expectedURLColumns)
+	if !statusMarker {
+		delete(expected, "status")
+		delete(expected, "claimed_at")
+	}
+	for _, name := range slices.Sorted(maps.Keys(expected)) {
+		kind := expected[name]
+		typ, ok := actual[name]
+		switch {
+		case !ok:
+			problems = append(problems, fmt.Sprintf("column %s is missing, expected a %s column", name, kind))
+		case !slices.Contains(columnKinds[kind], typ):
+			problems = append(problems, fmt.Sprintf("column %s is %s, expected a %s column", name, typ, kind))
+		}
+	}
+	if _, ok := actual["processed"]; ok && statusMarker {
+		problems = append(problems, "column processed is from before the status column, start once with AUTO_MIGRATE=true to migrate it")
+	}
+	for _, p := range problems {
+		log.Printf("Schema drift: %s", p)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%d schema differences: %s", len(problems), strings.Join(problems, "; "))
+	}
+	log.Println("Schema verified")
+	return nil
+}
@@ -0,0 +1,57 @@
+package app
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ofjangra/sqsURLProducer/models"
+)
+
+func TestVerifySchema(t *testing.T) {
+	tests := []struct {
+		name         string
+		alter        []string
+		statusMarker bool
+		// err is what the error must say, "" for a schema that passes.
+		err string
+	}{
+		{"migrated table", nil, true, ""},
+		{"status column missing", []string{"ALTER TABLE urls DROP COLUMN status"}, true, "column status is missing, expected a text column"},
+		{"status column missing with PROCESSED_MARKER", []string{"ALTER TABLE urls DROP COLUMN status", "ALTER TABLE urls DROP COLUMN claimed_at"}, false, ""},
+		{"url column missing", []string{"ALTER TABLE urls DROP COLUMN url"}, true, "column url is missing, expected a text column"},
+		{"incompatible type", []string{"ALTER TABLE urls DROP COLUMN scheduled_at", "ALTER TABLE urls ADD COLUMN scheduled_at text"}, true, "column scheduled_at is text, expected a timestamp column"},
+		{"processed column left over", []string{"ALTER TABLE urls ADD COLUMN processed boolean"}, true, "column processed is from before the status column"},
+		{"two columns missing", []string{"ALTER TABLE urls DROP COLUMN group_key", "ALTER TABLE urls DROP COLUMN next_attempt_at"}, true, "2 schema differences: column group_key is missing, expected a text column; column next_attempt_at is missing"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := testDB(t)
+			if err := db.AutoMigrate(&models.URLs{}); err != nil {
+				t.Fatal(err)
+			}
+			for _, sql := range tt.alter {
+				if err := db.Exec(sql).Error; err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := verifySchema(db, tt.statusMarker)
+			if tt.err == "" {
+				if err != nil {
+					t.Errorf("got %v, want the schema verified", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("got error %v, want it to contain %q", err, tt.err)
+			}
+		})
+	}
+
+	t.Run("table missing", func(t *testing.T) {
+		db := testDB(t)
+		if err := verifySchema(db, true); err == nil || !strings.Contains(err.Error(), "table urls does not exist") {
+			t.Errorf("got error %v, want the missing table named", err)
+		}
+	})
+}
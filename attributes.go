@@ -0,0 +1,207 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/ofjangra/sqsURLProducer/models"
+)
+
+// MaxMessageAttributes is the most message attributes SQS accepts on one
+// message.
+const MaxMessageAttributes = 10
+
+// messageAttributes returns the SQS message attributes for url, or nil when
+// none are enabled.
+func (p *producer) messageAttributes(url models.URLs) map[string]types.MessageAttributeValue {
+	attrs := map[string]types.MessageAttributeValue{}
+	if p.sequenceAttribute {
+		// Row ids grow with insertion order, so consumers of a standard
+		// queue can use them to restore the order rows were added in. The
+		// tables of SOURCE_TABLES number their rows separately, so there
+		// the sequence only orders the messages of one table.
+		attrs["sequence"] = numberAttribute(uint64(url.ID))
+	}
+	if p.producerID != "" {
+		attrs["producer_id"] = stringAttribute(p.producerID)
+	}
+	if p.sourceHost != "" {
+		attrs["source_host"] = stringAttribute(p.sourceHost)
+	}
+	if p.sourceNode != "" {
+		attrs["source_node"] = stringAttribute(p.sourceNode)
+	}
+	if p.correlationIDs {
+		// With STORE_CORRELATION_ID the id is stored when the row is
+		// marked sent, and a row sent again after that keeps it, so
+		// consumers see one trace per URL. A row retried before it was
+		// ever marked sent gets a new id.
+		id := aws.ToString(url.CorrelationID)
+		if id == "" {
+			id = newUUID()
+		}
+		attrs["correlation_id"] = stringAttribute(id)
+	}
+	for key, value := range p.messageTags {
+		attrs[key] = stringAttribute(value)
+	}
+
+	if len(attrs) == 0 {
+		return nil
+	}
+	return attrs
+}
+
+// setBatchPositions adds the batch_index (from 0) and batch_size attributes
+// to every entry of batch.
+func setBatchPositions(batch outboundBatch) {
+	size := numberAttribute(uint64(len(batch.entries)))
+	for i := range batch.entries {
+		if batch.entries[i].MessageAttributes == nil {
+			batch.entries[i].MessageAttributes = map[string]types.MessageAttributeValue{}
+		}
+		batch.entries[i].MessageAttributes["batch_index"] = numberAttribute(uint64(i))
+		batch.entries[i].MessageAttributes["batch_size"] = size
+	}
+}
+
+// batchPositionBytes is the most bytes the batch_index and batch_size
+// attributes add to a message of a batch of up to batchSize messages. They
+// are only set once a batch is complete, so batches reserve this much per
+// message for them.
+func batchPositionBytes(batchSize int) int {
+	digits := len(strconv.Itoa(batchSize))
+	return len("batch_index") + len("batch_size") + 2*(len("Number")+digits)
+}
+
+func numberAttribute(n uint64) types.MessageAttributeValue {
+	return types.MessageAttributeValue{
+		DataType:    aws.String("Number"),
+		StringValue: aws.String(strconv.FormatUint(n, 10)),
+	}
+}
+
+func stringAttribute(s string) types.MessageAttributeValue {
+	return types.MessageAttributeValue{
+		DataType:    aws.String("String"),
+		StringValue: aws.String(s),
+	}
+}
+
+// producerInstanceID identifies this process in the producer_id attribute.
+// It is the HOSTNAME, which is the pod name on Kubernetes, or a random UUID
+// when that is unset, and is computed once so every message of a process
+// carries the same value.
+func producerInstanceID() string {
+	if host := os.Getenv("HOSTNAME"); host != "" {
+		return host
+	}
+	return newUUID()
+}
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	b[6] = b[6]&0x0f | 0x40 // version 4
+	b[8] = b[8]&0x3f | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// sourceHost is the host name for the source_host attribute: HOSTNAME, which
+// is the pod name on Kubernetes, or the kernel's host name.
+func sourceHost() string {
+	if host := os.Getenv("HOSTNAME"); host != "" {
+		return host
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		log.Printf("Failed to look up the host name for source_host: %v", err)
+	}
+	return host
+}
+
+// EntryIDPollPlaceholder in ENTRY_ID_PREFIX is replaced by the number of the
+// poll, counted from 1 since startup.
+const EntryIDPollPlaceholder = "{poll}"
+
+// entryIDPattern is the character set SQS allows in batch entry ids.
+var entryIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]*$`)
+
+// validEntryIDPrefix checks that ids built from prefix stay valid batch entry
+// ids: at most 80 letters, digits, '-' or '_'. Room is left for the longest
+// poll and message numbers.
+func validEntryIDPrefix(prefix string) error {
+	rest := strings.ReplaceAll(prefix, EntryIDPollPlaceholder, "")
+	longest := len(rest) + strings.Count(prefix, EntryIDPollPlaceholder)*maxIntDigits + len("msg-") + maxIntDigits
+	switch {
+	case !entryIDPattern.MatchString(rest):
+		return fmt.Errorf("invalid entry id prefix %q, expected letters, digits, '-', '_' or %s", prefix, EntryIDPollPlaceholder)
+	case longest > MaxEntryIDLength:
+		return fmt.Errorf("entry id prefix %q is too long, ids built from it may reach %d characters, SQS allows %d", prefix, longest, MaxEntryIDLength)
+	}
+	return nil
+}
+
+const (
+	// MaxEntryIDLength is the longest batch entry id SQS accepts.
+	MaxEntryIDLength = 80
+	maxIntDigits     = 19
+)
+
+// attributeNamePattern is the character set SQS allows in attribute names.
+var attributeNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,256}$`)
+
+// reservedAttributes are set by the producer itself and cannot be tags.
+var reservedAttributes = []string{"sequence", "producer_id", "source_host", "source_node", "correlation_id", "batch_index", "batch_size"}
+
+// parseMessageTags parses MESSAGE_TAGS, a comma-separated list of key=value
+// pairs attached to every message as String attributes. Keys must be valid
+// SQS attribute names and values must not be empty.
+func parseMessageTags(value string) (map[string]string, error) {
+	if value == "" {
+		return nil, nil
+	}
+	tags := map[string]string{}
+	for _, pair := range strings.Split(value, ",") {
+		key, val, ok := strings.Cut(pair, "=")
+		key, val = strings.TrimSpace(key), strings.TrimSpace(val)
+		if !ok || val == "" {
+			return nil, fmt.Errorf("invalid message tag %q, expected key=value", pair)
+		}
+		if err := validAttributeName(key); err != nil {
+			return nil, err
+		}
+		if _, dup := tags[key]; dup {
+			return nil, fmt.Errorf("message tag %q is set twice", key)
+		}
+		tags[key] = val
+	}
+	return tags, nil
+}
+
+func validAttributeName(name string) error {
+	lower := strings.ToLower(name)
+	switch {
+	case !attributeNamePattern.MatchString(name):
+		return fmt.Errorf("invalid attribute name %q, expected up to 256 letters, digits, '_', '-' or '.'", name)
+	case strings.HasPrefix(lower, "aws.") || strings.HasPrefix(lower, "amazon."):
+		return fmt.Errorf("invalid attribute name %q, the AWS. and Amazon. prefixes are reserved", name)
+	case strings.HasPrefix(name, ".") || strings.HasSuffix(name, ".") || strings.Contains(name, ".."):
+		return fmt.Errorf("invalid attribute name %q, it may not start or end with '.' or contain '..'", name)
+	}
+	if slices.Contains(reservedAttributes, name) {
+		return fmt.Errorf("invalid attribute name %q, it is set by the producer", name)
+	}
+	return nil
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"maps"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/ofjangra/sqsURLProducer/models"
+)
+
+// attribute returns the value of entry's attribute name, "" if it is unset.
+func attribute(entry types.SendMessageBatchRequestEntry, name string) string {
+	return aws.ToString(entry.MessageAttributes[name].StringValue)
+}
+
+func TestBatchPositions(t *testing.T) {
+	tests := []struct {
+		name  string
+		rows  int
+		sizes []int
+	}{
+		{"one full batch", 3, []int{3}},
+		{"a full and a partial batch", 5, []int{3, 2}},
+		{"a single message", 1, []int{1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestProducer(dryRunDB(t, nil), &fakeSQS{})
+			p.batchSize, p.batchPositions = 3, true
+			batches, _ := p.buildBatches(testRows(tt.rows))
+			if len(batches) != len(tt.sizes) {
+				t.Fatalf("got %d batches, want %d", len(batches), len(tt.sizes))
+			}
+			for b, batch := range batches {
+				if len(batch.entries) != tt.sizes[b] {
+					t.Fatalf("batch %d: got %d entries, want %d", b, len(batch.entries), tt.sizes[b])
+				}
+				for i, entry := range batch.entries {
+					index, size := attribute(entry, "batch_index"), attribute(entry, "batch_size")
+					if index != strconv.Itoa(i) || size != strconv.Itoa(tt.sizes[b]) {
+						t.Errorf("batch %d entry %d: got batch_index %s and batch_size %s", b, i, index, size)
+					}
+					if got := entry.MessageAttributes["batch_index"].DataType; aws.ToString(got) != "Number" {
+						t.Errorf("batch %d entry %d: got data type %q, want Number", b, i, aws.ToString(got))
+					}
+				}
+			}
+		})
+	}
+
+	// Without BATCH_POSITIONS no attributes are set.
+	p := newTestProducer(dryRunDB(t, nil), &fakeSQS{})
+	batches, _ := p.buildBatches(testRows(2))
+	if attrs := batches[0].entries[0].MessageAttributes; attrs != nil {
+		t.Errorf("got attributes %v, want none", attrs)
+	}
+}
+
+func TestBatchPositionBytes(t *testing.T) {
+	// The reservation covers the attributes of the largest index and size.
+	for _, batchSize := range []int{1, 9, 10} {
+		p := newTestProducer(dryRunDB(t, nil), &fakeSQS{})
+		p.batchSize, p.batchPositions = batchSize, true
+		batches, _ := p.buildBatches(testRows(batchSize))
+		last := batches[0].entries[batchSize-1]
+		body := len(aws.ToString(last.MessageBody))
+		if size := messageSize(last); size-body > batchPositionBytes(batchSize) {
+			t.Errorf("batch size %d: attributes take %d bytes, more than the %d reserved", batchSize, size-body, batchPositionBytes(batchSize))
+		}
+	}
+}
+
+func TestSourceAttributes(t *testing.T) {
+	t.Setenv("HOSTNAME", "pod-7")
+	if host := sourceHost(); host != "pod-7" {
+		t.Errorf("got source host %q, want HOSTNAME", host)
+	}
+	t.Setenv("HOSTNAME", "")
+	if host, _ := os.Hostname(); sourceHost() != host {
+		t.Errorf("got source host %q without HOSTNAME, want the kernel's %q", sourceHost(), host)
+	}
+
+	p := newTestProducer(dryRunDB(t, nil), &fakeSQS{})
+	p.sourceHost, p.sourceNode = "pod-7", "node-3"
+	batches, _ := p.buildBatches(testRows(2))
+	for _, entry := range batches[0].entries {
+		if host, node := attribute(entry, "source_host"), attribute(entry, "source_node"); host != "pod-7" || node != "node-3" {
+			t.Errorf("got source_host %q and source_node %q", host, node)
+		}
+	}
+
+	// Without NODE_NAME there is no source_node attribute.
+	p.sourceNode = ""
+	batches, _ = p.buildBatches(testRows(1))
+	if _, ok := batches[0].entries[0].MessageAttributes["source_node"]; ok {
+		t.Error("got a source_node attribute without NODE_NAME")
+	}
+}
+
+func TestEntryIDPrefix(t *testing.T) {
+	tests := []struct {
+		prefix string
+		first  string
+		err    string
+	}{
+		{"", "msg-1", ""},
+		{"prod_", "prod_msg-1", ""},
+		{"poll-{poll}-", "poll-7-msg-1", ""},
+		{"bad prefix", "", "invalid entry id prefix"},
+		{"bad.", "", "invalid entry id prefix"},
+		// Room is left for "msg-" and a message number of 19 digits.
+		{strings.Repeat("a", 57), strings.Repeat("a", 57) + "msg-1", ""},
+		{strings.Repeat("a", 58), "", "too long"},
+		{"{poll}{poll}{poll}", "777msg-1", ""},
+		{"{poll}{poll}{poll}-", "", "too long"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.prefix, func(t *testing.T) {
+			err := validEntryIDPrefix(tt.prefix)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			p := newTestProducer(dryRunDB(t, nil), &fakeSQS{})
+			p.entryIDPrefix, p.pollCount = tt.prefix, 7
+			batches, _ := p.buildBatches(testRows(3))
+			ids := map[string]bool{}
+			for _, entry := range batches[0].entries {
+				id := aws.ToString(entry.Id)
+				if !entryIDPattern.MatchString(id) || len(id) > MaxEntryIDLength {
+					t.Errorf("got invalid entry id %q", id)
+				}
+				ids[id] = true
+			}
+			if id := aws.ToString(batches[0].entries[0].Id); id != tt.first {
+				t.Errorf("got first entry id %q, want %q", id, tt.first)
+			}
+			if len(ids) != 3 {
+				t.Errorf("got entry ids %v, want 3 distinct", ids)
+			}
+		})
+	}
+}
+
+// uuidPattern matches a version 4 UUID.
+var uuidPattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+func TestCorrelationIDs(t *testing.T) {
+	p := newTestProducer(dryRunDB(t, nil), &fakeSQS{})
+	p.correlationIDs = true
+	rows := testRows(50)
+	stored := "0f8fad5b-d9cb-469f-a165-70867728950e"
+	rows[9].CorrelationID = &stored
+
+	batches, _ := p.buildBatches(rows)
+	seen := map[string]bool{}
+	for _, batch := range batches {
+		for i, entry := range batch.entries {
+			id := attribute(entry, "correlation_id")
+			if batch.ids[i] == 10 {
+				if id != stored {
+					t.Errorf("URL 10: got correlation id %q, want the stored %q", id, stored)
+				}
+				continue
+			}
+			if !uuidPattern.MatchString(id) {
+				t.Errorf("URL %d: got correlation id %q, want a UUID", batch.ids[i], id)
+			}
+			if seen[id] {
+				t.Errorf("URL %d: correlation id %q is not unique", batch.ids[i], id)
+			}
+			seen[id] = true
+		}
+	}
+}
+
+func TestStoreCorrelationID(t *testing.T) {
+	db := testDB(t)
+	insertRows(t, db, "urls", pending, pending, pending)
+	client := &fakeSQS{}
+	p := newTestProducer(db, client)
+	p.correlationIDs, p.storeCorrelation = true, true
+
+	if _, err := p.processURLs(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	sentIDs := map[string]string{}
+	for _, req := range client.requests {
+		for _, entry := range req.Entries {
+			sentIDs[aws.ToString(entry.MessageBody)] = attribute(entry, "correlation_id")
+		}
+	}
+	var rows []models.URLs
+	if err := db.Table("urls").Order("id").Find(&rows).Error; err != nil {
+		t.Fatal(err)
+	}
+	for _, row := range rows {
+		if got, want := aws.ToString(row.CorrelationID), sentIDs[row.URL]; got == "" || got != want {
+			t.Errorf("URL %d: stored correlation id %q, want the sent %q", row.ID, got, want)
+		}
+	}
+}
+
+func TestParseMessageTags(t *testing.T) {
+	tests := []struct {
+		value string
+		tags  map[string]string
+		err   string
+	}{
+		{"", nil, ""},
+		{"env=prod", map[string]string{"env": "prod"}, ""},
+		{" env = prod , team=data,pipeline.version=1.2=rc ", map[string]string{"env": "prod", "team": "data", "pipeline.version": "1.2=rc"}, ""},
+		{"env", nil, "expected key=value"},
+		{"env=", nil, "expected key=value"},
+		{"env=prod,env=dev", nil, "set twice"},
+		{"my tag=x", nil, "invalid attribute name"},
+		{"AWS.trace=x", nil, "prefixes are reserved"},
+		{"amazon.id=x", nil, "prefixes are reserved"},
+		{".env=x", nil, "may not start or end with '.'"},
+		{"a..b=x", nil, "contain '..'"},
+		{"sequence=1", nil, "set by the producer"},
+		{"correlation_id=abc", nil, "set by the producer"},
+		{"batch_size=3", nil, "set by the producer"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			tags, err := parseMessageTags(tt.value)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !maps.Equal(tags, tt.tags) {
+				t.Errorf("got tags %v, want %v", tags, tt.tags)
+			}
+		})
+	}
+}
+
+func TestMessageTagsOnEveryEntry(t *testing.T) {
+	p := newTestProducer(dryRunDB(t, nil), &fakeSQS{})
+	p.messageTags = map[string]string{"env": "prod", "team": "data"}
+	batches, _ := p.buildBatches(testRows(25))
+	entries := 0
+	for _, batch := range batches {
+		for _, entry := range batch.entries {
+			entries++
+			if env, team := attribute(entry, "env"), attribute(entry, "team"); env != "prod" || team != "data" {
+				t.Errorf("entry %s: got env %q and team %q", aws.ToString(entry.Id), env, team)
+			}
+		}
+	}
+	if entries != 25 {
+		t.Errorf("got %d entries, want 25", entries)
+	}
+}
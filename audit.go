@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/ofjangra/sqsURLProducer/app"
+	"github.com/ofjangra/sqsURLProducer/models"
+	"gorm.io/gorm"
+	"gorm.io/plugin/dbresolver"
+)
+
+// AuditSink selects where a record of every message SQS accepted is kept,
+// separately from the application log.
+//
+//   - AuditNone (the default) keeps no record.
+//   - AuditFile appends one JSON object per message to AUDIT_FILE.
+//   - AuditTable inserts rows into the dispatch_audit table.
+type AuditSink string
+
+const (
+	AuditNone  AuditSink = "none"
+	AuditFile  AuditSink = "file"
+	AuditTable AuditSink = "table"
+)
+
+func parseAuditSink(value string) (AuditSink, error) {
+	switch s := AuditSink(value); s {
+	case AuditNone, AuditFile, AuditTable:
+		return s, nil
+	}
+	return "", fmt.Errorf("invalid audit sink %q, expected %s, %s or %s", value, AuditNone, AuditFile, AuditTable)
+}
+
+type auditor interface {
+	record(records []models.DispatchAudit) error
+}
+
+// newAuditor opens the configured sink. It returns nil for AuditNone.
+func newAuditor(sink AuditSink, path string) (auditor, error) {
+	switch sink {
+	case AuditFile:
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+		if err != nil {
+			return nil, err
+		}
+		return &fileAuditor{enc: json.NewEncoder(f)}, nil
+	case AuditTable:
+		if !app.AutoMigrate() {
+			m := app.GetDB().Migrator()
+			if !m.HasTable(&models.DispatchAudit{}) {
+				return nil, errors.New("AUTO_MIGRATE is off and the dispatch_audit table does not exist")
+			}
+			if !m.HasColumn(&models.DispatchAudit{}, "source_table") {
+				return nil, errors.New("AUTO_MIGRATE is off and the dispatch_audit table has no source_table column, start once with AUTO_MIGRATE=true to add it")
+			}
+			return tableAuditor{db: app.GetDB}, nil
+		}
+		if err := app.GetDB().AutoMigrate(&models.DispatchAudit{}); err != nil {
+			return nil, err
+		}
+		return tableAuditor{db: app.GetDB}, nil
+	}
+	return nil, nil
+}
+
+type fileAuditor struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func (a *fileAuditor) record(records []models.DispatchAudit) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, r := range records {
+		if err := a.enc.Encode(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type tableAuditor struct {
+	// db is the database holding dispatch_audit, app.GetDB outside tests.
+	db func() *gorm.DB
+}
+
+// record inserts records after counting the URLs among them that already
+// have a record for the same queue and source table, i.e. were sent before,
+// typically because marking them sent failed. Records passed together are
+// always of one queue and table. The check reads the primary, since a
+// lagging DB_REPLICA_DSN replica would miss the records of recent sends.
+func (a tableAuditor) record(records []models.DispatchAudit) error {
+	if len(records) == 0 {
+		return nil
+	}
+	ids := make([]uint, len(records))
+	for i, r := range records {
+		ids[i] = r.URLID
+	}
+	var resent []uint
+	err := a.db().Clauses(dbresolver.Write).Model(&models.DispatchAudit{}).
+		Distinct("url_id").
+		Where("url_id IN ? AND queue_url = ? AND source_table = ?", ids, records[0].QueueURL, records[0].SourceTable).
+		Pluck("url_id", &resent).Error
+	if err != nil {
+		log.Printf("Failed to check the audit table for repeated sends: %v", err)
+	} else if len(resent) > 0 {
+		duplicateSendsSuspected.Add(uint64(len(resent)))
+		log.Printf("Sent %d URLs that were already recorded as sent, e.g. URL %d", len(resent), resent[0])
+	}
+	return a.db().Create(&records).Error
+}
+
+// audit records the entries of batch that SQS reported as successful. A
+// failure to write the audit trail is logged but does not fail the send.
+// Suspected duplicates are only counted by the table sink, the one that
+// keeps the earlier sends to check against, see tableAuditor.record.
+func (p *producer) audit(batch outboundBatch, successful []types.SendMessageBatchResultEntry) {
+	if p.auditor == nil || len(successful) == 0 {
+		return
+	}
+
+	urlIDs := batch.urlIDs()
+	now := time.Now()
+	records := make([]models.DispatchAudit, 0, len(successful))
+	for _, s := range successful {
+		urlID, ok := urlIDs[aws.ToString(s.Id)]
+		if !ok {
+			continue
+		}
+		records = append(records, models.DispatchAudit{
+			URLID:       urlID,
+			QueueURL:    p.queueURL,
+			SourceTable: p.db.Statement.Table,
+			SentAt:      now,
+			MessageID:   aws.ToString(s.MessageId),
+		})
+	}
+	if err := p.auditor.record(records); err != nil {
+		log.Printf("Failed to write %d audit records: %v", len(records), err)
+	}
+}
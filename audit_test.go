@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ofjangra/sqsURLProducer/models"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/plugin/dbresolver"
+)
+
+func TestFileAuditor(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	a, err := newAuditor(AuditFile, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &fakeSQS{fail: func(call int, body string) (string, bool, bool) {
+		return "InternalError", false, body == "url-2"
+	}}
+	p := newTestProducer(dryRunDB(t, nil), client)
+	p.retryBudget = time.Nanosecond
+	p.auditor = a
+	batches, _ := p.buildBatches(testRows(3))
+
+	start := time.Now()
+	var result ProcessResult
+	p.deliverBatch(context.Background(), batches[0], &result)
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var records []models.DispatchAudit
+	for scanner := bufio.NewScanner(f); scanner.Scan(); {
+		var r models.DispatchAudit
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatalf("bad audit line %q: %v", scanner.Text(), err)
+		}
+		records = append(records, r)
+	}
+
+	// Only the sends SQS accepted are recorded.
+	want := map[uint]string{1: "m-url-1", 3: "m-url-3"}
+	if len(records) != len(want) {
+		t.Fatalf("got %d audit records, want %d: %+v", len(records), len(want), records)
+	}
+	for _, r := range records {
+		if r.MessageID != want[r.URLID] {
+			t.Errorf("URL %d: got message id %q, want %q", r.URLID, r.MessageID, want[r.URLID])
+		}
+		if r.QueueURL != testQueueURL {
+			t.Errorf("URL %d: got queue %q", r.URLID, r.QueueURL)
+		}
+		if r.SentAt.Before(start) {
+			t.Errorf("URL %d: got sent_at %s, before the send", r.URLID, r.SentAt)
+		}
+	}
+}
+
+func TestTableAuditorDuplicates(t *testing.T) {
+	db := testDB(t)
+	if err := db.Migrator().DropTable(&models.DispatchAudit{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&models.DispatchAudit{}); err != nil {
+		t.Fatal(err)
+	}
+	// A replica that fails every query, so the check only finds the
+	// earlier sends on the primary.
+	replica, err := sql.Open("pgx", os.Getenv("TEST_DATABASE_URL"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Use(dbresolver.Register(dbresolver.Config{Replicas: []gorm.Dialector{postgres.New(postgres.Config{Conn: replica})}})); err != nil {
+		t.Fatal(err)
+	}
+	replica.Close()
+	a := tableAuditor{db: func() *gorm.DB { return db }}
+	send := func(table string, ids ...uint) {
+		t.Helper()
+		records := make([]models.DispatchAudit, len(ids))
+		for i, id := range ids {
+			records[i] = models.DispatchAudit{URLID: id, QueueURL: testQueueURL, SourceTable: table, SentAt: time.Now(), MessageID: "m"}
+		}
+		if err := a.record(records); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	before := duplicateSendsSuspected.Value()
+	send("", 1, 2)
+	send("urls_news", 1)
+	if got := duplicateSendsSuspected.Value() - before; got != 0 {
+		t.Fatalf("got %d suspected duplicates after first sends, want 0", got)
+	}
+	// URL 2 is sent again, URL 3 for the first time.
+	send("", 2, 3)
+	if got := duplicateSendsSuspected.Value() - before; got != 1 {
+		t.Errorf("got %d suspected duplicates, want 1", got)
+	}
+
+	var count int64
+	if err := db.Clauses(dbresolver.Write).Model(&models.DispatchAudit{}).Count(&count).Error; err != nil {
+		t.Fatal(err)
+	}
+	if count != 5 {
+		t.Errorf("got %d audit rows, want 5", count)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+)
+
+// loadAWSConfig builds the AWS configuration shared by the producer and the
+// optional subcommands from the IAM_* and AWS_* environment variables.
+func loadAWSConfig(ctx context.Context) (aws.Config, error) {
+	cfg, err := config.LoadDefaultConfig(ctx, awsConfigOptions()...)
+	if err != nil {
+		return aws.Config{}, err
+	}
+	if cfg.Region == "" {
+		return aws.Config{}, errors.New("no AWS region configured, set AWS_REGION or a region in the AWS profile")
+	}
+	if !regionPattern.MatchString(cfg.Region) {
+		// The SDK accepts any region and only fails to resolve the
+		// endpoint on the first request.
+		return aws.Config{}, fmt.Errorf("invalid AWS region %q, expected a region code such as us-east-1", cfg.Region)
+	}
+	return cfg, nil
+}
+
+// regionPattern matches AWS region codes such as us-east-1, us-gov-west-1,
+// ap-southeast-5 or eusc-de-east-1, whose partition prefix can be longer
+// than a country code.
+var regionPattern = regexp.MustCompile(`^[a-z]{2,4}(-[a-z]+)+-[0-9]+$`)
+
+// awsConfigOptions picks the retry mode, the endpoint variant, the HTTP
+// client and the credential source. Static IAM_ACCESS_KEY and
+// IAM_SECRET (or the files named by IAM_ACCESS_KEY_FILE and IAM_SECRET_FILE)
+// win when both are set; otherwise AWS_PROFILE selects a named
+// profile from the shared config files, and with neither the SDK's default
+// credential chain (environment, shared config, instance role) is used.
+func awsConfigOptions() []func(*config.LoadOptions) error {
+	var opts []func(*config.LoadOptions) error
+	if region := os.Getenv("AWS_REGION"); region != "" {
+		opts = append(opts, config.WithRegion(region))
+	}
+
+	// adaptive adds client-side rate limiting that kicks in on throttling
+	// errors, which suits bursty backlogs better than plain retries.
+	retryMode, err := aws.ParseRetryMode(getEnvDefault("AWS_RETRY_MODE", string(aws.RetryModeStandard)))
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	opts = append(opts, config.WithRetryMode(retryMode))
+
+	// Compliance environments may require FIPS 140 validated or IPv6
+	// capable endpoints. The SDK's own AWS_USE_FIPS_ENDPOINT and
+	// AWS_USE_DUALSTACK_ENDPOINT still apply when these are unset.
+	if getEnvBool("AWS_USE_FIPS", false) {
+		log.Println("Using FIPS endpoints")
+		opts = append(opts, config.WithUseFIPSEndpoint(aws.FIPSEndpointStateEnabled))
+	}
+	if getEnvBool("AWS_USE_DUALSTACK", false) {
+		log.Println("Using dual-stack endpoints")
+		opts = append(opts, config.WithUseDualStackEndpoint(aws.DualStackEndpointStateEnabled))
+	}
+	opts = append(opts, config.WithHTTPClient(httpClient()))
+
+	accessKeyID := getEnvOrFile("IAM_ACCESS_KEY")
+	secretAccessKey := getEnvOrFile("IAM_SECRET")
+	profile := os.Getenv("AWS_PROFILE")
+	switch {
+	case accessKeyID != "" && secretAccessKey != "":
+		opts = append(opts, config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(accessKeyID, secretAccessKey, "")))
+	case accessKeyID != "" || secretAccessKey != "":
+		log.Fatal("IAM_ACCESS_KEY and IAM_SECRET must be set together")
+	case profile != "":
+		log.Printf("Using AWS profile %q", profile)
+		opts = append(opts, config.WithSharedConfigProfile(profile))
+	default:
+		log.Println("No static AWS credentials configured, using the default credential chain")
+	}
+	return opts
+}
+
+// getEnvOrFile returns the contents of the file named by key_FILE, trimmed of
+// surrounding whitespace, when that is set, and the value of key otherwise.
+// Mounted secret files keep credentials out of the process environment.
+func getEnvOrFile(key string) string {
+	path := os.Getenv(key + "_FILE")
+	if path == "" {
+		return os.Getenv(key)
+	}
+	if os.Getenv(key) != "" {
+		log.Printf("Both %s and %s_FILE are set, using the file", key, key)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatalf("Failed to read %s_FILE: %v", key, err)
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// httpClient is the SDK's default HTTP client with its connection pool sized
+// by SQS_MAX_IDLE_CONNS, SQS_MAX_IDLE_CONNS_PER_HOST and
+// SQS_IDLE_CONN_TIMEOUT. Every SendMessageBatch goes to the same host, so
+// keeping enough idle connections to it saves a TLS handshake per request
+// under load.
+func httpClient() *awshttp.BuildableClient {
+	maxIdle := getEnvInt("SQS_MAX_IDLE_CONNS", awshttp.DefaultHTTPTransportMaxIdleConns)
+	maxIdlePerHost := getEnvInt("SQS_MAX_IDLE_CONNS_PER_HOST", awshttp.DefaultHTTPTransportMaxIdleConnsPerHost)
+	idleTimeout := getEnvDuration("SQS_IDLE_CONN_TIMEOUT", awshttp.DefaultHTTPTransportIdleConnTimeout)
+	if maxIdle < 0 || maxIdlePerHost < 0 || idleTimeout < 0 {
+		log.Fatal("SQS_MAX_IDLE_CONNS, SQS_MAX_IDLE_CONNS_PER_HOST and SQS_IDLE_CONN_TIMEOUT must not be negative")
+	}
+	return awshttp.NewBuildableClient().WithTransportOptions(func(tr *http.Transport) {
+		tr.MaxIdleConns = maxIdle
+		tr.MaxIdleConnsPerHost = maxIdlePerHost
+		tr.IdleConnTimeout = idleTimeout
+	})
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+)
+
+// awsEnv clears the variables awsConfigOptions and the SDK read, points the
+// shared config files at an empty file, and then sets env.
+func awsEnv(t *testing.T, env map[string]string) {
+	t.Helper()
+	empty := filepath.Join(t.TempDir(), "empty")
+	if err := os.WriteFile(empty, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{
+		"AWS_REGION", "AWS_DEFAULT_REGION", "AWS_PROFILE", "AWS_RETRY_MODE", "AWS_USE_FIPS", "AWS_USE_DUALSTACK",
+		"AWS_USE_FIPS_ENDPOINT", "AWS_USE_DUALSTACK_ENDPOINT",
+		"IAM_ACCESS_KEY", "IAM_ACCESS_KEY_FILE", "IAM_SECRET", "IAM_SECRET_FILE",
+		"SQS_MAX_IDLE_CONNS", "SQS_MAX_IDLE_CONNS_PER_HOST", "SQS_IDLE_CONN_TIMEOUT",
+	} {
+		t.Setenv(key, "")
+	}
+	t.Setenv("AWS_CONFIG_FILE", empty)
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", empty)
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	for key, value := range env {
+		t.Setenv(key, value)
+	}
+}
+
+// loadOptions applies the options awsConfigOptions builds from env.
+func loadOptions(t *testing.T, env map[string]string) config.LoadOptions {
+	t.Helper()
+	awsEnv(t, env)
+	var o config.LoadOptions
+	for _, opt := range awsConfigOptions() {
+		if err := opt(&o); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return o
+}
+
+func TestAWSProfile(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		profile string
+		static  bool
+	}{
+		{"default credential chain", nil, "", false},
+		{"profile", map[string]string{"AWS_PROFILE": "dev"}, "dev", false},
+		{"static keys win over the profile", map[string]string{"AWS_PROFILE": "dev", "IAM_ACCESS_KEY": "AKID", "IAM_SECRET": "secret"}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := loadOptions(t, tt.env)
+			if o.SharedConfigProfile != tt.profile {
+				t.Errorf("got profile %q, want %q", o.SharedConfigProfile, tt.profile)
+			}
+			if static := o.Credentials != nil; static != tt.static {
+				t.Errorf("got static credentials: %v, want %v", static, tt.static)
+			}
+		})
+	}
+}
+
+func TestAWSProfileRegion(t *testing.T) {
+	awsEnv(t, map[string]string{"AWS_PROFILE": "dev"})
+	path := filepath.Join(t.TempDir(), "config")
+	if err := os.WriteFile(path, []byte("[profile dev]\nregion = eu-west-2\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("AWS_CONFIG_FILE", path)
+
+	cfg, err := loadAWSConfig(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Region != "eu-west-2" {
+		t.Errorf("got region %q, want the profile's eu-west-2", cfg.Region)
+	}
+}
+
+func TestAWSRetryMode(t *testing.T) {
+	tests := []struct {
+		value string
+		want  aws.RetryMode
+	}{
+		{"", aws.RetryModeStandard},
+		{"standard", aws.RetryModeStandard},
+		{"adaptive", aws.RetryModeAdaptive},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			o := loadOptions(t, map[string]string{"AWS_REGION": "us-east-1", "AWS_RETRY_MODE": tt.value})
+			if o.RetryMode != tt.want {
+				t.Errorf("got option %q, want %q", o.RetryMode, tt.want)
+			}
+			cfg, err := loadAWSConfig(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.RetryMode != tt.want {
+				t.Errorf("got loaded retry mode %q, want %q", cfg.RetryMode, tt.want)
+			}
+		})
+	}
+}
+
+func TestAWSTransport(t *testing.T) {
+	tests := []struct {
+		name           string
+		env            map[string]string
+		maxIdle        int
+		maxIdlePerHost int
+		idleTimeout    time.Duration
+	}{
+		{"SDK defaults", nil, awshttp.DefaultHTTPTransportMaxIdleConns, awshttp.DefaultHTTPTransportMaxIdleConnsPerHost, awshttp.DefaultHTTPTransportIdleConnTimeout},
+		{"tuned", map[string]string{"SQS_MAX_IDLE_CONNS": "200", "SQS_MAX_IDLE_CONNS_PER_HOST": "64", "SQS_IDLE_CONN_TIMEOUT": "2m"}, 200, 64, 2 * time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := loadOptions(t, tt.env)
+			client, ok := o.HTTPClient.(*awshttp.BuildableClient)
+			if !ok {
+				t.Fatalf("got HTTP client %T, want *http.BuildableClient", o.HTTPClient)
+			}
+			tr := client.GetTransport()
+			if tr.MaxIdleConns != tt.maxIdle || tr.MaxIdleConnsPerHost != tt.maxIdlePerHost || tr.IdleConnTimeout != tt.idleTimeout {
+				t.Errorf("got MaxIdleConns %d, MaxIdleConnsPerHost %d and IdleConnTimeout %s, want %d, %d and %s",
+					tr.MaxIdleConns, tr.MaxIdleConnsPerHost, tr.IdleConnTimeout, tt.maxIdle, tt.maxIdlePerHost, tt.idleTimeout)
+			}
+		})
+	}
+}
+
+func TestAWSCredentialFiles(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	keyFile, secretFile := write("key", "AKIDFROMFILE\n"), write("secret", "  secret-from-file \n")
+
+	tests := []struct {
+		name   string
+		env    map[string]string
+		key    string
+		secret string
+	}{
+		{"inline", map[string]string{"IAM_ACCESS_KEY": "AKID", "IAM_SECRET": "secret"}, "AKID", "secret"},
+		{"files", map[string]string{"IAM_ACCESS_KEY_FILE": keyFile, "IAM_SECRET_FILE": secretFile}, "AKIDFROMFILE", "secret-from-file"},
+		{"files win over inline values", map[string]string{"IAM_ACCESS_KEY": "AKID", "IAM_ACCESS_KEY_FILE": keyFile, "IAM_SECRET": "secret", "IAM_SECRET_FILE": secretFile}, "AKIDFROMFILE", "secret-from-file"},
+		{"a file and an inline value", map[string]string{"IAM_ACCESS_KEY_FILE": keyFile, "IAM_SECRET": "secret"}, "AKIDFROMFILE", "secret"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := loadOptions(t, tt.env)
+			if o.Credentials == nil {
+				t.Fatal("got no static credentials")
+			}
+			creds, err := o.Credentials.Retrieve(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if creds.AccessKeyID != tt.key || creds.SecretAccessKey != tt.secret {
+				t.Errorf("got key %q and secret %q, want %q and %q", creds.AccessKeyID, creds.SecretAccessKey, tt.key, tt.secret)
+			}
+		})
+	}
+}
+
+func TestAWSRegion(t *testing.T) {
+	tests := []struct {
+		region string
+		valid  bool
+	}{
+		{"us-east-1", true},
+		{"us-gov-west-1", true},
+		{"ap-southeast-5", true},
+		{"cn-northwest-1", true},
+		{"eusc-de-east-1", true},
+		{"", false},
+		{"us-east", false},
+		{"US-EAST-1", false},
+		{"useast1", false},
+		{"us-east-1 ", false},
+		{"u-east-1", false},
+		{"europe-west-1", false},
+		{"https://sqs.us-east-1.amazonaws.com", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.region, func(t *testing.T) {
+			awsEnv(t, map[string]string{"AWS_REGION": tt.region})
+			cfg, err := loadAWSConfig(context.Background())
+			if !tt.valid {
+				want := "invalid AWS region"
+				if tt.region == "" {
+					want = "no AWS region configured"
+				}
+				if err == nil || !strings.Contains(err.Error(), want) {
+					t.Fatalf("got error %v, want %q", err, want)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Region != tt.region {
+				t.Errorf("got region %q", cfg.Region)
+			}
+		})
+	}
+}
+
+func TestAWSEndpointVariants(t *testing.T) {
+	tests := []struct {
+		name      string
+		env       map[string]string
+		fips      aws.FIPSEndpointState
+		dualStack aws.DualStackEndpointState
+	}{
+		{"defaults", nil, aws.FIPSEndpointStateUnset, aws.DualStackEndpointStateUnset},
+		{"FIPS", map[string]string{"AWS_USE_FIPS": "true"}, aws.FIPSEndpointStateEnabled, aws.DualStackEndpointStateUnset},
+		{"dual-stack", map[string]string{"AWS_USE_DUALSTACK": "true"}, aws.FIPSEndpointStateUnset, aws.DualStackEndpointStateEnabled},
+		{"both", map[string]string{"AWS_USE_FIPS": "true", "AWS_USE_DUALSTACK": "true"}, aws.FIPSEndpointStateEnabled, aws.DualStackEndpointStateEnabled},
+		// The SDK's own variables still apply.
+		{"SDK variable", map[string]string{"AWS_USE_FIPS_ENDPOINT": "true"}, aws.FIPSEndpointStateEnabled, aws.DualStackEndpointStateUnset},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			awsEnv(t, tt.env)
+			t.Setenv("AWS_REGION", "us-east-1")
+			cfg, err := loadAWSConfig(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			endpoints := sqs.NewFromConfig(cfg).Options().EndpointOptions
+			if endpoints.UseFIPSEndpoint != tt.fips || endpoints.UseDualStackEndpoint != tt.dualStack {
+				t.Errorf("got FIPS %v and dual-stack %v, want %v and %v", endpoints.UseFIPSEndpoint, endpoints.UseDualStackEndpoint, tt.fips, tt.dualStack)
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+const (
+	// MaxSQSMessageBytes is the largest message SQS accepts (256 KiB).
+	MaxSQSMessageBytes = 262144
+	// MaxSQSBatchBytes is the largest combined payload of all messages in
+	// one SendMessageBatch call.
+	MaxSQSBatchBytes = 262144
+	// MaxSQSDelay is the longest DelaySeconds SQS accepts on a message.
+	MaxSQSDelay = 900 * time.Second
+)
+
+// OversizePolicy decides what happens to a message that would push a batch
+// past MaxSQSBatchBytes.
+//
+//   - OversizeSplit (the default) sends the batch built so far and starts a
+//     new one with the message, so every URL is sent at the cost of an
+//     extra, smaller request.
+//   - OversizeSkip drops the message and marks its row failed, keeping
+//     batches full at the cost of losing that URL.
+type OversizePolicy string
+
+const (
+	OversizeSplit OversizePolicy = "split"
+	OversizeSkip  OversizePolicy = "skip"
+)
+
+func parseOversizePolicy(value string) (OversizePolicy, error) {
+	switch p := OversizePolicy(value); p {
+	case OversizeSplit, OversizeSkip:
+		return p, nil
+	}
+	return "", fmt.Errorf("invalid oversize policy %q, expected %s or %s", value, OversizeSplit, OversizeSkip)
+}
+
+// messageSize is the number of bytes entry counts towards the SQS size
+// limits: its body plus, for every message attribute, the bytes of its name,
+// data type and value, as SQS counts them.
+func messageSize(entry types.SendMessageBatchRequestEntry) int {
+	size := len(aws.ToString(entry.MessageBody))
+	for name, attr := range entry.MessageAttributes {
+		size += len(name) + len(aws.ToString(attr.DataType)) + len(aws.ToString(attr.StringValue)) + len(attr.BinaryValue)
+	}
+	return size
+}
+
+// messageBody wraps url in the configured BODY_PREFIX and BODY_SUFFIX. It
+// fails when the result is larger than MAX_MESSAGE_BYTES, which is at most
+// the SQS limit.
+func (p *producer) messageBody(url string) (string, error) {
+	body := p.bodyPrefix + url + p.bodySuffix
+	if len(body) > p.maxMessageBytes {
+		return "", fmt.Errorf("message body is %d bytes, more than the limit of %d", len(body), p.maxMessageBytes)
+	}
+	if err := validMessageText(body); err != nil {
+		return "", err
+	}
+	return body, nil
+}
+
+// validMessageText checks that s only holds characters SQS accepts in a
+// message body. A single invalid body fails the whole SendMessageBatch
+// request, so such rows are rejected before they are batched.
+func validMessageText(s string) error {
+	if !utf8.ValidString(s) {
+		return fmt.Errorf("message body is not valid UTF-8")
+	}
+	for i, r := range s {
+		switch {
+		case r == '\t' || r == '\n' || r == '\r',
+			r >= 0x20 && r <= 0xD7FF,
+			r >= 0xE000 && r <= 0xFFFD,
+			r >= 0x10000:
+		default:
+			return fmt.Errorf("message body contains %U at byte %d, which SQS does not allow", r, i)
+		}
+	}
+	return nil
+}
+
+// delaySeconds is the DelaySeconds that holds back a message scheduled for
+// scheduledAt until then, capped at MaxSQSDelay. Rows scheduled later are
+// not fetched; for FIFO queues, which do not accept per-message delays, not
+// before they are due.
+func delaySeconds(scheduledAt *time.Time, now time.Time) int32 {
+	if scheduledAt == nil || !scheduledAt.After(now) {
+		return 0
+	}
+	return int32(min(math.Ceil(scheduledAt.Sub(now).Seconds()), MaxSQSDelay.Seconds()))
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/ofjangra/sqsURLProducer/models"
+)
+
+func TestValidMessageText(t *testing.T) {
+	tests := []struct {
+		name  string
+		text  string
+		valid bool
+	}{
+		{"plain URL", "https://example.com/a?b=c", true},
+		{"tab, newline and carriage return", "a\tb\nc\rd", true},
+		{"non-ASCII", "https://example.com/straße/日本", true},
+		{"supplementary plane", "https://example.com/\U0001F600", true},
+		{"invalid UTF-8", "https://example.com/\xff", false},
+		{"NUL", "https://example.com/\x00", false},
+		{"other control character", "https://example.com/\x1b", false},
+		{"U+FFFE", "https://example.com/\uFFFE", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validMessageText(tt.text); (err == nil) != tt.valid {
+				t.Errorf("got error %v, want valid %v", err, tt.valid)
+			}
+		})
+	}
+}
+
+func TestInvalidBodiesMarkedFailed(t *testing.T) {
+	log := &eventLog{}
+	client := &fakeSQS{log: log}
+	p := newTestProducer(dryRunDB(t, log), client)
+	urls := testRows(3)
+	urls[1].URL = "https://example.com/\x00"
+
+	var result ProcessResult
+	p.sendURLs(context.Background(), urls, &result)
+
+	if result.Sent != 2 || result.Skipped != 1 {
+		t.Fatalf("got %d sent and %d skipped, want 2 and 1", result.Sent, result.Skipped)
+	}
+	for _, req := range client.requests {
+		for _, e := range req.Entries {
+			if strings.Contains(aws.ToString(e.MessageBody), "\x00") {
+				t.Errorf("sent the invalid body %q", aws.ToString(e.MessageBody))
+			}
+		}
+	}
+	marked := log.matching(`'` + string(models.StatusFailed) + `'`)
+	if len(marked) != 1 || !strings.Contains(marked[0], "IN (2)") {
+		t.Errorf("want row 2 marked failed, got %q", log.events)
+	}
+}
+
+// rowsOfSize returns rows with ids from 1 whose URLs are size bytes long.
+func rowsOfSize(sizes ...int) []models.URLs {
+	rows := make([]models.URLs, len(sizes))
+	for i, size := range sizes {
+		rows[i] = models.URLs{ID: uint(i + 1), URL: strings.Repeat("u", size)}
+	}
+	return rows
+}
+
+// batchIDs returns the row ids of every batch.
+func batchIDs(batches []outboundBatch) [][]uint {
+	ids := make([][]uint, len(batches))
+	for i, b := range batches {
+		ids[i] = b.ids
+	}
+	return ids
+}
+
+func TestBuildBatchesOversize(t *testing.T) {
+	const half = MaxSQSBatchBytes / 2
+	tests := []struct {
+		name     string
+		policy   OversizePolicy
+		sizes    []int
+		batches  [][]uint
+		rejected []uint
+	}{
+		{"exactly at the batch limit", OversizeSplit, []int{half, half}, [][]uint{{1, 2}}, nil},
+		{"split just above the limit", OversizeSplit, []int{half, half + 1, 10}, [][]uint{{1}, {2, 3}}, nil},
+		{"skip exactly at the limit", OversizeSkip, []int{half, half}, [][]uint{{1, 2}}, nil},
+		{"skip just above the limit", OversizeSkip, []int{half, half + 1, 10}, [][]uint{{1, 3}}, []uint{2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestProducer(dryRunDB(t, nil), &fakeSQS{})
+			p.oversizePolicy = tt.policy
+			batches, rejected := p.buildBatches(rowsOfSize(tt.sizes...))
+			if got := batchIDs(batches); !slices.EqualFunc(got, tt.batches, slices.Equal) {
+				t.Errorf("got batches %v, want %v", got, tt.batches)
+			}
+			var ids []uint
+			for _, r := range rejected {
+				ids = append(ids, r.id)
+			}
+			if !slices.Equal(ids, tt.rejected) {
+				t.Errorf("got rejected %v, want %v", ids, tt.rejected)
+			}
+		})
+	}
+}
+
+func TestMaxMessageBytes(t *testing.T) {
+	tests := []struct {
+		name     string
+		size     int
+		rejected bool
+	}{
+		{"below the cap", 97, false},
+		{"at the cap", 98, false},
+		{"above the cap", 99, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestProducer(dryRunDB(t, nil), &fakeSQS{})
+			p.maxMessageBytes = 100
+			p.bodyPrefix, p.bodySuffix = "<", ">"
+			batches, rejected := p.buildBatches(rowsOfSize(tt.size))
+			if tt.rejected {
+				if len(batches) != 0 || len(rejected) != 1 {
+					t.Fatalf("got %d batches and %d rejected, want the row rejected", len(batches), len(rejected))
+				}
+				if !strings.Contains(rejected[0].reason, "more than the limit of 100") {
+					t.Errorf("got reason %q", rejected[0].reason)
+				}
+				return
+			}
+			if len(batches) != 1 || len(rejected) != 0 {
+				t.Fatalf("got %d batches and %d rejected, want the row batched", len(batches), len(rejected))
+			}
+		})
+	}
+}
+
+func TestAttributeBytesFlushBatch(t *testing.T) {
+	// Each entry is a 10 byte body plus an attribute counted as its name,
+	// its "String" data type and its value.
+	const body = 10
+	const overhead = body + len("tag") + len("String")
+	tests := []struct {
+		name     string
+		value    int
+		batches  [][]uint
+		rejected []uint
+	}{
+		{"no attribute", 0, [][]uint{{1, 2}}, nil},
+		{"two entries at the batch limit", MaxSQSBatchBytes/2 - overhead, [][]uint{{1, 2}}, nil},
+		{"two entries just above the batch limit", MaxSQSBatchBytes/2 - overhead + 1, [][]uint{{1}, {2}}, nil},
+		{"an entry above the message limit", MaxSQSMessageBytes - overhead + 1, nil, []uint{1, 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestProducer(dryRunDB(t, nil), &fakeSQS{})
+			if tt.value > 0 {
+				p.messageTags = map[string]string{"tag": strings.Repeat("v", tt.value)}
+			}
+			batches, rejected := p.buildBatches(rowsOfSize(body, body))
+			if got := batchIDs(batches); !slices.EqualFunc(got, tt.batches, slices.Equal) {
+				t.Errorf("got batches %v, want %v", got, tt.batches)
+			}
+			var ids []uint
+			for _, r := range rejected {
+				ids = append(ids, r.id)
+			}
+			if !slices.Equal(ids, tt.rejected) {
+				t.Errorf("got rejected %v, want %v", ids, tt.rejected)
+			}
+		})
+	}
+}
+
+func TestScheduleBeyondRetention(t *testing.T) {
+	client := &fakeSQS{retention: "600"}
+	p := newTestProducer(dryRunDB(t, nil), client)
+	p.retention = checkRetention(context.Background(), client, testQueueURL, 0)
+	p.processingTime = time.Minute
+
+	at := func(d time.Duration) *time.Time {
+		when := time.Now().Add(d)
+		return &when
+	}
+	rows := []models.URLs{
+		{ID: 1, URL: "url-1"},
+		{ID: 2, URL: "url-2", ScheduledAt: at(5 * time.Minute)},
+		{ID: 3, URL: "url-3", ScheduledAt: at(9*time.Minute + 30*time.Second)},
+	}
+	batches, rejected := p.buildBatches(rows)
+	if got := batchIDs(batches); !slices.EqualFunc(got, [][]uint{{1, 2}}, slices.Equal) {
+		t.Errorf("got batches %v, want [[1 2]]", got)
+	}
+	if len(rejected) != 1 || rejected[0].id != 3 {
+		t.Fatalf("got rejected %+v, want URL 3", rejected)
+	}
+	if !strings.Contains(rejected[0].reason, "exceeds the queue's retention of 10m0s") {
+		t.Errorf("got reason %q", rejected[0].reason)
+	}
+
+	// Without a known retention nothing is skipped.
+	p.retention = 0
+	if _, rejected := p.buildBatches(rows); len(rejected) != 0 {
+		t.Errorf("got %d rejected with an unknown retention, want 0", len(rejected))
+	}
+}
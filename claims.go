@@ -0,0 +1,459 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ofjangra/sqsURLProducer/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Rows are claimed before they are sent so that several producer instances
+// can share a table: a claim moves a pending row to claimed and sets
+// claimed_at, and only pending rows are eligible for the next fetch. The
+// claiming UPDATE selects its rows with FOR UPDATE SKIP LOCKED, so
+// concurrent polls never claim the same row. A producer that dies mid-poll
+// leaves its claims behind; the recovery sweep hands them back once they
+// are older than the claim timeout.
+//
+// With a read replica the pending rows are looked up on the replica and then
+// claimed on the primary with an UPDATE that re-checks the status. Rows the
+// replica has not seen yet wait for a later poll, and rows that are no longer
+// pending on the primary are skipped, so replica lag never causes a re-send.
+
+// TransactionScope controls how much of a poll runs in one database
+// transaction.
+//
+// TransactionStatement (the default) commits every claim and status update on
+// its own, so rows left claimed by a crash wait for the recovery sweep.
+//
+// TransactionPoll runs the claims and status updates of a whole poll in one
+// transaction that commits once every batch was attempted. A poll that fails
+// or crashes part way through rolls back, returning all of its rows to
+// pending at once, but the claimed rows stay locked until the poll ends and
+// rows already sent by then are sent again by a later poll.
+type TransactionScope string
+
+const (
+	TransactionStatement TransactionScope = "statement"
+	TransactionPoll      TransactionScope = "poll"
+)
+
+func parseTransactionScope(value string) (TransactionScope, error) {
+	switch s := TransactionScope(value); s {
+	case TransactionStatement, TransactionPoll:
+		return s, nil
+	}
+	return "", fmt.Errorf("invalid transaction scope %q, expected %s or %s", value, TransactionStatement, TransactionPoll)
+}
+
+// inPollTransaction runs poll with p.db replaced by a transaction, which is
+// committed if poll succeeds and rolled back if it fails or panics.
+func (p *producer) inPollTransaction(poll func() (ProcessResult, error)) (result ProcessResult, err error) {
+	tx := p.db.Begin()
+	if tx.Error != nil {
+		return result, tx.Error
+	}
+	db := p.db
+	p.db = tx
+	defer func() {
+		p.db = db
+		if r := recover(); r != nil {
+			tx.Rollback()
+			panic(r)
+		}
+		if err != nil {
+			if rollbackErr := tx.Rollback().Error; rollbackErr != nil {
+				log.Printf("Failed to roll back the poll transaction, its claims will be released when the connection closes: %v", rollbackErr)
+			}
+			return
+		}
+		if commitErr := tx.Commit().Error; commitErr != nil {
+			err = fmt.Errorf("failed to commit the poll transaction, its %d URLs are pending again: %w", result.Fetched, commitErr)
+		}
+	}()
+	return poll()
+}
+
+// claimURLs claims up to limit pending rows and returns them in id order.
+//
+// With a lock timeout the claim runs in a transaction (a savepoint inside a
+// poll transaction) with lock_timeout set, so a claim stuck behind row locks
+// held by another transaction fails fast instead of hanging the poll. SKIP
+// LOCKED never waits, but the UPDATE of rows looked up on a replica does.
+//
+// trimmed reports that MAX_FETCH_BYTES cut the claim short of limit while
+// more rows were pending.
+func (p *producer) claimURLs(limit int) (urls []models.URLs, trimmed bool, err error) {
+	if p.lockTimeout <= 0 {
+		return p.claim(p.db, limit)
+	}
+	err = p.db.Transaction(func(tx *gorm.DB) error {
+		// SET does not take bind parameters.
+		if err := tx.Exec(fmt.Sprintf("SET LOCAL lock_timeout = %d", p.lockTimeout.Milliseconds())).Error; err != nil {
+			return err
+		}
+		var err error
+		urls, trimmed, err = p.claim(tx, limit)
+		return err
+	})
+	return urls, trimmed, err
+}
+
+func (p *producer) claim(db *gorm.DB, limit int) ([]models.URLs, bool, error) {
+	now := time.Now()
+	var candidates any = p.pendingRows(db, now).
+		Select("id").
+		Order("id").
+		Limit(limit).
+		Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"})
+	var trimmed bool
+	if p.readReplica || p.maxFetchBytes > 0 {
+		query := p.pendingRows(db, now).
+			Order("id").
+			Limit(limit).
+			Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"})
+		if p.readReplica {
+			query = p.pendingRows(p.db, now).Order("id").Limit(limit)
+		}
+		var ids []uint
+		var err error
+		ids, trimmed, err = p.candidateIDs(query)
+		if err != nil || len(ids) == 0 {
+			return nil, false, err
+		}
+		candidates = ids
+	}
+
+	if p.marker.legacy() {
+		// Without a claimed state the rows stay locked until the poll
+		// transaction ends instead.
+		var urls []models.URLs
+		err := p.pendingRows(db, now).
+			Where("id IN (?)", candidates).
+			Order("id").
+			Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Find(&urls).Error
+		return urls, trimmed, err
+	}
+
+	var urls []models.URLs
+	err := db.Model(&urls).
+		Clauses(clause.Returning{}).
+		Where("id IN (?) AND status = ?", candidates, models.StatusPending).
+		Updates(map[string]any{"status": models.StatusClaimed, "claimed_at": now}).Error
+
+	// RETURNING yields rows in no particular order.
+	sort.Slice(urls, func(i, j int) bool { return urls[i].ID < urls[j].ID })
+	return urls, trimmed, err
+}
+
+// candidateIDs returns the ids of the rows query selects. With
+// MAX_FETCH_BYTES it looks up the size of each row's URL and group key as
+// well and keeps only as many leading rows as fit, but always the first, so
+// a chunk of huge URLs is fetched a few rows at a time rather than all at
+// once. trimmed reports whether rows were left out.
+func (p *producer) candidateIDs(query *gorm.DB) (ids []uint, trimmed bool, err error) {
+	if p.maxFetchBytes <= 0 {
+		err = query.Pluck("id", &ids).Error
+		return ids, false, err
+	}
+	var rows []struct {
+		ID    uint
+		Bytes int
+	}
+	err = query.Select("id, octet_length(url) + coalesce(octet_length(group_key), 0) AS bytes").Scan(&rows).Error
+	total := 0
+	for i, row := range rows {
+		total += row.Bytes
+		if i > 0 && total > p.maxFetchBytes {
+			return ids, true, err
+		}
+		ids = append(ids, row.ID)
+	}
+	return ids, false, err
+}
+
+// holdForMinBatch returns the number of pending rows when this poll should
+// send nothing because there are fewer than MIN_BATCH_SIZE of them, letting
+// them accumulate into a fuller batch, and 0 otherwise. Rows are held for at
+// most MIN_BATCH_MAX_WAIT from the first poll that held them.
+func (p *producer) holdForMinBatch() (int, error) {
+	now := time.Now()
+	var pending int64
+	err := p.db.Table("(?) AS pending", p.pendingRows(p.db, now).Select("id").Limit(p.minBatchSize)).Count(&pending).Error
+	if err != nil {
+		return 0, err
+	}
+	table := p.db.Statement.Table
+	if pending == 0 || pending >= int64(p.minBatchSize) {
+		delete(p.heldSince, table)
+		return 0, nil
+	}
+	since, held := p.heldSince[table]
+	if !held {
+		if p.heldSince == nil {
+			p.heldSince = map[string]time.Time{}
+		}
+		p.heldSince[table], since = now, now
+	}
+	if now.Sub(since) >= p.minBatchMaxWait {
+		delete(p.heldSince, table)
+		p.debugf("Sending %d URLs, below MIN_BATCH_SIZE, after holding them for %s", pending, now.Sub(since).Round(time.Second))
+		return 0, nil
+	}
+	p.debugf("Holding %d URLs until MIN_BATCH_SIZE %d URLs are pending", pending, p.minBatchSize)
+	return int(pending), nil
+}
+
+// peekURLs reads up to limit pending rows with ids above after, without
+// claiming them, for SEND_ONLY.
+func (p *producer) peekURLs(limit int, after uint) ([]models.URLs, bool, error) {
+	query := p.pendingRows(p.db, time.Now()).
+		Where("id > ?", after).
+		Order("id").
+		Limit(limit)
+	var ids []uint
+	var trimmed bool
+	if p.maxFetchBytes > 0 {
+		var err error
+		ids, trimmed, err = p.candidateIDs(query.Session(&gorm.Session{}))
+		if err != nil || len(ids) == 0 {
+			return nil, false, err
+		}
+		query = query.Where("id IN ?", ids)
+	}
+	var urls []models.URLs
+	err := query.Find(&urls).Error
+	return urls, trimmed, err
+}
+
+// pendingRows selects the rows a poll at now may claim: pending (or not yet
+// processed, with PROCESSED_MARKER), matching FETCH_FILTER, past their
+// next_attempt_at, and scheduled no later than the delay SQS can still apply
+// for them.
+func (p *producer) pendingRows(db *gorm.DB, now time.Time) *gorm.DB {
+	return p.marker.unprocessed(p.fetchFilter.apply(db.Model(&models.URLs{}))).
+		Where("next_attempt_at IS NULL OR next_attempt_at <= ?", now).
+		Where("scheduled_at IS NULL OR scheduled_at <= ?", now.Add(p.maxDelay))
+}
+
+// releaseClaims makes rows that could not be sent eligible for the next poll.
+func (p *producer) releaseClaims(ids []uint) {
+	if p.sendOnly || p.marker.legacy() {
+		return
+	}
+	for _, chunk := range chunkIDs(ids, p.updateChunkSize) {
+		err := p.db.Model(&models.URLs{}).
+			Where("id IN ?", chunk).
+			Updates(map[string]any{"status": models.StatusPending, "claimed_at": nil}).Error
+		if err != nil {
+			dbUpdateFailures.Inc()
+			log.Printf("Failed to release %d claimed URLs, they will be recovered after %s: %v", len(chunk), p.claimTimeout, err)
+		}
+	}
+}
+
+// retryLater returns rows that failed to send to pending, keeping them out of
+// the fetch until ENTRY_RETRY_DELAY has passed.
+func (p *producer) retryLater(ids []uint) {
+	if p.sendOnly || len(ids) == 0 {
+		return
+	}
+	if p.strictFailures != nil {
+		p.strictFailures.retry = append(p.strictFailures.retry, ids...)
+	}
+	updates := map[string]any{"status": models.StatusPending, "claimed_at": nil, "next_attempt_at": time.Now().Add(p.entryRetryDelay)}
+	if p.marker.legacy() {
+		updates = map[string]any{"next_attempt_at": updates["next_attempt_at"]}
+	}
+	for _, chunk := range chunkIDs(ids, p.updateChunkSize) {
+		err := p.db.Model(&models.URLs{}).
+			Where("id IN ?", chunk).
+			Updates(updates).Error
+		if err != nil {
+			dbUpdateFailures.Inc()
+			log.Printf("Failed to schedule %d URLs for retry, they will be recovered after %s: %v", len(chunk), p.claimTimeout, err)
+		}
+	}
+}
+
+// setStatus moves the rows in ids to status. Like every status update it
+// does nothing with SEND_ONLY.
+func (p *producer) setStatus(ids []uint, status models.URLStatus) {
+	updates := p.marker.updates(status)
+	if p.sendOnly || len(updates) == 0 || len(ids) == 0 {
+		return
+	}
+	if p.strictFailures != nil && status == models.StatusFailed {
+		p.strictFailures.failed = append(p.strictFailures.failed, ids...)
+	}
+	for _, chunk := range chunkIDs(ids, p.updateChunkSize) {
+		if err := p.db.Model(&models.URLs{}).Where("id IN ?", chunk).Updates(updates).Error; err != nil {
+			dbUpdateFailures.Inc()
+			log.Printf("Failed to mark %d URLs %s: %v", len(chunk), status, err)
+		}
+	}
+}
+
+// chunkIDs splits ids into slices of at most size ids, so that an UPDATE on
+// a large id list stays well clear of Postgres's limit of 65535 bind
+// parameters per statement. A size below 1 leaves ids in one chunk.
+func chunkIDs(ids []uint, size int) [][]uint {
+	if size < 1 || len(ids) <= size {
+		return [][]uint{ids}
+	}
+	chunks := make([][]uint, 0, (len(ids)+size-1)/size)
+	for start := 0; start < len(ids); start += size {
+		chunks = append(chunks, ids[start:min(start+size, len(ids))])
+	}
+	return chunks
+}
+
+// flushSent marks the rows deferred by BATCH_STATUS_UPDATE sent. Until then
+// the rows are still claimed, so a crash before the flush re-sends them once
+// their claims are recovered, as at_least_once allows.
+func (p *producer) flushSent() {
+	if len(p.deferredSent) == 0 {
+		return
+	}
+	p.setSent(p.deferredSent, p.deferredColumns)
+	p.deferredSent = p.deferredSent[:0]
+	clear(p.deferredColumns)
+}
+
+// sentColumns holds values stored on rows in the update that marks them
+// sent, by column and row id: the SQS message ids with STORE_MESSAGE_ID and
+// the correlation ids with STORE_CORRELATION_ID.
+type sentColumns map[string]map[uint]string
+
+func (c sentColumns) set(column string, id uint, value string) {
+	if c[column] == nil {
+		c[column] = map[uint]string{}
+	}
+	c[column][id] = value
+}
+
+// add merges the values of other into c.
+func (c sentColumns) add(other sentColumns) {
+	for column, values := range other {
+		for id, value := range values {
+			c.set(column, id, value)
+		}
+	}
+}
+
+// setSent marks the rows in ids sent, storing each row's values in columns
+// in the same update.
+func (p *producer) setSent(ids []uint, columns sentColumns) {
+	if len(columns) == 0 {
+		p.setStatus(ids, models.StatusSent)
+		return
+	}
+	if p.sendOnly {
+		return
+	}
+	// Every row binds its id once for the IN list and twice, along with
+	// its value, for the CASE of every column.
+	perRow := 1 + 2*len(columns)
+	for _, chunk := range chunkIDs(ids, max(1, p.updateChunkSize/perRow)) {
+		updates := p.marker.updates(models.StatusSent)
+		for column, values := range columns {
+			var sql strings.Builder
+			args := make([]any, 0, 2*len(chunk))
+			sql.WriteString("CASE id")
+			for _, id := range chunk {
+				sql.WriteString(" WHEN ? THEN ?")
+				args = append(args, id, values[id])
+			}
+			sql.WriteString(" END")
+			updates[column] = gorm.Expr(sql.String(), args...)
+		}
+		err := p.db.Model(&models.URLs{}).Where("id IN ?", chunk).Updates(updates).Error
+		if err != nil {
+			dbUpdateFailures.Inc()
+			log.Printf("Failed to mark %d URLs %s: %v", len(chunk), models.StatusSent, err)
+		}
+	}
+}
+
+// recoverStaleClaims returns claimed rows whose claim is older than the claim
+// timeout to pending, i.e. rows claimed by a producer that never finished them.
+func (p *producer) recoverStaleClaims() error {
+	if p.sendOnly || p.marker.legacy() {
+		return nil
+	}
+	result := p.db.Model(&models.URLs{}).
+		Where("status = ? AND claimed_at < ?", models.StatusClaimed, time.Now().Add(-p.claimTimeout)).
+		Updates(map[string]any{"status": models.StatusPending, "claimed_at": nil})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected > 0 {
+		log.Printf("Recovered %d URLs with claims older than %s", result.RowsAffected, p.claimTimeout)
+	}
+	return nil
+}
+
+// countByStatus returns the number of rows in each status. Every status is
+// present in the result, with zero for statuses that have no rows. With a
+// PROCESSED_MARKER other than status, unprocessed rows count as pending and
+// processed ones as sent.
+func countByStatus(db *gorm.DB, marker processedMarker) (map[models.URLStatus]int64, error) {
+	counts := make(map[models.URLStatus]int64, len(models.Statuses))
+	for _, status := range models.Statuses {
+		counts[status] = 0
+	}
+
+	if marker.legacy() {
+		var total, pending int64
+		if err := db.Model(&models.URLs{}).Count(&total).Error; err != nil {
+			return nil, err
+		}
+		if err := marker.unprocessed(db.Model(&models.URLs{})).Count(&pending).Error; err != nil {
+			return nil, err
+		}
+		counts[models.StatusPending] = pending
+		counts[models.StatusSent] = total - pending
+		return counts, nil
+	}
+
+	var rows []struct {
+		Status models.URLStatus
+		Count  int64
+	}
+	if err := db.Model(&models.URLs{}).Select("status, count(*) AS count").Group("status").Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		counts[row.Status] = row.Count
+	}
+	return counts, nil
+}
+
+// countSources is countByStatus summed over tables, the distinct tables of
+// SOURCE_TABLES, along with the counts of each of them. With no tables it
+// counts the urls table and returns no per-table counts.
+func countSources(db *gorm.DB, tables []string, marker processedMarker) (map[models.URLStatus]int64, map[string]map[models.URLStatus]int64, error) {
+	if len(tables) == 0 {
+		counts, err := countByStatus(db, marker)
+		return counts, nil, err
+	}
+	total := make(map[models.URLStatus]int64, len(models.Statuses))
+	perTable := make(map[string]map[models.URLStatus]int64, len(tables))
+	for _, table := range tables {
+		counts, err := countByStatus(db.Table(table).Session(&gorm.Session{}), marker)
+		if err != nil {
+			return nil, nil, fmt.Errorf("counting %s: %w", table, err)
+		}
+		for status, n := range counts {
+			total[status] += n
+		}
+		perTable[table] = counts
+	}
+	return total, perTable, nil
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ofjangra/sqsURLProducer/models"
+	"gorm.io/gorm"
+)
+
+// statuses returns the status of every row of table, in id order.
+func statuses(t *testing.T, db *gorm.DB, table string) []models.URLStatus {
+	t.Helper()
+	var got []models.URLStatus
+	if err := db.Table(table).Order("id").Pluck("status", &got).Error; err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+const (
+	pending = models.StatusPending
+	claimed = models.StatusClaimed
+	sent    = models.StatusSent
+	failed  = models.StatusFailed
+)
+
+// execSQL runs statements against db.
+func execSQL(t *testing.T, db *gorm.DB, statements ...string) {
+	t.Helper()
+	for _, statement := range statements {
+		if err := db.Exec(statement).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestClaimURLs(t *testing.T) {
+	five := []models.URLStatus{pending, pending, pending, pending, pending}
+	tests := []struct {
+		name  string
+		rows  []models.URLStatus
+		limit int
+		// setup, if set, prepares the rows and the producer.
+		setup func(t *testing.T, db *gorm.DB, p *producer)
+		ids   []uint
+		want  []models.URLStatus
+	}{
+		{"up to the limit", []models.URLStatus{pending, pending, pending}, 2, nil, []uint{1, 2}, []models.URLStatus{claimed, claimed, pending}},
+		{"pending rows only", []models.URLStatus{sent, claimed, pending, failed}, 10, nil, []uint{3}, []models.URLStatus{sent, claimed, claimed, failed}},
+		{"nothing pending", []models.URLStatus{sent}, 10, nil, nil, []models.URLStatus{sent}},
+		{"FETCH_FILTER", five, 10, func(t *testing.T, db *gorm.DB, p *producer) {
+			execSQL(t, db, "UPDATE urls SET group_key = 'tenant-a' WHERE id IN (1, 4)", "UPDATE urls SET group_key = 'tenant-b' WHERE id = 2")
+			p.fetchFilter = fetchFilter{"group_key": {"tenant-a"}}
+		}, []uint{1, 4}, []models.URLStatus{claimed, pending, pending, claimed, pending}},
+		{"FETCH_FILTER with several values", five, 10, func(t *testing.T, db *gorm.DB, p *producer) {
+			execSQL(t, db, "UPDATE urls SET group_key = 'tenant-a' WHERE id IN (1, 4)", "UPDATE urls SET group_key = 'tenant-b' WHERE id = 2")
+			p.fetchFilter = fetchFilter{"group_key": {"tenant-a", "tenant-b"}, "url": {"url-1", "url-2"}}
+		}, []uint{1, 2}, []models.URLStatus{claimed, claimed, pending, pending, pending}},
+		{"next_attempt_at cooldown", five, 10, func(t *testing.T, db *gorm.DB, p *producer) {
+			execSQL(t, db, "UPDATE urls SET next_attempt_at = now() + interval '1 hour' WHERE id = 2", "UPDATE urls SET next_attempt_at = now() - interval '1 second' WHERE id = 3")
+		}, []uint{1, 3, 4, 5}, []models.URLStatus{claimed, pending, claimed, claimed, claimed}},
+		{"scheduled_at past, near and far", five, 10, func(t *testing.T, db *gorm.DB, p *producer) {
+			execSQL(t, db,
+				"UPDATE urls SET scheduled_at = now() - interval '1 hour' WHERE id = 1",
+				"UPDATE urls SET scheduled_at = now() + interval '5 minutes' WHERE id = 2",
+				"UPDATE urls SET scheduled_at = now() + interval '1 hour' WHERE id = 3")
+			p.maxDelay = MaxSQSDelay
+		}, []uint{1, 2, 4, 5}, []models.URLStatus{claimed, claimed, pending, claimed, claimed}},
+		{"scheduled_at near without delays", five, 10, func(t *testing.T, db *gorm.DB, p *producer) {
+			execSQL(t, db, "UPDATE urls SET scheduled_at = now() + interval '5 minutes' WHERE id = 2")
+		}, []uint{1, 3, 4, 5}, []models.URLStatus{claimed, pending, claimed, claimed, claimed}},
+		{"MAX_FETCH_BYTES", five, 10, func(t *testing.T, db *gorm.DB, p *producer) {
+			// url-1 to url-5 are 5 bytes each.
+			p.maxFetchBytes = 14
+		}, []uint{1, 2}, []models.URLStatus{claimed, claimed, pending, pending, pending}},
+		{"MAX_FETCH_BYTES counts the group key", five, 10, func(t *testing.T, db *gorm.DB, p *producer) {
+			execSQL(t, db, "UPDATE urls SET group_key = 'tenant' WHERE id = 1")
+			p.maxFetchBytes = 14
+		}, []uint{1}, []models.URLStatus{claimed, pending, pending, pending, pending}},
+		{"MAX_FETCH_BYTES below a single row", five, 10, func(t *testing.T, db *gorm.DB, p *producer) {
+			p.maxFetchBytes = 1
+		}, []uint{1}, []models.URLStatus{claimed, pending, pending, pending, pending}},
+		{"PROCESSED_MARKER=bool", five, 10, func(t *testing.T, db *gorm.DB, p *producer) {
+			execSQL(t, db, "ALTER TABLE urls ADD COLUMN processed boolean", "UPDATE urls SET processed = true WHERE id = 2", "UPDATE urls SET processed = false WHERE id = 3")
+			p.marker = processedMarker{kind: MarkerBool, column: "processed"}
+		}, []uint{1, 3, 4, 5}, five},
+		{"PROCESSED_MARKER=timestamp", five, 10, func(t *testing.T, db *gorm.DB, p *producer) {
+			execSQL(t, db, "ALTER TABLE urls ADD COLUMN processed_at timestamptz", "UPDATE urls SET processed_at = now() WHERE id IN (1, 5)")
+			p.marker = processedMarker{kind: MarkerTimestamp, column: "processed_at"}
+		}, []uint{2, 3, 4}, five},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := testDB(t)
+			insertRows(t, db, "urls", tt.rows...)
+			p := newTestProducer(db, &fakeSQS{})
+			if tt.setup != nil {
+				tt.setup(t, db, p)
+			}
+
+			urls, _, err := p.claimURLs(tt.limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ids []uint
+			for _, u := range urls {
+				ids = append(ids, u.ID)
+			}
+			if !slices.Equal(ids, tt.ids) {
+				t.Errorf("claimed %v, want %v", ids, tt.ids)
+			}
+			if got := statuses(t, db, "urls"); !slices.Equal(got, tt.want) {
+				t.Errorf("got statuses %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReleaseAndRecoverClaims(t *testing.T) {
+	db := testDB(t)
+	insertRows(t, db, "urls", pending, pending, pending)
+	p := newTestProducer(db, &fakeSQS{})
+	if _, _, err := p.claimURLs(3); err != nil {
+		t.Fatal(err)
+	}
+
+	p.releaseClaims([]uint{1})
+	if got, want := statuses(t, db, "urls"), []models.URLStatus{pending, claimed, claimed}; !slices.Equal(got, want) {
+		t.Fatalf("after release got %v, want %v", got, want)
+	}
+
+	// Row 2 was claimed by a producer that died long ago.
+	if err := db.Table("urls").Where("id = 2").Update("claimed_at", time.Now().Add(-time.Hour)).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := p.recoverStaleClaims(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := statuses(t, db, "urls"), []models.URLStatus{pending, pending, claimed}; !slices.Equal(got, want) {
+		t.Errorf("after recovery got %v, want %v", got, want)
+	}
+}
+
+func TestMinBatchHold(t *testing.T) {
+	tests := []struct {
+		name     string
+		pending  int
+		maxWait  time.Duration
+		draining bool
+		fetched  int
+		held     int
+	}{
+		{"below the minimum", 2, time.Hour, false, 0, 2},
+		{"at the minimum", 3, time.Hour, false, 3, 0},
+		{"held long enough", 2, 0, false, 2, 0},
+		{"never held in RUN_MODE=once", 2, time.Hour, true, 2, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := testDB(t)
+			insertRows(t, db, "urls", slices.Repeat([]models.URLStatus{pending}, tt.pending)...)
+			p := newTestProducer(db, &fakeSQS{})
+			p.minBatchSize, p.minBatchMaxWait, p.draining = 3, tt.maxWait, tt.draining
+
+			result, err := p.processURLs(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Fetched != tt.fetched || result.Held != tt.held {
+				t.Errorf("got %d fetched and %d held, want %d and %d", result.Fetched, result.Held, tt.fetched, tt.held)
+			}
+		})
+	}
+}
+
+func TestStrictPollRollback(t *testing.T) {
+	failRow2 := func(call int, body string) (string, bool, bool) {
+		return "InternalError", false, body == "url-2"
+	}
+	tests := []struct {
+		name        string
+		fail        func(call int, body string) (string, bool, bool)
+		poisonPolls int
+		err         error
+		want        []models.URLStatus
+		// delayed is whether row 2 keeps its ENTRY_RETRY_DELAY.
+		delayed bool
+	}{
+		{"every batch sent", nil, 0, nil, []models.URLStatus{sent, sent, sent}, false},
+		{"rolled back with the retry delay kept", failRow2, 0, errStrictPollFailed, []models.URLStatus{pending, pending, pending}, true},
+		{"rolled back with the quarantine kept", failRow2, 1, errStrictPollFailed, []models.URLStatus{pending, failed, pending}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := testDB(t)
+			insertRows(t, db, "urls", pending, pending, pending)
+			p := newTestProducer(db, &fakeSQS{fail: tt.fail})
+			p.transactionScope, p.strictPoll = TransactionPoll, true
+			p.retryBudget = time.Nanosecond
+			p.failures = newFailureTracker(tt.poisonPolls, time.Hour)
+
+			_, err := p.processURLs(context.Background())
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got error %v, want %v", err, tt.err)
+			}
+			if got := statuses(t, db, "urls"); !slices.Equal(got, tt.want) {
+				t.Errorf("got statuses %v, want %v", got, tt.want)
+			}
+			var delayed int64
+			if err := db.Table("urls").Where("id = 2 AND next_attempt_at IS NOT NULL").Count(&delayed).Error; err != nil {
+				t.Fatal(err)
+			}
+			if (delayed == 1) != tt.delayed {
+				t.Errorf("got a retry delay on row 2: %v, want %v", delayed == 1, tt.delayed)
+			}
+		})
+	}
+}
+
+func TestPollTransactionRollback(t *testing.T) {
+	errClaim := errors.New("connection reset")
+	tests := []struct {
+		name string
+		// claimErr fails the second claim of the poll.
+		claimErr bool
+		panicOn  int
+	}{
+		{"second claim fails", true, 0},
+		{"second send panics", false, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := testDB(t)
+			insertRows(t, db, "urls", pending, pending, pending, pending)
+			var claims atomic.Int32
+			err := db.Callback().Update().Before("gorm:update").Register("test:fail_claim", func(tx *gorm.DB) {
+				// Only the claim updates with RETURNING.
+				if _, ok := tx.Statement.Clauses["RETURNING"]; ok && claims.Add(1) == 2 && tt.claimErr {
+					tx.AddError(errClaim)
+				}
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			client := &fakeSQS{panicOn: tt.panicOn}
+			p := newTestProducer(db, client)
+			p.transactionScope = TransactionPoll
+			p.fetchChunkSize, p.batchSize = 2, 2
+
+			func() {
+				defer func() {
+					if r := recover(); (r != nil) != (tt.panicOn > 0) {
+						t.Errorf("got panic %v", r)
+					}
+				}()
+				if _, err := p.processURLs(context.Background()); !errors.Is(err, errClaim) && tt.claimErr {
+					t.Errorf("got error %v, want %v", err, errClaim)
+				}
+			}()
+
+			// Rows 1 and 2 were sent and marked sent before the failure,
+			// the rollback returns them to pending along with the rest.
+			if client.calls == 0 {
+				t.Fatal("nothing was sent before the failure")
+			}
+			if got, want := statuses(t, db, "urls"), []models.URLStatus{pending, pending, pending, pending}; !slices.Equal(got, want) {
+				t.Errorf("got statuses %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestLockTimeoutSkipsPoll(t *testing.T) {
+	db := testDB(t)
+	insertRows(t, db, "urls", pending, pending, pending)
+
+	// Another transaction holds row 1. Rows looked up on a replica are
+	// claimed without SKIP LOCKED, so the claim waits for it.
+	holder := db.Begin()
+	if err := holder.Exec("SELECT id FROM urls WHERE id = 1 FOR UPDATE").Error; err != nil {
+		t.Fatal(err)
+	}
+	defer holder.Rollback()
+
+	client := &fakeSQS{}
+	p := newTestProducer(db, client)
+	p.readReplica = true
+	p.lockTimeout = 100 * time.Millisecond
+
+	start := time.Now()
+	result, err := p.processURLs(context.Background())
+	if err != nil {
+		t.Fatalf("got error %v, want the poll skipped", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("poll took %s, want it to give up after the lock timeout", elapsed)
+	}
+	if result.Fetched != 0 || client.calls != 0 {
+		t.Errorf("got %d fetched and %d sends, want none", result.Fetched, client.calls)
+	}
+	if got, want := statuses(t, db, "urls"), []models.URLStatus{pending, pending, pending}; !slices.Equal(got, want) {
+		t.Errorf("got statuses %v, want %v", got, want)
+	}
+
+	// Once the lock is released the next poll sends them.
+	holder.Rollback()
+	if result, err = p.processURLs(context.Background()); err != nil || result.Sent != 3 {
+		t.Errorf("got %d sent and error %v after the lock was released, want 3", result.Sent, err)
+	}
+}
+
+func TestStatusTransitions(t *testing.T) {
+	db := testDB(t)
+	insertRows(t, db, "urls", pending, pending, pending, sent)
+	p := newTestProducer(db, &fakeSQS{fail: func(call int, body string) (string, bool, bool) {
+		return "InvalidParameterValue", true, body == "url-2"
+	}})
+
+	urls, _, err := p.claimURLs(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := statuses(t, db, "urls"), []models.URLStatus{claimed, claimed, claimed, sent}; !slices.Equal(got, want) {
+		t.Fatalf("after the claim got %v, want %v", got, want)
+	}
+	var result ProcessResult
+	p.sendURLs(context.Background(), urls, &result)
+	p.flushSent()
+	if got, want := statuses(t, db, "urls"), []models.URLStatus{sent, failed, sent, sent}; !slices.Equal(got, want) {
+		t.Errorf("after the send got %v, want %v", got, want)
+	}
+}
+
+// TestClaimInChunks checks that a poll whose limit is above FETCH_CHUNK_SIZE
+// claims and sends one chunk at a time, so no more than a chunk of rows is
+// held in memory at once.
+func TestClaimInChunks(t *testing.T) {
+	db := testDB(t)
+	insertRows(t, db, "urls", slices.Repeat([]models.URLStatus{pending}, 25)...)
+	log := &eventLog{}
+	client := &fakeSQS{log: log}
+	p := newTestProducer(db.Session(&gorm.Session{Logger: sqlRecorder{log: log}}), client)
+	p.fetchLimit, p.fetchChunkSize = 100, 10
+
+	result, err := p.processURLs(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Fetched != 25 || result.Sent != 25 {
+		t.Fatalf("got %d fetched and %d sent, want 25 and 25", result.Fetched, result.Sent)
+	}
+	// Every chunk is sent before the next one is claimed.
+	var steps []string
+	for _, e := range log.matching("") {
+		switch {
+		case strings.Contains(e, `"status"='claimed'`):
+			steps = append(steps, "claim")
+		case strings.HasPrefix(e, "send"):
+			steps = append(steps, e[strings.LastIndex(e, " ")+1:])
+		}
+	}
+	if want := []string{"claim", "10", "claim", "10", "claim", "5"}; !slices.Equal(steps, want) {
+		t.Errorf("got claims and sends %v, want %v", steps, want)
+	}
+	if got := statuses(t, db, "urls"); slices.ContainsFunc(got, func(s models.URLStatus) bool { return s != sent }) {
+		t.Errorf("got statuses %v, want every row sent", got)
+	}
+}
+
+func TestStatusUpdateChunks(t *testing.T) {
+	ids := make([]uint, 2500)
+	for i := range ids {
+		ids[i] = uint(i + 1)
+	}
+	messageIDs := sentColumns{}
+	for _, id := range ids {
+		messageIDs.set("message_id", id, fmt.Sprintf("m-%d", id))
+	}
+	tests := []struct {
+		name    string
+		update  func(p *producer)
+		updates int
+	}{
+		{"status", func(p *producer) { p.setStatus(ids, failed) }, 3},
+		{"release", func(p *producer) { p.releaseClaims(ids) }, 3},
+		{"retry later", func(p *producer) { p.retryLater(ids) }, 3},
+		// Each row binds three parameters, so a chunk holds 333 rows.
+		{"sent with message ids", func(p *producer) { p.setSent(ids, messageIDs) }, 8},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			log := &eventLog{}
+			p := newTestProducer(dryRunDB(t, log), &fakeSQS{})
+			tt.update(p)
+			if updates := log.matching("sql UPDATE"); len(updates) != tt.updates {
+				t.Errorf("got %d UPDATE statements, want %d", len(updates), tt.updates)
+			}
+		})
+	}
+}
@@ -1,10 +1,14 @@
 package config
 
 import (
+	"database/sql"
 	"fmt"
+	"strings"
 
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+	"gorm.io/plugin/dbresolver"
 )
 
 type DBConfig struct {
@@ -14,18 +18,80 @@ type DBConfig struct {
 	User     string
 	DBName   string
 	SSLMode  string
+	// ApplicationName is reported to Postgres so the app's connections can
+	// be told apart in pg_stat_activity.
+	ApplicationName string
+	// ReplicaDSN, when set, is a read replica that serves queries while
+	// writes keep going to the primary.
+	ReplicaDSN string
+	// TablePrefix and SingularTable configure gorm's naming strategy, so the
+	// models can map onto tables named by other conventions.
+	TablePrefix   string
+	SingularTable bool
 }
 
-func DBConnection(config *DBConfig) (*gorm.DB, error) {
+// DSN builds the keyword/value connection string for the primary.
+func (config *DBConfig) DSN() string {
 	dsn := fmt.Sprintf(
 		"host=%s port=%s user=%s password=%s dbname=%s sslmode=%s",
 		config.Host, config.Port, config.User, config.Password, config.DBName, config.SSLMode,
 	)
-	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
+	if config.ApplicationName != "" {
+		dsn += " application_name=" + quoteDSNValue(config.ApplicationName)
+	}
+	return dsn
+}
+
+// quoteDSNValue single-quotes a connection string value so that spaces,
+// quotes and backslashes in it survive parsing.
+func quoteDSNValue(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `'`, `\'`)
+	return "'" + value + "'"
+}
+
+// DBConnection opens the primary and, with ReplicaDSN, registers the
+// replica with dbresolver. The replica's pool is returned along with the
+// primary, nil without a replica, since closing the primary's pool leaves
+// it open.
+func DBConnection(config *DBConfig) (*gorm.DB, *sql.DB, error) {
+	db, err := gorm.Open(postgres.Open(config.DSN()), &gorm.Config{
+		NamingStrategy: schema.NamingStrategy{TablePrefix: config.TablePrefix, SingularTable: config.SingularTable},
+	})
 	if err != nil {
 		fmt.Println("Db connection error:", err)
-		return nil, err
+		return nil, nil, err
+	}
+	if config.ReplicaDSN == "" {
+		fmt.Println("Database connected")
+		return db, nil, nil
+	}
+
+	replica, err := openReplica(db, config.ReplicaDSN)
+	if err != nil {
+		fmt.Println("Db replica connection error:", err)
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+		return nil, nil, err
 	}
+	fmt.Println("Database replica registered")
 	fmt.Println("Database connected")
-	return db, nil
+	return db, replica, nil
+}
+
+// openReplica opens the pool of the replica at dsn and has db read from it.
+func openReplica(db *gorm.DB, dsn string) (*sql.DB, error) {
+	replica, err := sql.Open("pgx", dsn)
+	if err != nil {
+		return nil, err
+	}
+	err = db.Use(dbresolver.Register(dbresolver.Config{
+		Replicas: []gorm.Dialector{postgres.New(postgres.Config{Conn: replica})},
+	}))
+	if err != nil {
+		replica.Close()
+		return nil, err
+	}
+	return replica, nil
 }
@@ -0,0 +1,41 @@
+package config
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+func TestDSNApplicationName(t *testing.T) {
+	tests := []struct {
+		name string
+		app  string
+	}{
+		{"plain", "sqs-url-producer"},
+		{"spaces", "url producer eu"},
+		{"quote and backslash", `it's a \ name`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := DBConfig{Host: "db", Port: "5432", User: "u", Password: "p", DBName: "urls", SSLMode: "disable", ApplicationName: tt.app}
+			parsed, err := pgconn.ParseConfig(config.DSN())
+			if err != nil {
+				t.Fatalf("DSN %q does not parse: %v", config.DSN(), err)
+			}
+			if got := parsed.RuntimeParams["application_name"]; got != tt.app {
+				t.Errorf("got application_name %q, want %q", got, tt.app)
+			}
+			if parsed.Database != "urls" {
+				t.Errorf("got dbname %q, want urls", parsed.Database)
+			}
+		})
+	}
+}
+
+func TestDSNWithoutApplicationName(t *testing.T) {
+	config := DBConfig{Host: "db", Port: "5432", User: "u", Password: "p", DBName: "urls", SSLMode: "disable"}
+	if dsn := config.DSN(); strings.Contains(dsn, "application_name") {
+		t.Errorf("got %q, want no application_name", dsn)
+	}
+}
@@ -0,0 +1,106 @@
+//go:build consumer
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/joho/godotenv"
+)
+
+// The consume subcommand is only compiled into binaries built with
+// `-tags consumer`. It reads messages back off SQS_URL so an operator can
+// confirm that what the producer sends actually round-trips:
+//
+//	go build -tags consumer -o sqsURLProducer . && ./sqsURLProducer consume -max 10
+func init() {
+	subcommands["consume"] = runConsumer
+}
+
+func runConsumer(args []string) {
+	flags := flag.NewFlagSet("consume", flag.ExitOnError)
+	maxMessages := flags.Int("max", 0, "stop after receiving this many messages (0 means run until interrupted)")
+	keep := flags.Bool("keep", false, "leave received messages on the queue instead of deleting them")
+	flags.Parse(args)
+
+	// The consumer does not need the database, so a missing .env is fine
+	// as long as the variables are set some other way.
+	godotenv.Load(".env")
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	cfg, err := loadAWSConfig(ctx)
+	if err != nil {
+		log.Fatalf("Failed to load AWS configuration: %v", err)
+	}
+	queueURL, err := resolveQueueURL(ctx, ssm.NewFromConfig(cfg), cfg.Region)
+	if err != nil {
+		log.Fatalf("Failed to resolve the queue URL: %v", err)
+	}
+
+	received, err := consumeMessages(ctx, sqs.NewFromConfig(cfg), queueURL, *maxMessages, !*keep, os.Stdout)
+	if err != nil && ctx.Err() == nil {
+		log.Fatalf("Failed to receive messages: %v", err)
+	}
+	log.Printf("Received %d messages", received)
+}
+
+// consumerAPI is the part of the SQS client the consumer uses, so that
+// tests can stand in for SQS.
+type consumerAPI interface {
+	ReceiveMessage(ctx context.Context, params *sqs.ReceiveMessageInput, optFns ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error)
+	DeleteMessage(ctx context.Context, params *sqs.DeleteMessageInput, optFns ...func(*sqs.Options)) (*sqs.DeleteMessageOutput, error)
+}
+
+// MaxReceiveMessages is the most messages SQS returns from one
+// ReceiveMessage call.
+const MaxReceiveMessages = 10
+
+// consumeMessages long-polls queueURL and prints the id and body of every
+// message to w until max messages have been received (0 for no limit) or
+// ctx is cancelled. No more messages are asked for than are left to reach
+// max, so none are received only to be left unprinted.
+func consumeMessages(ctx context.Context, client consumerAPI, queueURL string, max int, deleteReceived bool, w io.Writer) (int, error) {
+	received := 0
+	for max == 0 || received < max {
+		want := MaxReceiveMessages
+		if max > 0 {
+			want = min(want, max-received)
+		}
+		out, err := client.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{
+			QueueUrl:            aws.String(queueURL),
+			MaxNumberOfMessages: int32(want),
+			WaitTimeSeconds:     20,
+		})
+		if err != nil {
+			return received, err
+		}
+
+		for _, msg := range out.Messages {
+			received++
+			fmt.Fprintf(w, "%s\t%s\n", aws.ToString(msg.MessageId), aws.ToString(msg.Body))
+
+			if !deleteReceived {
+				continue
+			}
+			if _, err := client.DeleteMessage(ctx, &sqs.DeleteMessageInput{
+				QueueUrl:      aws.String(queueURL),
+				ReceiptHandle: msg.ReceiptHandle,
+			}); err != nil {
+				log.Printf("Failed to delete message %s: %v", aws.ToString(msg.MessageId), err)
+			}
+		}
+	}
+	return received, nil
+}
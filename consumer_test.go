@@ -0,0 +1,103 @@
+//go:build consumer
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// fakeQueue is a fakeSQS that hands the messages sent to it back out to
+// ReceiveMessage, in the order they were sent.
+type fakeQueue struct {
+	*fakeSQS
+	received int
+	// asked is the MaxNumberOfMessages of every ReceiveMessage call.
+	asked   []int32
+	deleted []string
+}
+
+func (q *fakeQueue) ReceiveMessage(ctx context.Context, in *sqs.ReceiveMessageInput, _ ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.asked = append(q.asked, in.MaxNumberOfMessages)
+	var sent []types.SendMessageBatchRequestEntry
+	for _, r := range q.requests {
+		sent = append(sent, r.Entries...)
+	}
+	out := &sqs.ReceiveMessageOutput{}
+	for _, e := range sent[q.received:min(q.received+int(in.MaxNumberOfMessages), len(sent))] {
+		out.Messages = append(out.Messages, types.Message{
+			MessageId:     aws.String("m-" + aws.ToString(e.MessageBody)),
+			Body:          e.MessageBody,
+			ReceiptHandle: e.Id,
+		})
+	}
+	q.received += len(out.Messages)
+	return out, nil
+}
+
+func (q *fakeQueue) DeleteMessage(ctx context.Context, in *sqs.DeleteMessageInput, _ ...func(*sqs.Options)) (*sqs.DeleteMessageOutput, error) {
+	q.deleted = append(q.deleted, aws.ToString(in.ReceiptHandle))
+	return &sqs.DeleteMessageOutput{}, nil
+}
+
+func TestConsumeRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		max    int
+		delete bool
+		asked  []int32
+	}{
+		{"up to max", 15, true, []int32{10, 5}},
+		{"fewer than a receive", 3, true, []int32{3}},
+		{"kept on the queue", 12, false, []int32{10, 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := &fakeQueue{fakeSQS: &fakeSQS{}}
+			p := newTestProducer(dryRunDB(t, nil), q)
+			var result ProcessResult
+			p.sendURLs(context.Background(), testRows(25), &result)
+			if result.Sent != 25 {
+				t.Fatalf("sent %d URLs, want 25", result.Sent)
+			}
+
+			var out bytes.Buffer
+			received, err := consumeMessages(context.Background(), q, testQueueURL, tt.max, tt.delete, &out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if received != tt.max {
+				t.Errorf("received %d messages, want %d", received, tt.max)
+			}
+			if !slices.Equal(q.asked, tt.asked) {
+				t.Errorf("asked for %v messages, want %v", q.asked, tt.asked)
+			}
+			lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+			for i, line := range lines {
+				if want := fmt.Sprintf("m-url-%d\turl-%d", i+1, i+1); line != want {
+					t.Fatalf("line %d: got %q, want %q", i+1, line, want)
+				}
+			}
+			if len(lines) != tt.max {
+				t.Errorf("printed %d messages, want %d", len(lines), tt.max)
+			}
+			want := 0
+			if tt.delete {
+				want = tt.max
+			}
+			if len(q.deleted) != want {
+				t.Errorf("deleted %d messages, want %d", len(q.deleted), want)
+			}
+		})
+	}
+}
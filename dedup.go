@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ofjangra/sqsURLProducer/models"
+)
+
+// DedupWindow is how long a FIFO queue remembers a deduplication id.
+const DedupWindow = 5 * time.Minute
+
+// DedupScope decides what the MessageDeduplicationId of a FIFO message is
+// derived from, and so which re-sends SQS suppresses:
+//
+//   - DedupScopeURL hashes the URL alone. The same URL sent twice within the
+//     dedup window is delivered once, even if it was inserted as a new row.
+//   - DedupScopeURLTime hashes the URL together with the dedup window it is
+//     sent in, so a URL re-inserted after the window is delivered again.
+//     Two sends straddling a window boundary are both delivered.
+//   - DedupScopeRowID uses the row id, so every row is delivered once no matter
+//     how often its URL appears in the table. With SOURCE_TABLES the id also
+//     names the row's table, since the tables number their rows separately.
+//
+// DedupScopeNone leaves the id unset, which requires content-based
+// deduplication to be enabled on the queue.
+type DedupScope string
+
+const (
+	DedupScopeNone    DedupScope = ""
+	DedupScopeURL     DedupScope = "url"
+	DedupScopeURLTime DedupScope = "url_time"
+	DedupScopeRowID   DedupScope = "row_id"
+)
+
+func parseDedupScope(value string) (DedupScope, error) {
+	switch s := DedupScope(value); s {
+	case DedupScopeNone, DedupScopeURL, DedupScopeURLTime, DedupScopeRowID:
+		return s, nil
+	}
+	return "", fmt.Errorf("invalid dedup scope %q, expected %s, %s or %s", value, DedupScopeURL, DedupScopeURLTime, DedupScopeRowID)
+}
+
+// MaxDedupIDLength is the longest MessageDeduplicationId SQS accepts.
+const MaxDedupIDLength = 128
+
+// dedupID returns the deduplication id for url, a row of table ("" for the
+// urls table without SOURCE_TABLES), under scope, or "" when no explicit id
+// should be sent.
+func dedupID(scope DedupScope, table string, url models.URLs, now time.Time) string {
+	switch scope {
+	case DedupScopeURL:
+		return hashID(url.URL)
+	case DedupScopeURLTime:
+		bucket := now.Unix() / int64(DedupWindow/time.Second)
+		return hashID(url.URL + "\n" + strconv.FormatInt(bucket, 10))
+	case DedupScopeRowID:
+		id := strconv.FormatUint(uint64(url.ID), 10)
+		if table == "" {
+			return "row-" + id
+		}
+		if dedup := "row-" + table + "-" + id; len(dedup) <= MaxDedupIDLength {
+			return dedup
+		}
+		// Only a schema-qualified name near Postgres's limit is this long.
+		return "row-" + hashID(table+"\n"+id)
+	}
+	return ""
+}
+
+func hashID(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
+
+// isFIFOQueue reports whether queueURL names a FIFO queue, whose names
+// always end in ".fifo".
+func isFIFOQueue(queueURL string) bool {
+	return strings.HasSuffix(queueURL, ".fifo")
+}
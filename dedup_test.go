@@ -0,0 +1,82 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/ofjangra/sqsURLProducer/models"
+	"gorm.io/gorm"
+)
+
+func TestDedupIDSourceTables(t *testing.T) {
+	db := dryRunDB(t, nil)
+	p := newTestProducer(db, &fakeSQS{})
+	p.queueURL = "https://sqs.us-east-1.amazonaws.com/123456789012/urls.fifo"
+	p.dedupScope = DedupScopeRowID
+
+	// Row 1 of each table, as processURLs polls them with SOURCE_TABLES.
+	ids := map[string]string{}
+	for _, table := range []string{"urls", "urls_news"} {
+		p.db = db.Table(table).Session(&gorm.Session{})
+		batches, _ := p.buildBatches(testRows(1))
+		ids[table] = aws.ToString(batches[0].entries[0].MessageDeduplicationId)
+	}
+	if ids["urls"] == ids["urls_news"] {
+		t.Fatalf("row 1 of urls and urls_news share the dedup id %q", ids["urls"])
+	}
+	if ids["urls"] != "row-urls-1" {
+		t.Errorf("got %q, want row-urls-1", ids["urls"])
+	}
+
+	row := models.URLs{ID: 5}
+	if id := dedupID(DedupScopeRowID, "", row, time.Now()); id != "row-5" {
+		t.Errorf("got %q without SOURCE_TABLES, want row-5", id)
+	}
+	long := dedupID(DedupScopeRowID, "public."+strings.Repeat("u", 120), row, time.Now())
+	if len(long) > MaxDedupIDLength {
+		t.Errorf("got a %d byte dedup id for a long table name, want at most %d", len(long), MaxDedupIDLength)
+	}
+}
+
+func TestDedupID(t *testing.T) {
+	row := models.URLs{ID: 7, URL: "https://example.com/a"}
+	sameURL := models.URLs{ID: 8, URL: "https://example.com/a"}
+	other := models.URLs{ID: 7, URL: "https://example.com/b"}
+	// A dedup window starts at every multiple of DedupWindow.
+	boundary := time.Unix(1_800_000_000-1_800_000_000%300, 0)
+	before, start, end := boundary.Add(-time.Second), boundary, boundary.Add(DedupWindow-time.Second)
+	tests := []struct {
+		name  string
+		scope DedupScope
+		a, b  models.URLs
+		at    [2]time.Time
+		same  bool
+	}{
+		{"none", DedupScopeNone, row, row, [2]time.Time{start, start}, true},
+		{"url: same URL in another row", DedupScopeURL, row, sameURL, [2]time.Time{start, end}, true},
+		{"url: same URL hours later", DedupScopeURL, row, row, [2]time.Time{start, start.Add(3 * time.Hour)}, true},
+		{"url: other URL", DedupScopeURL, row, other, [2]time.Time{start, start}, false},
+		{"url_time: within a window", DedupScopeURLTime, row, sameURL, [2]time.Time{start, end}, true},
+		{"url_time: across a window boundary", DedupScopeURLTime, row, row, [2]time.Time{before, start}, false},
+		{"url_time: other URL", DedupScopeURLTime, row, other, [2]time.Time{start, start}, false},
+		{"row_id: same row", DedupScopeRowID, row, other, [2]time.Time{start, start.Add(time.Hour)}, true},
+		{"row_id: same URL in another row", DedupScopeRowID, row, sameURL, [2]time.Time{start, start}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := dedupID(tt.scope, "", tt.a, tt.at[0])
+			b := dedupID(tt.scope, "", tt.b, tt.at[1])
+			if (a == b) != tt.same {
+				t.Errorf("got ids %q and %q, want them equal: %v", a, b, tt.same)
+			}
+			if tt.scope == DedupScopeNone && a != "" {
+				t.Errorf("got id %q, want none", a)
+			}
+			if len(a) > MaxDedupIDLength {
+				t.Errorf("got a %d byte id, SQS allows %d", len(a), MaxDedupIDLength)
+			}
+		})
+	}
+}
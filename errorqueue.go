@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// poisonRow is a claimed row that can never be delivered, with the reason.
+// table is set by forwardPoison.
+type poisonRow struct {
+	id     uint
+	table  string
+	url    string
+	reason string
+}
+
+// SendMode decides which goroutines send to the destination queues.
+//
+//   - SendShared (the default) sends to SQS_URL and ERROR_QUEUE_URL from the
+//     producer's goroutine, so failed rows are forwarded before the poll
+//     carries on.
+//   - SendPerQueue gives ERROR_QUEUE_URL and NOTIFY_QUEUE_URL a sender
+//     goroutine each, fed through a channel, so a slow or failing error or
+//     notify queue never holds up delivery to SQS_URL. What is queued at
+//     shutdown is still sent.
+type SendMode string
+
+const (
+	SendShared   SendMode = "shared"
+	SendPerQueue SendMode = "per_queue"
+)
+
+func parseSendMode(value string) (SendMode, error) {
+	switch m := SendMode(value); m {
+	case SendShared, SendPerQueue:
+		return m, nil
+	}
+	return "", fmt.Errorf("invalid send mode %q, expected %s or %s", value, SendShared, SendPerQueue)
+}
+
+// ErrorQueueBuffer is how many forwards wait for the error queue's own
+// sender before further ones are dropped, see SendPerQueue.
+const ErrorQueueBuffer = 100
+
+// startQueueSenders starts the sender goroutines of SendPerQueue for the
+// error and notify queues that are set.
+func (p *producer) startQueueSenders() {
+	if p.errorQueueURL != "" {
+		p.startErrorQueueSender()
+	}
+	if n, ok := p.notifier.(*queueNotifier); ok {
+		n.start()
+	}
+}
+
+// stopQueueSenders waits for the senders started by startQueueSenders to
+// send what is queued, see stopErrorQueueSender.
+func (p *producer) stopQueueSenders() {
+	p.stopErrorQueueSender()
+	if n, ok := p.notifier.(*queueNotifier); ok {
+		n.stop()
+	}
+}
+
+// startErrorQueueSender starts the goroutine that forwards rows to
+// ERROR_QUEUE_URL with SendPerQueue.
+func (p *producer) startErrorQueueSender() {
+	p.errorQueue = make(chan []poisonRow, ErrorQueueBuffer)
+	p.errorQueueDone = make(chan struct{})
+	go func() {
+		defer close(p.errorQueueDone)
+		for rows := range p.errorQueue {
+			p.sendPoison(context.Background(), rows)
+		}
+	}()
+}
+
+// stopErrorQueueSender waits for the error queue's sender to forward what is
+// queued. It must be called from the goroutine that forwards rows, once it
+// is done polling.
+func (p *producer) stopErrorQueueSender() {
+	if p.errorQueue == nil {
+		return
+	}
+	close(p.errorQueue)
+	<-p.errorQueueDone
+}
+
+// forwardPoison sends rows that are about to be marked failed to
+// ERROR_QUEUE_URL, so a separate process can inspect them. Each message
+// carries the URL as its body, with url_id and error attributes and, with
+// SOURCE_TABLES, a source_table attribute naming the row's table. Forwarding
+// is best effort: a row whose forward fails is only logged, and is marked
+// failed either way. With sendOnly nothing is forwarded, since the rows stay
+// pending and would be forwarded again by every poll.
+func (p *producer) forwardPoison(ctx context.Context, rows []poisonRow) {
+	if p.sendOnly || p.errorQueueURL == "" || len(rows) == 0 {
+		return
+	}
+	for i := range rows {
+		rows[i].table = p.db.Statement.Table
+	}
+	if p.errorQueue != nil {
+		select {
+		case p.errorQueue <- rows:
+		default:
+			log.Printf("Error queue sender is %d forwards behind, not forwarding %d failed URLs", ErrorQueueBuffer, len(rows))
+		}
+		return
+	}
+	p.sendPoison(ctx, rows)
+}
+
+// sendPoison forwards rows to ERROR_QUEUE_URL in batches.
+func (p *producer) sendPoison(ctx context.Context, rows []poisonRow) {
+	fifo := isFIFOQueue(p.errorQueueURL)
+	now := time.Now()
+	for start := 0; start < len(rows); start += MaxSQSBatchEntries {
+		chunk := rows[start:min(start+MaxSQSBatchEntries, len(rows))]
+		entries := make([]types.SendMessageBatchRequestEntry, len(chunk))
+		for i, row := range chunk {
+			entries[i] = types.SendMessageBatchRequestEntry{
+				Id:          aws.String(fmt.Sprintf("err-%d", i)),
+				MessageBody: aws.String(errorQueueBody(row.url)),
+				MessageAttributes: map[string]types.MessageAttributeValue{
+					"url_id": numberAttribute(uint64(row.id)),
+					"error":  stringAttribute(row.reason),
+				},
+			}
+			if row.table != "" {
+				entries[i].MessageAttributes["source_table"] = stringAttribute(row.table)
+			}
+			if fifo {
+				entries[i].MessageGroupId = aws.String(fmt.Sprintf("url-%d", row.id))
+				entries[i].MessageDeduplicationId = aws.String(fmt.Sprintf("url-%d-%d", row.id, now.UnixNano()))
+			}
+		}
+
+		// Like the send itself, waiting for the rate limit is not cut
+		// short, so failed URLs are still forwarded during a shutdown.
+		p.errorQueueLimit.wait(context.WithoutCancel(ctx), len(entries))
+		out, err := p.sqsClient.SendMessageBatch(context.WithoutCancel(ctx), &sqs.SendMessageBatchInput{
+			QueueUrl: aws.String(p.errorQueueURL),
+			Entries:  entries,
+		})
+		if err != nil {
+			log.Printf("Failed to forward %d failed URLs to the error queue: %v", len(chunk), err)
+			continue
+		}
+		for _, f := range out.Failed {
+			log.Printf("Failed to forward a failed URL to the error queue: %s: %s", aws.ToString(f.Code), aws.ToString(f.Message))
+		}
+		log.Printf("Forwarded %d failed URLs to the error queue", len(out.Successful))
+	}
+}
+
+// errorQueueBody is the body forwarded for url. A URL that is itself not a
+// valid message body, which may be why it failed, is sent escaped instead,
+// and either is cut short to leave room for the attributes.
+func errorQueueBody(url string) string {
+	const limit = MaxSQSMessageBytes - 1024
+	if url != "" && len(url) <= limit && validMessageText(url) == nil {
+		return url
+	}
+	quoted := strconv.QuoteToASCII(url)
+	if len(quoted) > limit {
+		quoted = quoted[:limit]
+	}
+	return quoted
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/ofjangra/sqsURLProducer/models"
+)
+
+const testErrorQueueURL = "https://sqs.us-east-1.amazonaws.com/123456789012/errors"
+
+// requestsTo returns the requests client was sent for queueURL.
+func requestsTo(client *fakeSQS, queueURL string) []*sqs.SendMessageBatchInput {
+	var requests []*sqs.SendMessageBatchInput
+	for _, req := range client.requests {
+		if aws.ToString(req.QueueUrl) == queueURL {
+			requests = append(requests, req)
+		}
+	}
+	return requests
+}
+
+func TestForwardPoison(t *testing.T) {
+	tests := []struct {
+		name   string
+		urls   func() []models.URLs
+		fail   func(call int, body string) (string, bool, bool)
+		body   string
+		reason string
+	}{
+		{
+			name: "unsendable body",
+			urls: func() []models.URLs {
+				urls := testRows(3)
+				urls[1].URL = "https://example.com/\x00"
+				return urls
+			},
+			body:   `"https://example.com/\x00"`,
+			reason: "U+0000 at byte 20, which SQS does not allow",
+		},
+		{
+			name: "rejected by SQS",
+			urls: func() []models.URLs { return testRows(3) },
+			fail: func(call int, body string) (string, bool, bool) {
+				return "InvalidParameterValue", true, body == "url-2"
+			},
+			body:   "url-2",
+			reason: "InvalidParameterValue: fake failure",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			log := &eventLog{}
+			client := &fakeSQS{log: log, fail: tt.fail}
+			p := newTestProducer(dryRunDB(t, log), client)
+			p.retryBudget = time.Nanosecond
+			p.errorQueueURL = testErrorQueueURL
+
+			var result ProcessResult
+			p.sendURLs(context.Background(), tt.urls(), &result)
+
+			forwarded := requestsTo(client, testErrorQueueURL)
+			if len(forwarded) != 1 || len(forwarded[0].Entries) != 1 {
+				t.Fatalf("got %d error queue requests, want one with one entry", len(forwarded))
+			}
+			entry := forwarded[0].Entries[0]
+			if body := aws.ToString(entry.MessageBody); body != tt.body {
+				t.Errorf("got forwarded body %q, want %q", body, tt.body)
+			}
+			if id := aws.ToString(entry.MessageAttributes["url_id"].StringValue); id != "2" {
+				t.Errorf("got url_id %q, want 2", id)
+			}
+			if reason := aws.ToString(entry.MessageAttributes["error"].StringValue); !strings.Contains(reason, tt.reason) {
+				t.Errorf("got error %q, want it to contain %q", reason, tt.reason)
+			}
+
+			// The row is forwarded and then marked failed.
+			events := log.events
+			index := func(substr string) int {
+				return slices.IndexFunc(events, func(e string) bool { return strings.Contains(e, substr) })
+			}
+			forward := index("send " + testErrorQueueURL)
+			marked := index(`'` + string(models.StatusFailed) + `'`)
+			if forward < 0 || marked < forward {
+				t.Errorf("want the forward before row 2 is marked failed, got %q", events)
+			}
+			if marked >= 0 && !strings.Contains(events[marked], "IN (2)") {
+				t.Errorf("got %q, want row 2 marked failed", events[marked])
+			}
+		})
+	}
+}
+
+// slowErrorQueue sends to SQS_URL through fakeSQS and to the error queue
+// through errors, whose requests wait until release is closed.
+type slowErrorQueue struct {
+	*fakeSQS
+	errors  *fakeSQS
+	release chan struct{}
+}
+
+func (s *slowErrorQueue) SendMessageBatch(ctx context.Context, in *sqs.SendMessageBatchInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageBatchOutput, error) {
+	if aws.ToString(in.QueueUrl) == testErrorQueueURL {
+		<-s.release
+		return s.errors.SendMessageBatch(ctx, in, optFns...)
+	}
+	return s.fakeSQS.SendMessageBatch(ctx, in, optFns...)
+}
+
+func TestSendPerQueue(t *testing.T) {
+	client := &slowErrorQueue{
+		fakeSQS: &fakeSQS{fail: func(call int, body string) (string, bool, bool) {
+			return "InvalidParameterValue", true, body == "url-1" || body == "url-3" || body == "url-5"
+		}},
+		errors:  &fakeSQS{},
+		release: make(chan struct{}),
+	}
+	p := newTestProducer(dryRunDB(t, nil), client)
+	p.batchSize = 2
+	p.errorQueueURL = testErrorQueueURL
+	p.startQueueSenders()
+	released := false
+	t.Cleanup(func() {
+		if !released {
+			close(client.release)
+		}
+	})
+
+	// Every batch has a row to forward, but none waits for the stuck error
+	// queue.
+	done := make(chan ProcessResult)
+	go func() {
+		var result ProcessResult
+		p.sendURLs(context.Background(), testRows(6), &result)
+		done <- result
+	}()
+	select {
+	case result := <-done:
+		if result.Sent != 3 || result.Failed != 3 {
+			t.Errorf("got %d sent and %d failed, want 3 and 3", result.Sent, result.Failed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("sending to SQS_URL waited for the error queue")
+	}
+	if len(client.requests) != 3 {
+		t.Errorf("got %d requests to SQS_URL, want 3", len(client.requests))
+	}
+
+	// What is queued is still forwarded when the senders stop.
+	close(client.release)
+	released = true
+	p.stopQueueSenders()
+	var forwarded []string
+	for _, req := range client.errors.requests {
+		for _, e := range req.Entries {
+			forwarded = append(forwarded, aws.ToString(e.MessageBody))
+		}
+	}
+	if want := []string{"url-1", "url-3", "url-5"}; !slices.Equal(forwarded, want) {
+		t.Errorf("got %q forwarded, want %q", forwarded, want)
+	}
+}
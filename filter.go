@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"sort"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// fetchFilterColumns are the columns FETCH_FILTER may compare. Status and
+// claimed_at are left out since the claim pattern owns them.
+var fetchFilterColumns = []string{"url", "group_key"}
+
+// fetchFilter restricts which pending rows a poll claims. It is parsed from
+// FETCH_FILTER, written as a URL query string such as
+// group_key=tenant-a&group_key=tenant-b: each column is compared for
+// equality, a repeated column matches any of its values, and different
+// columns must all match. Columns are checked against fetchFilterColumns and
+// values are always bound as query parameters, so a filter cannot inject
+// SQL. Raw WHERE fragments are deliberately not supported for that reason.
+type fetchFilter map[string][]string
+
+func parseFetchFilter(value string) (fetchFilter, error) {
+	if value == "" {
+		return nil, nil
+	}
+	values, err := url.ParseQuery(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid fetch filter %q: %w", value, err)
+	}
+	for column := range values {
+		if !slices.Contains(fetchFilterColumns, column) {
+			return nil, fmt.Errorf("invalid fetch filter column %q, expected one of %v", column, fetchFilterColumns)
+		}
+	}
+	return fetchFilter(values), nil
+}
+
+// apply adds the filter's conditions to q. A nil filter leaves q unchanged.
+func (f fetchFilter) apply(q *gorm.DB) *gorm.DB {
+	columns := make([]string, 0, len(f))
+	for column := range f {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+
+	for _, column := range columns {
+		values := make([]any, len(f[column]))
+		for i, v := range f[column] {
+			values[i] = v
+		}
+		q = q.Where(clause.IN{Column: clause.Column{Name: column}, Values: values})
+	}
+	return q
+}
+
+func (f fetchFilter) String() string {
+	return url.Values(f).Encode()
+}
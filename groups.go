@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log"
+	neturl "net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/ofjangra/sqsURLProducer/models"
+)
+
+// MaxMessageGroupIDLength is the longest MessageGroupId SQS accepts.
+const MaxMessageGroupIDLength = 128
+
+// GroupStrategy decides the MessageGroupId of rows without a group_key.
+//
+//   - GroupPerMessage (the default) gives every message its own group, so
+//     nothing is ordered and FIFO throughput is never limited by a group.
+//   - GroupByHost groups messages by the URL's host, keeping the URLs of one
+//     host in order. In FIFO high-throughput mode ordering only holds within
+//     a group and throughput scales with the number of active groups, so
+//     many distinct hosts spread well across partitions while a single hot
+//     host is limited to the per-group rate.
+//   - GroupSingle puts every message in one group, delivering them all in
+//     order at the cost of the per-group throughput limit.
+//   - GroupHashed hashes the URL into one of GROUP_BUCKETS groups, trading
+//     ordering for parallelism: more buckets deliver more messages at once,
+//     fewer keep more of them in order. The same URL always lands in the
+//     same bucket.
+//
+// Only FIFO queues honour group ids; standard queues ignore them.
+type GroupStrategy string
+
+const (
+	GroupPerMessage GroupStrategy = "per_message"
+	GroupByHost     GroupStrategy = "by_host"
+	GroupSingle     GroupStrategy = "single"
+	GroupHashed     GroupStrategy = "hashed"
+
+	// SingleGroupID is the group id used by GroupSingle.
+	SingleGroupID = "single"
+)
+
+func parseGroupStrategy(value string) (GroupStrategy, error) {
+	switch s := GroupStrategy(value); s {
+	case GroupPerMessage, GroupByHost, GroupSingle, GroupHashed:
+		return s, nil
+	}
+	return "", fmt.Errorf("invalid group id strategy %q, expected %s, %s, %s or %s", value, GroupPerMessage, GroupByHost, GroupSingle, GroupHashed)
+}
+
+// groupID returns the MessageGroupId for url. A row's group_key wins when it
+// is a valid group id, so messages sharing a key are delivered in order on
+// FIFO queues; otherwise the group strategy derives one, falling back to a
+// group of its own from the message's sequence number n.
+func (p *producer) groupID(url models.URLs, n int) string {
+	if url.GroupKey != nil {
+		key := *url.GroupKey
+		if validMessageGroupID(key) {
+			return key
+		}
+		log.Printf("Ignoring invalid group_key %q on URL %d, it must be 1-%d printable ASCII characters", key, url.ID, MaxMessageGroupIDLength)
+	}
+	switch p.groupStrategy {
+	case GroupSingle:
+		return SingleGroupID
+	case GroupHashed:
+		h := fnv.New32a()
+		h.Write([]byte(url.URL))
+		return fmt.Sprintf("bucket-%d", h.Sum32()%uint32(p.groupBuckets))
+	case GroupByHost:
+		if host := urlHost(url.URL); host != "" {
+			if validMessageGroupID(host) {
+				return host
+			}
+			// Hosts can be up to 253 characters, too long for a group id.
+			return "host-" + hashID(host)
+		}
+		log.Printf("URL %d has no host to group by, sending it in a group of its own", url.ID)
+	}
+	return fmt.Sprintf("group-%d", n)
+}
+
+// urlHost returns the lower-cased host name of rawURL, or "" if it has none.
+func urlHost(rawURL string) string {
+	u, err := neturl.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+// validMessageGroupID reports whether id satisfies the SQS constraints on
+// message group ids: 1 to 128 alphanumeric or punctuation characters.
+func validMessageGroupID(id string) bool {
+	if strings.TrimSpace(id) == "" || len(id) > MaxMessageGroupIDLength {
+		return false
+	}
+	for _, r := range id {
+		if r <= ' ' || r > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// groupSkew returns the share of the messages in batches that belong to
+// their largest message group: 1 when all share one group, close to 0 when
+// they are spread across many. A FIFO queue delivers each group in order,
+// one message at a time per consumer, so a high skew serialises most of a
+// poll behind a single group. It also returns the number of messages, and a
+// skew of 0 when there are none.
+func groupSkew(batches []outboundBatch) (float64, int) {
+	counts := map[string]int{}
+	total, largest := 0, 0
+	for _, batch := range batches {
+		for _, entry := range batch.entries {
+			group := aws.ToString(entry.MessageGroupId)
+			counts[group]++
+			largest = max(largest, counts[group])
+			total++
+		}
+	}
+	if total == 0 {
+		return 0, 0
+	}
+	return float64(largest) / float64(total), total
+}
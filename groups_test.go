@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/ofjangra/sqsURLProducer/models"
+)
+
+func TestGroupID(t *testing.T) {
+	key := func(k string) *string { return &k }
+	longHost := strings.Repeat("a", 60) + "." + strings.Repeat("b", 60) + ".example.com"
+	tests := []struct {
+		name     string
+		strategy GroupStrategy
+		url      models.URLs
+		want     string
+	}{
+		{"per message", GroupPerMessage, models.URLs{URL: "https://example.com/a"}, "group-7"},
+		{"group_key wins", GroupByHost, models.URLs{URL: "https://example.com/a", GroupKey: key("tenant-1")}, "tenant-1"},
+		{"group_key wins over single", GroupSingle, models.URLs{URL: "https://example.com/a", GroupKey: key("tenant-1")}, "tenant-1"},
+		{"blank group_key ignored", GroupPerMessage, models.URLs{URL: "https://example.com/a", GroupKey: key(" ")}, "group-7"},
+		{"group_key with a space ignored", GroupSingle, models.URLs{URL: "https://example.com/a", GroupKey: key("tenant 1")}, SingleGroupID},
+		{"group_key too long ignored", GroupPerMessage, models.URLs{URL: "https://example.com/a", GroupKey: key(strings.Repeat("k", 129))}, "group-7"},
+		{"by host", GroupByHost, models.URLs{URL: "https://Example.COM:8443/a?b=c"}, "example.com"},
+		{"by host, host too long", GroupByHost, models.URLs{URL: "https://" + longHost + "/a"}, "host-" + hashID(longHost)},
+		{"by host, no host", GroupByHost, models.URLs{URL: "not a url"}, "group-7"},
+		{"single", GroupSingle, models.URLs{URL: "https://example.com/a"}, SingleGroupID},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestProducer(nil, &fakeSQS{})
+			p.groupStrategy, p.groupBuckets = tt.strategy, 16
+			got := p.groupID(tt.url, 7)
+			if got != tt.want {
+				t.Errorf("got group %q, want %q", got, tt.want)
+			}
+			if !validMessageGroupID(got) {
+				t.Errorf("got invalid group id %q", got)
+			}
+		})
+	}
+}
+
+func TestHashedGroups(t *testing.T) {
+	const buckets, urls = 16, 1600
+	p := newTestProducer(nil, &fakeSQS{})
+	p.groupStrategy, p.groupBuckets = GroupHashed, buckets
+
+	counts := map[string]int{}
+	for i := range urls {
+		url := models.URLs{URL: fmt.Sprintf("https://example.com/page/%d", i)}
+		group := p.groupID(url, i)
+		if again := p.groupID(url, i+1); again != group {
+			t.Fatalf("URL %d landed in %s and then %s, want the same bucket", i, group, again)
+		}
+		counts[group]++
+	}
+	if len(counts) != buckets {
+		t.Fatalf("got %d groups, want %d", len(counts), buckets)
+	}
+	for group, n := range counts {
+		if !strings.HasPrefix(group, "bucket-") {
+			t.Errorf("got group %q, want a bucket", group)
+		}
+		// An even spread puts 100 URLs in each bucket.
+		if n < 50 || n > 150 {
+			t.Errorf("bucket %s got %d of %d URLs, want close to %d", group, n, urls, urls/buckets)
+		}
+	}
+}
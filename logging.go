@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// LogLevel controls how much the producer logs. LogDebug adds a JSON line
+// for every message sent and a line per batch, which is too much volume for
+// production; at LogInfo a poll's progress is logged once, in its summary.
+type LogLevel string
+
+const (
+	LogInfo  LogLevel = "info"
+	LogDebug LogLevel = "debug"
+)
+
+func parseLogLevel(value string) (LogLevel, error) {
+	switch l := LogLevel(value); l {
+	case LogInfo, LogDebug:
+		return l, nil
+	}
+	return "", fmt.Errorf("invalid log level %q, expected %s or %s", value, LogInfo, LogDebug)
+}
+
+type sentMessageLog struct {
+	Event         string `json:"event"`
+	Producer      string `json:"producer,omitempty"`
+	URLID         uint   `json:"url_id"`
+	URL           string `json:"url"`
+	GroupID       string `json:"group_id,omitempty"`
+	DedupID       string `json:"dedup_id,omitempty"`
+	MessageID     string `json:"message_id"`
+	CorrelationID string `json:"correlation_id,omitempty"`
+}
+
+// logSent writes a debug line for each entry of batch that SQS accepted.
+func (p *producer) logSent(batch outboundBatch, successful []types.SendMessageBatchResultEntry) {
+	if p.logLevel != LogDebug || len(successful) == 0 {
+		return
+	}
+
+	index := make(map[string]int, len(batch.entries))
+	for i, entry := range batch.entries {
+		index[aws.ToString(entry.Id)] = i
+	}
+	for _, s := range successful {
+		i, ok := index[aws.ToString(s.Id)]
+		if !ok {
+			continue
+		}
+		line, err := json.Marshal(sentMessageLog{
+			Event:         "message_sent",
+			Producer:      p.name,
+			URLID:         batch.ids[i],
+			URL:           batch.urls[i],
+			GroupID:       aws.ToString(batch.entries[i].MessageGroupId),
+			DedupID:       aws.ToString(batch.entries[i].MessageDeduplicationId),
+			MessageID:     aws.ToString(s.MessageId),
+			CorrelationID: aws.ToString(batch.entries[i].MessageAttributes["correlation_id"].StringValue),
+		})
+		if err != nil {
+			continue
+		}
+		log.Printf("DEBUG %s", line)
+	}
+}
+
+type pollSummaryLog struct {
+	Event            string    `json:"event"`
+	Producer         string    `json:"producer,omitempty"`
+	FinishedAt       time.Time `json:"finished_at"`
+	Fetched          int       `json:"fetched"`
+	Sent             int       `json:"sent"`
+	Failed           int       `json:"failed"`
+	Skipped          int       `json:"skipped"`
+	BatchesSucceeded int       `json:"batches_succeeded"`
+	BatchesFailed    int       `json:"batches_failed"`
+	Held             int       `json:"held"`
+	DurationMS       int64     `json:"duration_ms"`
+	Error            string    `json:"error,omitempty"`
+}
+
+// recordPoll adds the totals of a poll to the message counters, keeps them
+// as the last poll reported by /summary and logs them as one JSON line, at
+// every log level.
+func (p *producer) recordPoll(result ProcessResult, duration time.Duration, err error) {
+	messagesSent.Add(uint64(result.Sent))
+	messagesFailed.Add(uint64(result.Failed))
+	urlsSkipped.Add(uint64(result.Skipped))
+
+	summary := p.pollSummary("poll_summary", result, duration, err)
+	p.lastPoll.Store(summary)
+	logJSON(summary)
+}
+
+// pollSummary builds the summary line of a poll, or of a whole run of polls
+// in RUN_MODE=once.
+func (p *producer) pollSummary(event string, result ProcessResult, duration time.Duration, err error) *pollSummaryLog {
+	summary := &pollSummaryLog{
+		Event:            event,
+		Producer:         p.name,
+		FinishedAt:       time.Now().UTC(),
+		Fetched:          result.Fetched,
+		Sent:             result.Sent,
+		Failed:           result.Failed,
+		Skipped:          result.Skipped,
+		BatchesSucceeded: result.BatchesSucceeded,
+		BatchesFailed:    result.BatchesFailed,
+		Held:             result.Held,
+		DurationMS:       duration.Milliseconds(),
+	}
+	if err != nil {
+		summary.Error = err.Error()
+	}
+	return summary
+}
+
+// setLogPrefix adds producer=<name> to every log line from now on, after the
+// timestamp, where log aggregators parsing key=value pairs look for it. main
+// sets it from PRODUCER_NAME before anything else logs, so the startup lines
+// carry the name too. A name with whitespace is left for loadSettings to
+// reject.
+func setLogPrefix(name string) {
+	if name == "" || strings.ContainsFunc(name, unicode.IsSpace) {
+		return
+	}
+	log.SetPrefix("producer=" + name + " ")
+	log.SetFlags(log.Flags() | log.Lmsgprefix)
+}
+
+// logJSON logs v as a single JSON line.
+func logJSON(v any) {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	log.Printf("%s", line)
+}
+
+// debugf logs a line only with LOG_LEVEL=debug.
+func (p *producer) debugf(format string, args ...any) {
+	if p.logLevel == LogDebug {
+		log.Printf("DEBUG "+format, args...)
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/ofjangra/sqsURLProducer/models"
+)
+
+func TestProducerIDAttribute(t *testing.T) {
+	t.Setenv("HOSTNAME", "producer-7f9c")
+	if id := producerInstanceID(); id != "producer-7f9c" {
+		t.Errorf("got producer id %q, want HOSTNAME", id)
+	}
+	t.Setenv("HOSTNAME", "")
+	id := producerInstanceID()
+	if !uuidPattern.MatchString(id) {
+		t.Fatalf("got producer id %q without HOSTNAME, want a UUID", id)
+	}
+
+	// The id is computed once, so every message of every poll carries it.
+	p := newTestProducer(dryRunDB(t, nil), &fakeSQS{})
+	p.producerID = id
+	for poll := 1; poll <= 2; poll++ {
+		p.pollCount = poll
+		batches, _ := p.buildBatches(testRows(15))
+		for _, batch := range batches {
+			for _, entry := range batch.entries {
+				if got := attribute(entry, "producer_id"); got != id {
+					t.Errorf("poll %d: got producer_id %q, want %q", poll, got, id)
+				}
+			}
+		}
+	}
+}
+
+// captureLog sends the standard logger's output to the returned buffer for
+// the rest of the test.
+func captureLog(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var out bytes.Buffer
+	flags, prefix := log.Flags(), log.Prefix()
+	log.SetOutput(&out)
+	t.Cleanup(func() {
+		log.SetOutput(os.Stderr)
+		log.SetFlags(flags)
+		log.SetPrefix(prefix)
+	})
+	return &out
+}
+
+// loggedJSON decodes the JSON lines of out whose event is event.
+func loggedJSON[T any](t *testing.T, out *bytes.Buffer, event string) []T {
+	t.Helper()
+	var lines []T
+	for _, line := range strings.Split(out.String(), "\n") {
+		_, object, ok := strings.Cut(line, "{")
+		if !ok || !strings.Contains(line, `"event":"`+event+`"`) {
+			continue
+		}
+		var v T
+		if err := json.Unmarshal([]byte("{"+object), &v); err != nil {
+			t.Fatalf("bad %s line %q: %v", event, line, err)
+		}
+		lines = append(lines, v)
+	}
+	return lines
+}
+
+func TestDebugLines(t *testing.T) {
+	for _, level := range []LogLevel{LogInfo, LogDebug} {
+		t.Run(string(level), func(t *testing.T) {
+			out := captureLog(t)
+			p := newTestProducer(dryRunDB(t, nil), &fakeSQS{})
+			p.logLevel = level
+			batches, _ := p.buildBatches(testRows(3))
+
+			var result ProcessResult
+			p.deliverBatch(context.Background(), batches[0], &result)
+
+			sent := loggedJSON[sentMessageLog](t, out, "message_sent")
+			batchLine := strings.Contains(out.String(), "DEBUG Successfully sent batch of 3 messages.")
+			if level == LogInfo {
+				if len(sent) != 0 || batchLine {
+					t.Errorf("got debug lines at info level: %q", out.String())
+				}
+				return
+			}
+			if !batchLine {
+				t.Errorf("missing the per-batch debug line: %q", out.String())
+			}
+			if len(sent) != 3 {
+				t.Fatalf("got %d message_sent lines, want one per message", len(sent))
+			}
+			for _, line := range sent {
+				want := sentMessageLog{
+					Event:     "message_sent",
+					URLID:     line.URLID,
+					URL:       fmt.Sprintf("url-%d", line.URLID),
+					GroupID:   aws.ToString(batches[0].entries[line.URLID-1].MessageGroupId),
+					MessageID: fmt.Sprintf("m-url-%d", line.URLID),
+				}
+				if line != want {
+					t.Errorf("got %+v, want %+v", line, want)
+				}
+			}
+		})
+	}
+}
+
+func TestProducerName(t *testing.T) {
+	out := captureLog(t)
+	log.SetFlags(log.LstdFlags)
+	setLogPrefix("eu-1")
+	log.Print("Starting SQS Producer")
+	if line := out.String(); !regexp.MustCompile(`^\d{4}/\d\d/\d\d \d\d:\d\d:\d\d producer=eu-1 Starting SQS Producer\n$`).MatchString(line) {
+		t.Errorf("got log line %q, want the name after the timestamp", line)
+	}
+
+	// The JSON lines carry it as a field as well.
+	out.Reset()
+	p := newTestProducer(dryRunDB(t, nil), &fakeSQS{})
+	p.name, p.logLevel = "eu-1", LogDebug
+	batches, _ := p.buildBatches(testRows(1))
+	var result ProcessResult
+	p.deliverBatch(context.Background(), batches[0], &result)
+	p.recordPoll(result, time.Second, nil)
+	for _, line := range loggedJSON[sentMessageLog](t, out, "message_sent") {
+		if line.Producer != "eu-1" {
+			t.Errorf("got producer %q in message_sent", line.Producer)
+		}
+	}
+	summaries := loggedJSON[pollSummaryLog](t, out, "poll_summary")
+	if len(summaries) != 1 || summaries[0].Producer != "eu-1" {
+		t.Errorf("got poll summaries %+v, want one with the producer name", summaries)
+	}
+}
+
+func TestProducerNameWithSpaces(t *testing.T) {
+	out := captureLog(t)
+	setLogPrefix("eu 1")
+	log.Print("x")
+	if strings.Contains(out.String(), "producer=") {
+		t.Errorf("got %q, want no prefix for a name loadSettings rejects", out.String())
+	}
+}
+
+func TestPollSummary(t *testing.T) {
+	db := testDB(t)
+	insertRows(t, db, "urls", slices.Repeat([]models.URLStatus{pending}, 12)...)
+	client := &fakeSQS{fail: func(call int, body string) (string, bool, bool) {
+		switch body {
+		case "url-3":
+			return "InternalError", false, true
+		case "url-7":
+			return "InvalidParameterValue", true, true
+		}
+		return "", false, false
+	}}
+	p := newTestProducer(db, client)
+	p.retryBudget = time.Nanosecond
+	// url-10 to url-12 are too long and skipped, url-1 to url-9 go out in
+	// batches of 5 and 4.
+	p.maxMessageBytes, p.batchSize = 5, 5
+
+	out := captureLog(t)
+	result, err := p.processURLs(context.Background())
+	p.recordPoll(result, 1500*time.Millisecond, err)
+
+	summaries := loggedJSON[pollSummaryLog](t, out, "poll_summary")
+	if len(summaries) != 1 {
+		t.Fatalf("got %d poll summaries, want 1: %q", len(summaries), out.String())
+	}
+	got := summaries[0]
+	got.FinishedAt = time.Time{}
+	want := pollSummaryLog{
+		Event:            "poll_summary",
+		Fetched:          12,
+		Sent:             7,
+		Failed:           2,
+		Skipped:          3,
+		BatchesSucceeded: 1,
+		BatchesFailed:    1,
+		DurationMS:       1500,
+	}
+	if got != want {
+		t.Errorf("got summary %+v, want %+v", got, want)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -10,150 +11,290 @@ import (
 	"syscall"
 	"time"
 
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/sqs"
-	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
 	"github.com/ofjangra/sqsURLProducer/app"
 	"github.com/ofjangra/sqsURLProducer/models"
-	"gorm.io/gorm"
+	"golang.org/x/sync/errgroup"
 )
 
 const (
-	BatchSize       = 10
-	RetryAttempts   = 3
-	RetryBackoff    = 2 * time.Second
-	DatabaseLimit   = 100
-	PollingInterval = 10 * time.Second
+	// MaxSQSBatchEntries is the most entries SQS accepts in one SendMessageBatch call.
+	MaxSQSBatchEntries = 10
+
+	BatchSize      = 10
+	RetryAttempts  = 3
+	RetryBackoff   = 2 * time.Second
+	DatabaseLimit  = 100
+	FetchChunkSize = 1000
+
+	// StatusUpdateChunkSize is the default for the most ids a single status
+	// UPDATE binds.
+	StatusUpdateChunkSize = 1000
+	PollingInterval       = 10 * time.Second
+
+	ReconnectAttempts = 5
+	ReconnectBackoff  = time.Second
+)
+
+// subcommands holds optional commands that are compiled in with build tags,
+// keyed by the first command-line argument.
+var subcommands = map[string]func(args []string){}
+
+// RunMode selects between running as a long-lived service (the default) and
+// RunOnce, which sends everything pending and exits, suiting cron jobs and
+// batch pipelines.
+type RunMode string
+
+const (
+	RunService RunMode = "service"
+	RunOnce    RunMode = "once"
 )
 
+func parseRunMode(value string) (RunMode, error) {
+	switch m := RunMode(value); m {
+	case RunService, RunOnce:
+		return m, nil
+	}
+	return "", fmt.Errorf("invalid run mode %q, expected %s or %s", value, RunService, RunOnce)
+}
+
 func main() {
-	app.InitApp()
+	if len(os.Args) > 1 {
+		cmd, ok := subcommands[os.Args[1]]
+		if !ok {
+			log.Fatalf("Unknown command %q", os.Args[1])
+		}
+		cmd(os.Args[2:])
+		return
+	}
 
-	queueURL := getEnv("SQS_URL")
-	accessKeyID := getEnv("IAM_ACCESS_KEY")
-	secretAccessKey := getEnv("IAM_SECRET")
-	region := getEnv("AWS_REGION")
-	port := getEnv("PORT")
+	setLogPrefix(os.Getenv("PRODUCER_NAME"))
+	app.InitApp()
 
-	cfg, err := config.LoadDefaultConfig(context.TODO(),
-		config.WithRegion(region),
-		config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(accessKeyID, secretAccessKey, "")),
-	)
+	// The AWS configuration comes first because the queue URL, which several
+	// settings are checked against, may have to be read from SSM.
+	cfg, err := loadAWSConfig(context.TODO())
 	if err != nil {
 		log.Fatalf("Failed to load AWS configuration: %v", err)
 	}
+	queueURL, err := resolveQueueURL(context.TODO(), ssm.NewFromConfig(cfg), cfg.Region)
+	if err != nil {
+		log.Fatalf("Failed to resolve the queue URL: %v", err)
+	}
 
-	sqsClient := sqs.NewFromConfig(cfg)
-	db := app.GetDB()
-
-	// Graceful shutdown handling
-	ctx, cancel := context.WithCancel(context.Background())
-	go handleShutdown(cancel)
+	s := loadSettings(queueURL)
 
-	log.Println("Starting SQS Producer...")
+	p := &producer{
+		db:                app.GetDB(),
+		sqsClient:         sqs.NewFromConfig(cfg),
+		queueURL:          s.QueueURL,
+		errorQueueURL:     s.ErrorQueueURL,
+		queueLimit:        newTokenBucket(s.QueueRate),
+		errorQueueLimit:   newTokenBucket(s.ErrorQueueRate),
+		batchSize:         s.BatchSize,
+		fetchLimit:        s.FetchLimit,
+		fetchChunkSize:    s.FetchChunkSize,
+		maxFetchBytes:     s.MaxFetchBytes,
+		fetchFilter:       s.FetchFilter,
+		updateChunkSize:   s.UpdateChunkSize,
+		maxPerInterval:    s.MaxMessagesPerInterval,
+		semantics:         s.Semantics,
+		marker:            s.Marker,
+		batchStatusUpdate: s.BatchStatusUpdate,
+		transactionScope:  s.TransactionScope,
+		dedupScope:        s.DedupScope,
+		groupStrategy:     s.GroupStrategy,
+		groupBuckets:      s.GroupBuckets,
+		groupSkewWarn:     s.GroupSkewWarn,
+		entryRetryDelay:   s.EntryRetryDelay,
+		retryBudget:       s.RetryBudget,
+		claimTimeout:      s.ClaimTimeout,
+		lockTimeout:       s.LockTimeout,
+		pollDeadline:      s.PollDeadline,
+		failureHook:       newFailureWebhook(s.FailureWebhookURL, s.FailureWebhookDebounce, s.SendOnly),
+		sequenceAttribute: s.SequenceAttribute,
+		batchPositions:    s.BatchPositions,
+		producerID:        s.ProducerID,
+		sourceHost:        s.SourceHost,
+		sourceNode:        s.SourceNode,
+		messageTags:       s.MessageTags,
+		readReplica:       app.HasReplica(),
+		bodyPrefix:        s.BodyPrefix,
+		bodySuffix:        s.BodySuffix,
+		maxMessageBytes:   s.MaxMessageBytes,
+		oversizePolicy:    s.OversizePolicy,
+		exitOnPanic:       s.ExitOnPanic,
+		minBatchSize:      s.MinBatchSize,
+		minBatchMaxWait:   s.MinBatchMaxWait,
+		strictPoll:        s.StrictPoll,
+		startupJitter:     s.StartupJitter,
+		sendOnly:          s.SendOnly,
+		entryIDPrefix:     s.EntryIDPrefix,
+		sources:           s.SourceTables,
+		storeMessageID:    s.StoreMessageID,
+		correlationIDs:    s.CorrelationID,
+		storeCorrelation:  s.StoreCorrelationID,
+		logLevel:          s.LogLevel,
+		name:              s.ProducerName,
+	}
 
-	messageCount := 0
+	p.notifier = newQueueNotifier(p.sqsClient, s.NotifyQueueURL, s.NotifyMode, newTokenBucket(s.NotifyQueueRate))
+	if !s.SendOnly {
+		p.failures = newFailureTracker(s.PoisonPolls, s.PoisonWindow)
+	}
 
-	go func() {
-		for {
-			select {
-			case <-ctx.Done():
-				log.Println("Shutting down producer...")
-				return
-			default:
-				processURLs(ctx, db, sqsClient, queueURL, &messageCount)
-			}
+	if !isFIFOQueue(s.QueueURL) {
+		// FIFO queues reject per-message delays, so their scheduled rows
+		// are only fetched once due.
+		p.maxDelay = MaxSQSDelay
+	}
 
-			time.Sleep(PollingInterval)
+	for _, table := range sourceTableNames(s.SourceTables) {
+		if !p.db.Migrator().HasTable(table) {
+			log.Fatalf("SOURCE_TABLES lists %s, which does not exist; create it with the columns of the urls table", table)
 		}
-	}()
-
-	// Start a simple HTTP server to keep the application running and provide a status endpoint
-	http.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("SQS Producer is running"))
-	})
+	}
+	if s.Marker.legacy() && !p.db.Migrator().HasColumn(&models.URLs{}, s.Marker.column) {
+		log.Fatalf("PROCESSED_MARKER=%s is set but the %s column does not exist", s.Marker.kind, s.Marker.column)
+	}
+	if s.StoreMessageID && !app.AutoMigrate() && !p.db.Migrator().HasColumn(&models.URLs{}, "message_id") {
+		log.Fatal("STORE_MESSAGE_ID is set but AUTO_MIGRATE is off and the message_id column does not exist")
+	}
+	if s.StoreCorrelationID && !app.AutoMigrate() && !p.db.Migrator().HasColumn(&models.URLs{}, "correlation_id") {
+		log.Fatal("STORE_CORRELATION_ID is set but AUTO_MIGRATE is off and the correlation_id column does not exist")
+	}
 
-	log.Println("Starting HTTP server on port", port)
-	if err := http.ListenAndServe(":"+port, nil); err != nil {
-		log.Fatalf("Failed to start HTTP server: %v", err)
+	if s.AdaptiveFetch {
+		p.adaptiveFetch = newAdaptiveFetchSize(s.AdaptiveFetchMin, s.FetchLimit, s.AdaptiveFetchStep, s.AdaptiveFetchThreshold)
 	}
-}
 
-func processURLs(ctx context.Context, db *gorm.DB, sqsClient *sqs.Client, queueURL string, messageCount *int) {
-	var urls []models.URLs
-	result := db.Limit(DatabaseLimit).Where("processed = ?", false).Find(&urls)
-	if result.Error != nil {
-		log.Printf("Database query failed: %v", result.Error)
-		return
+	if p.auditor, err = newAuditor(s.AuditSink, s.AuditFile); err != nil {
+		log.Fatalf("Failed to open %s audit sink: %v", s.AuditSink, err)
 	}
 
-	if len(urls) == 0 {
-		log.Println("No URLs found, sleeping...")
-		return
+	if err := waitForQueue(context.TODO(), p.sqsClient, s.QueueURL, s.WaitForDeps); err != nil {
+		log.Fatalf("Giving up waiting for SQS: %v", err)
+	}
+	if s.PurgeOnStart {
+		if err := purgeQueue(context.TODO(), p.sqsClient, s.QueueURL); err != nil {
+			log.Fatalf("Failed to purge the queue: %v", err)
+		}
+	}
+	retention := checkRetention(context.TODO(), p.sqsClient, s.QueueURL, s.RetentionWarnThreshold)
+	p.retention = retention
+	p.processingTime = s.ScheduleProcessingTime
+	if p.maxDelay > 0 && retention > 0 && p.maxDelay+p.processingTime > retention {
+		log.Printf("WARNING: delays of up to %s plus SCHEDULE_PROCESSING_TIME %s exceed the queue's retention of %s, scheduled rows delayed past it are marked failed", p.maxDelay, p.processingTime, retention)
 	}
 
-	log.Printf("Processing %d URLs...", len(urls))
+	// The producer, the stats loop and the HTTP server share one lifecycle:
+	// a signal or the first of them to fail stops all of them.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	// Prepare batches
-	var batch []types.SendMessageBatchRequestEntry
-	for i, url := range urls {
-		*messageCount++
-		batch = append(batch, types.SendMessageBatchRequestEntry{
-			Id:             aws.String(fmt.Sprintf("msg-%d", *messageCount)),
-			MessageBody:    aws.String(url.URL),
-			MessageGroupId: aws.String(fmt.Sprintf("group-%d", *messageCount)),
-		})
+	if s.SendMode == SendPerQueue {
+		p.startQueueSenders()
+	}
 
-		// Send when batch size is reached or it's the last message
-		if len(batch) == BatchSize || i == len(urls)-1 {
-			if err := sendBatch(ctx, sqsClient, queueURL, batch); err != nil {
-				log.Printf("Failed to send batch: %v", err)
-			} else {
-				// Update processed status for URLs in the batch
-				for _, entry := range batch {
-					db.Model(&models.URLs{}).Where("url = ?", *entry.MessageBody).Update("processed", true)
-				}
-			}
-			batch = nil // Reset batch
+	if s.RunMode == RunOnce {
+		log.Printf("Draining pending URLs with %s delivery...", s.Semantics)
+		start := time.Now()
+		total, err := p.drain(ctx)
+		p.stopQueueSenders()
+		logJSON(p.pollSummary("run_summary", total, time.Since(start), err))
+		if closeErr := app.CloseDB(); closeErr != nil {
+			log.Printf("Failed to close the database connection: %v", closeErr)
 		}
+		if err != nil {
+			log.Fatalf("Stopped after a fatal error: %v", err)
+		}
+		return
 	}
-}
+	g, ctx := errgroup.WithContext(ctx)
 
-func sendBatch(ctx context.Context, sqsClient *sqs.Client, queueURL string, batch []types.SendMessageBatchRequestEntry) error {
-	for attempt := 0; attempt < RetryAttempts; attempt++ {
-		_, err := sqsClient.SendMessageBatch(ctx, &sqs.SendMessageBatchInput{
-			QueueUrl: aws.String(queueURL),
-			Entries:  batch,
-		})
-		if err == nil {
-			log.Printf("Successfully sent batch of %d messages.", len(batch))
-			return nil
-		}
+	log.Printf("Starting SQS Producer with %s delivery...", s.Semantics)
 
-		log.Printf("Send batch attempt %d failed: %v", attempt+1, err)
-		time.Sleep(RetryBackoff * time.Duration(attempt+1))
+	g.Go(func() error {
+		defer p.stopQueueSenders()
+		return p.run(ctx, newPollScheduler(s.BusyPollInterval, s.IdlePollInterval, s.EmptyPollBackoffMax, s.EmptyPollThreshold, s.DBErrorBackoffMax))
+	})
+	g.Go(func() error {
+		p.runStats(ctx, s.StatsInterval)
+		return nil
+	})
+	if s.DBPingInterval > 0 {
+		g.Go(func() error {
+			p.runPing(ctx, s.DBPingInterval)
+			return nil
+		})
 	}
 
-	return fmt.Errorf("failed to send batch after %d attempts", RetryAttempts)
+	// Start a simple HTTP server to keep the application running and provide a status endpoint
+	srv := &server{settings: s, db: app.GetDB, region: cfg.Region, retention: retention, sqsClient: p.sqsClient, ready: &p.ready, lastPoll: &p.lastPoll}
+	serveHTTP(ctx, g, &http.Server{Handler: srv.routes()}, s.ListenAddr, s.ShutdownTimeout)
+
+	err = wait(ctx, g, s.ShutdownTimeout)
+	if errors.Is(err, errShutdownTimeout) {
+		log.Fatalf("%v, forcing exit", err)
+	}
+	if closeErr := app.CloseDB(); closeErr != nil {
+		log.Printf("Failed to close the database connection: %v", closeErr)
+	}
+	if err != nil {
+		log.Fatalf("Stopped after a fatal error: %v", err)
+	}
+	log.Println("Shutdown complete")
 }
 
-func handleShutdown(cancel context.CancelFunc) {
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-	<-c
-	cancel()
+// serveHTTP serves srv on addr in g. Once ctx ends, by a signal or another
+// goroutine of g failing, srv is shut down, giving requests in flight up to
+// timeout to finish. A server that cannot listen or fails fails g.
+func serveHTTP(ctx context.Context, g *errgroup.Group, srv *http.Server, addr string, timeout time.Duration) {
+	g.Go(func() error {
+		ln, err := listen(addr)
+		if err != nil {
+			return fmt.Errorf("HTTP server failed: %w", err)
+		}
+		log.Println("Starting HTTP server on", addr)
+		if err := srv.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+			return fmt.Errorf("HTTP server failed: %w", err)
+		}
+		return nil
+	})
+	g.Go(func() error {
+		<-ctx.Done()
+		log.Printf("Shutting down, waiting up to %s for in-flight work...", timeout)
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			log.Printf("HTTP server did not shut down cleanly: %v", err)
+		}
+		return nil
+	})
 }
 
-func getEnv(key string) string {
-	value := os.Getenv(key)
-	if value == "" {
-		log.Fatalf("Environment variable %s is not set", key)
+// errShutdownTimeout is returned by wait when the goroutines did not stop in
+// time.
+var errShutdownTimeout = errors.New("producer did not stop within the shutdown timeout")
+
+// wait returns the first error of g once all its goroutines have stopped.
+// After ctx ends, by a signal or a failing goroutine, they get up to timeout
+// to finish in-flight work, after which wait returns errShutdownTimeout and
+// the process exits regardless.
+func wait(ctx context.Context, g *errgroup.Group, timeout time.Duration) error {
+	done := make(chan error, 1)
+	go func() { done <- g.Wait() }()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+	}
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("%w of %s", errShutdownTimeout, timeout)
 	}
-	return value
 }
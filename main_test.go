@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+func TestWaitShutdownTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	g, ctx := errgroup.WithContext(ctx)
+	hung := make(chan struct{})
+	defer close(hung)
+	g.Go(func() error {
+		<-hung // in-flight work that ignores ctx
+		return nil
+	})
+
+	cancel()
+	start := time.Now()
+	err := wait(ctx, g, 50*time.Millisecond)
+	if !errors.Is(err, errShutdownTimeout) {
+		t.Fatalf("got %v, want errShutdownTimeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("wait returned after %s, want about the 50ms timeout", elapsed)
+	}
+}
+
+func TestWaitStopsInTime(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	g, ctx := errgroup.WithContext(ctx)
+	failure := errors.New("poll failed")
+	g.Go(func() error {
+		<-ctx.Done()
+		time.Sleep(10 * time.Millisecond) // finishing the last batch
+		return failure
+	})
+
+	cancel()
+	if err := wait(ctx, g, time.Second); !errors.Is(err, failure) {
+		t.Errorf("got %v, want the goroutine's error", err)
+	}
+}
+
+func TestFatalErrorStopsHTTP(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "producer.sock")
+	g, ctx := errgroup.WithContext(context.Background())
+	fatal := errors.New("poll panicked")
+	fail := make(chan struct{})
+	g.Go(func() error {
+		<-fail // the producer with EXIT_ON_PANIC
+		return fatal
+	})
+	serveHTTP(ctx, g, &http.Server{Handler: (&server{settings: &settings{}}).routes()}, "unix://"+path, time.Second)
+
+	client := unixClient(path)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp, err := client.Get("http://producer/version")
+		if err == nil {
+			resp.Body.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("HTTP server never came up: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	close(fail)
+	if err := wait(ctx, g, time.Second); !errors.Is(err, fatal) {
+		t.Fatalf("got %v, want the producer's error", err)
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("want the HTTP server shut down and its socket removed, got %v", err)
+	}
+	client.CloseIdleConnections()
+	if resp, err := client.Get("http://producer/version"); err == nil {
+		resp.Body.Close()
+		t.Error("HTTP server still answering after the producer failed")
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/ofjangra/sqsURLProducer/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// MarkerType selects how the urls table records that a row was processed.
+//
+// MarkerStatus (the default) is the status column with its pending, claimed,
+// sent and failed states.
+//
+// MarkerBool and MarkerTimestamp adapt the producer to existing tables that
+// only have a boolean column set once a row is processed, or a timestamp
+// column that stays NULL until then. Neither has a claimed state, so polls
+// hold their rows with the row locks of a poll transaction instead
+// (TRANSACTION_SCOPE=poll), and neither has a failed state, so rows that can
+// never be sent are marked processed like sent ones.
+type MarkerType string
+
+const (
+	MarkerStatus    MarkerType = "status"
+	MarkerBool      MarkerType = "bool"
+	MarkerTimestamp MarkerType = "timestamp"
+)
+
+func parseMarkerType(value string) (MarkerType, error) {
+	switch m := MarkerType(value); m {
+	case MarkerStatus, MarkerBool, MarkerTimestamp:
+		return m, nil
+	}
+	return "", fmt.Errorf("invalid processed marker %q, expected %s, %s or %s", value, MarkerStatus, MarkerBool, MarkerTimestamp)
+}
+
+// defaultMarkerColumns are the PROCESSED_COLUMN defaults.
+var defaultMarkerColumns = map[MarkerType]string{
+	MarkerStatus:    "status",
+	MarkerBool:      "processed",
+	MarkerTimestamp: "processed_at",
+}
+
+// markerColumnPattern is a plain, unquoted Postgres identifier.
+var markerColumnPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]{0,62}$`)
+
+// processedMarker is the column PROCESSED_MARKER and PROCESSED_COLUMN
+// configure, and generates the SQL that reads and writes it.
+type processedMarker struct {
+	kind   MarkerType
+	column string
+}
+
+func parseProcessedMarker(kind, column string) (processedMarker, error) {
+	m := processedMarker{}
+	var err error
+	if m.kind, err = parseMarkerType(kind); err != nil {
+		return m, err
+	}
+	m.column = column
+	if m.column == "" {
+		m.column = defaultMarkerColumns[m.kind]
+	}
+	if m.kind == MarkerStatus && m.column != "status" {
+		return m, fmt.Errorf("invalid processed column %q, the %s marker always uses the status column", column, MarkerStatus)
+	}
+	if !markerColumnPattern.MatchString(m.column) {
+		return m, fmt.Errorf("invalid processed column %q, expected a column name of letters, digits and '_'", column)
+	}
+	return m, nil
+}
+
+// legacy reports whether the marker is a column other than status, which
+// has no claimed or failed states.
+func (m processedMarker) legacy() bool {
+	return m.kind == MarkerBool || m.kind == MarkerTimestamp
+}
+
+// pending is the condition that holds for rows still waiting to be sent. A
+// NULL boolean counts as not processed.
+func (m processedMarker) pending() clause.Expr {
+	switch m.kind {
+	case MarkerBool:
+		return gorm.Expr("? IS NOT TRUE", clause.Column{Name: m.column})
+	case MarkerTimestamp:
+		return gorm.Expr("? IS NULL", clause.Column{Name: m.column})
+	}
+	return gorm.Expr("status = ?", models.StatusPending)
+}
+
+// unprocessed restricts db to the rows still waiting to be sent.
+func (m processedMarker) unprocessed(db *gorm.DB) *gorm.DB {
+	return db.Where(m.pending())
+}
+
+// updates returns the column values that move a row to status. Without a
+// status column sent and failed both mean processed, and there is nothing
+// to write for pending or claimed, so the result is empty.
+func (m processedMarker) updates(status models.URLStatus) map[string]any {
+	switch {
+	case !m.legacy():
+		return map[string]any{"status": status}
+	case status != models.StatusSent && status != models.StatusFailed:
+		return map[string]any{}
+	case m.kind == MarkerBool:
+		return map[string]any{m.column: true}
+	default:
+		return map[string]any{m.column: time.Now()}
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import "github.com/ofjangra/sqsURLProducer/metrics"
+
+var (
+	dbFetchDuration = metrics.NewHistogram("db_fetch_duration_seconds",
+		"Time taken to claim a chunk of pending URLs.", metrics.DefaultBuckets)
+	urlsPending = metrics.NewGauge("urls_pending",
+		"Rows waiting to be sent, as of the last stats refresh.")
+	dbUpdateFailures = metrics.NewCounter("db_update_failures_total",
+		"Status updates that failed to be written to the database.")
+	dbPingFailures = metrics.NewCounter("db_ping_failures_total",
+		"Keepalive pings of the database that failed.")
+	sqsInflightBatches = metrics.NewGauge("sqs_inflight_batches",
+		"SendMessageBatch requests currently in flight.")
+	sqsActiveWorkers = metrics.NewGauge("sqs_active_workers",
+		"Senders currently delivering claimed rows to SQS.")
+	producerPanics = metrics.NewCounter("producer_panics_total",
+		"Polls that panicked and were recovered.")
+	sqsGroupSkew = metrics.NewGauge("sqs_group_skew",
+		"Share of the last chunk of messages sent that belong to its largest message group.")
+	duplicateSendsSuspected = metrics.NewCounter("duplicate_sends_suspected_total",
+		"Messages sent for a URL the audit table already records as sent to the same queue, only counted with AUDIT_SINK=table.")
+	sqsSendErrors = metrics.NewCounterVec("sqs_send_errors_total",
+		"Failed SendMessageBatch attempts and entries, by AWS error code.", "code")
+	messagesSent = metrics.NewCounter("sqs_messages_sent_total",
+		"Messages SQS accepted.")
+	messagesFailed = metrics.NewCounter("sqs_messages_failed_total",
+		"Messages that could not be sent, whether retried later or marked failed.")
+	urlsSkipped = metrics.NewCounter("urls_skipped_total",
+		"Rows marked failed without being sent because they cannot form a valid message.")
+	poisonQuarantined = metrics.NewCounter("poison_urls_quarantined_total",
+		"Rows marked failed after failing to send in POISON_POLLS polls within POISON_WINDOW.")
+)
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/aws/smithy-go"
+	"github.com/ofjangra/sqsURLProducer/metrics"
+)
+
+// metricValue returns the value of series, a metric name with its labels if
+// any, in the text output of metrics.Default, and whether it is there.
+func metricValue(t *testing.T, series string) (float64, bool) {
+	t.Helper()
+	var out strings.Builder
+	metrics.Default.WriteText(&out)
+	for scanner := bufio.NewScanner(strings.NewReader(out.String())); scanner.Scan(); {
+		value, ok := strings.CutPrefix(scanner.Text(), series+" ")
+		if !ok {
+			continue
+		}
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			t.Fatalf("bad value of %s: %q", series, value)
+		}
+		return v, true
+	}
+	return 0, false
+}
+
+// metricDeltas snapshots series so the change since can be checked. Tests
+// share metrics.Default, so only changes are meaningful.
+func metricDeltas(t *testing.T, series ...string) func(series string) float64 {
+	t.Helper()
+	before := map[string]float64{}
+	for _, s := range series {
+		before[s], _ = metricValue(t, s)
+	}
+	return func(s string) float64 {
+		t.Helper()
+		v, ok := metricValue(t, s)
+		if !ok {
+			t.Errorf("%s is missing from the metrics output", s)
+		}
+		return v - before[s]
+	}
+}
+
+func TestPollMetrics(t *testing.T) {
+	db := testDB(t)
+	insertRows(t, db, "urls", pending, pending, pending)
+	client := &fakeSQS{fail: func(call int, body string) (string, bool, bool) {
+		return "ThrottlingException", false, body == "url-2"
+	}}
+	p := newTestProducer(db, client)
+	p.retryBudget = time.Nanosecond
+	p.groupStrategy = GroupSingle
+
+	const throttled = `sqs_send_errors_total{code="ThrottlingException"}`
+	delta := metricDeltas(t, "db_fetch_duration_seconds_count", "sqs_messages_sent_total", "sqs_messages_failed_total", throttled)
+	start := time.Now()
+	result, err := p.processURLs(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// As run does after every poll.
+	p.recordPoll(result, time.Since(start), err)
+
+	if got := delta("db_fetch_duration_seconds_count"); got < 1 {
+		t.Errorf("db_fetch_duration_seconds observed %v claims, want at least 1", got)
+	}
+	if got := delta("sqs_messages_sent_total"); got != 2 {
+		t.Errorf("sqs_messages_sent_total rose by %v, want 2", got)
+	}
+	if got := delta("sqs_messages_failed_total"); got != 1 {
+		t.Errorf("sqs_messages_failed_total rose by %v, want 1", got)
+	}
+	if got := delta(throttled); got != 1 {
+		t.Errorf("%s rose by %v, want 1", throttled, got)
+	}
+	if skew, _ := metricValue(t, "sqs_group_skew"); skew != 1 {
+		t.Errorf("got sqs_group_skew %v with a single group, want 1", skew)
+	}
+	for _, gauge := range []string{"sqs_inflight_batches", "sqs_active_workers"} {
+		if v, ok := metricValue(t, gauge); !ok || v != 0 {
+			t.Errorf("got %s %v after the poll, want 0", gauge, v)
+		}
+	}
+}
+
+func TestInflightGauges(t *testing.T) {
+	var during []float64
+	client := &fakeSQS{}
+	client.requestErr = func(call int) error {
+		// Called while SendMessageBatch is in flight.
+		inflight, _ := metricValue(t, "sqs_inflight_batches")
+		workers, _ := metricValue(t, "sqs_active_workers")
+		during = append(during, inflight, workers)
+		return nil
+	}
+	p := newTestProducer(dryRunDB(t, nil), client)
+
+	var result ProcessResult
+	p.sendURLs(context.Background(), testRows(15), &result)
+
+	// Two batches, each sent by the one worker with one request in flight.
+	if want := []float64{1, 1, 1, 1}; !slices.Equal(during, want) {
+		t.Errorf("got inflight batches and workers %v during the sends, want %v", during, want)
+	}
+	for _, gauge := range []string{"sqs_inflight_batches", "sqs_active_workers"} {
+		if v, _ := metricValue(t, gauge); v != 0 {
+			t.Errorf("got %s %v after the sends, want 0", gauge, v)
+		}
+	}
+}
+
+func TestGroupSkewMetric(t *testing.T) {
+	tests := []struct {
+		name     string
+		strategy GroupStrategy
+		skew     float64
+	}{
+		{"skewed", GroupSingle, 1},
+		{"balanced", GroupPerMessage, 0.05},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := captureLog(t)
+			p := newTestProducer(dryRunDB(t, nil), &fakeSQS{})
+			p.groupStrategy, p.groupSkewWarn = tt.strategy, 0.5
+
+			var result ProcessResult
+			p.sendURLs(context.Background(), testRows(20), &result)
+			if skew, ok := metricValue(t, "sqs_group_skew"); !ok || skew != tt.skew {
+				t.Errorf("got sqs_group_skew %v, want %v", skew, tt.skew)
+			}
+			if warned := strings.Contains(out.String(), "share one message group"); warned != (tt.skew >= 0.5) {
+				t.Errorf("got a skew warning: %v, want %v", warned, tt.skew >= 0.5)
+			}
+		})
+	}
+}
+
+func TestSendErrorCodes(t *testing.T) {
+	const (
+		throttled = `sqs_send_errors_total{code="ThrottlingException"}`
+		invalid   = `sqs_send_errors_total{code="InvalidParameterValue"}`
+		denied    = `sqs_send_errors_total{code="AccessDenied"}`
+		network   = `sqs_send_errors_total{code="network"}`
+	)
+	// Entries fail with a code each on the first request, the second
+	// request fails as a whole and the third cannot reach SQS.
+	client := &fakeSQS{
+		fail: func(call int, body string) (string, bool, bool) {
+			switch body {
+			case "url-1":
+				return "ThrottlingException", false, true
+			case "url-2":
+				return "InvalidParameterValue", true, true
+			}
+			return "", false, false
+		},
+		requestErr: func(call int) error {
+			switch call {
+			case 2:
+				return &smithy.GenericAPIError{Code: "AccessDenied", Message: "fake"}
+			case 3:
+				return &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+			}
+			return nil
+		},
+	}
+	p := newTestProducer(dryRunDB(t, nil), client)
+	p.retryBudget = time.Nanosecond
+	delta := metricDeltas(t, throttled, invalid, denied, network)
+
+	for range 3 {
+		var result ProcessResult
+		p.sendURLs(context.Background(), testRows(3), &result)
+	}
+
+	for series, want := range map[string]float64{throttled: 1, invalid: 1, denied: 1, network: 1} {
+		if got := delta(series); got != want {
+			t.Errorf("%s rose by %v, want %v", series, got, want)
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm/schema"
+)
+
+// DispatchAudit records one message SQS accepted, written by the optional
+// table audit sink.
+type DispatchAudit struct {
+	ID       uint   `json:"-" gorm:"column:id; primary_key; autoIncrement"`
+	URLID    uint   `json:"url_id" gorm:"column:url_id; not null; index"`
+	QueueURL string `json:"queue_url" gorm:"column:queue_url; not null"`
+	// SourceTable is the SOURCE_TABLES table the URL was read from, empty
+	// for the urls table without SOURCE_TABLES.
+	SourceTable string    `json:"source_table,omitempty" gorm:"column:source_table; not null; default:''"`
+	SentAt      time.Time `json:"sent_at" gorm:"column:sent_at; not null"`
+	MessageID   string    `json:"message_id" gorm:"column:message_id; not null"`
+}
+
+// TableName keeps the table's historical singular name with the naming
+// strategy's prefix: JoinTableName leaves an all lower-case name unchanged
+// apart from adding DB_TABLE_PREFIX.
+func (DispatchAudit) TableName(namer schema.Namer) string {
+	return namer.JoinTableName("dispatch_audit")
+}
@@ -1,6 +1,52 @@
 package models
 
+import (
+	"time"
+
+	"gorm.io/gorm/schema"
+)
+
+// URLStatus tracks a row through the producer pipeline:
+// pending -> claimed -> sent, or failed if it can never be sent.
+type URLStatus string
+
+const (
+	StatusPending URLStatus = "pending"
+	StatusClaimed URLStatus = "claimed"
+	StatusSent    URLStatus = "sent"
+	StatusFailed  URLStatus = "failed"
+)
+
+// Statuses lists every URLStatus in pipeline order.
+var Statuses = []URLStatus{StatusPending, StatusClaimed, StatusSent, StatusFailed}
+
 type URLs struct {
-	ID  uint   `json:"id" gorm:"column:id; primary_key; autoIncrement"`
-	URL string `json:"url" gorm:"column:url; not null"`
+	ID        uint       `json:"id" gorm:"column:id; primary_key; autoIncrement"`
+	URL       string     `json:"url" gorm:"column:url; not null"`
+	Status    URLStatus  `json:"status" gorm:"column:status; type:varchar(16); not null; default:pending; index"`
+	ClaimedAt *time.Time `json:"claimed_at" gorm:"column:claimed_at"`
+	// GroupKey, when set, is used as the MessageGroupId so that URLs sharing
+	// a key are delivered in order on FIFO queues.
+	GroupKey *string `json:"group_key" gorm:"column:group_key"`
+	// NextAttemptAt, when set, keeps a pending row out of the fetch until
+	// then. The producer sets it when SQS failed the row's message for a
+	// reason of its own; a failed row reset to pending may set it to delay
+	// the retry.
+	NextAttemptAt *time.Time `json:"next_attempt_at" gorm:"column:next_attempt_at"`
+	// ScheduledAt, when set, is the earliest time the URL should reach
+	// consumers. Rows due within 15 minutes are sent with a matching
+	// DelaySeconds, later ones wait for a later poll.
+	ScheduledAt *time.Time `json:"scheduled_at" gorm:"column:scheduled_at"`
+	// MessageID is the id SQS assigned to the row's message, stored with
+	// STORE_MESSAGE_ID when the row is marked sent.
+	MessageID *string `json:"message_id" gorm:"column:message_id; type:varchar(100)"`
+	// CorrelationID is the correlation_id attribute of the row's message,
+	// stored with STORE_CORRELATION_ID when the row is marked sent.
+	CorrelationID *string `json:"correlation_id" gorm:"column:correlation_id; type:varchar(36)"`
+}
+
+// TableName names the table after a single URL, so the default naming
+// strategy keeps calling it urls while DB_SINGULAR_TABLES maps it to url.
+func (URLs) TableName(namer schema.Namer) string {
+	return namer.TableName("URL")
 }
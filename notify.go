@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// NotifyMode selects how the events published to NOTIFY_QUEUE_URL are cut.
+//
+//   - NotifyPerURL (the default) publishes one event per sent URL.
+//   - NotifyPerBatch publishes one event per batch listing the ids of its
+//     sent URLs, for orchestration that only needs to know that work arrived.
+type NotifyMode string
+
+const (
+	NotifyPerURL   NotifyMode = "url"
+	NotifyPerBatch NotifyMode = "batch"
+)
+
+func parseNotifyMode(value string) (NotifyMode, error) {
+	switch m := NotifyMode(value); m {
+	case NotifyPerURL, NotifyPerBatch:
+		return m, nil
+	}
+	return "", fmt.Errorf("invalid notify mode %q, expected %s or %s", value, NotifyPerURL, NotifyPerBatch)
+}
+
+// sentURL is a URL SQS accepted, as reported to a sentNotifier. Table is
+// its SOURCE_TABLES table, "" for the urls table without SOURCE_TABLES.
+type sentURL struct {
+	ID        uint
+	Table     string
+	URL       string
+	MessageID string
+}
+
+// sentNotifier is told about the URLs of every batch SQS accepted, to
+// trigger downstream work once they are on the queue. A notifier must not
+// fail the send, it logs its own errors.
+type sentNotifier interface {
+	onSent(ctx context.Context, urls []sentURL)
+}
+
+// queueNotifier publishes sent events to a second SQS queue, at most at
+// the rate of its own RATE_ bucket.
+type queueNotifier struct {
+	client   sqsAPI
+	queueURL string
+	mode     NotifyMode
+	limit    *tokenBucket
+
+	// queue feeds the notifier's own sender goroutine with SendPerQueue, it
+	// is nil when events are published from the producer's goroutine.
+	queue chan []sentURL
+	done  chan struct{}
+}
+
+// NotifyQueueBuffer is how many batches of sent events wait for the notify
+// queue's own sender before further ones are dropped, see SendPerQueue.
+const NotifyQueueBuffer = 100
+
+func newQueueNotifier(client sqsAPI, queueURL string, mode NotifyMode, limit *tokenBucket) sentNotifier {
+	if queueURL == "" {
+		return nil
+	}
+	return &queueNotifier{client: client, queueURL: queueURL, mode: mode, limit: limit}
+}
+
+// start starts the goroutine that publishes events with SendPerQueue.
+func (n *queueNotifier) start() {
+	n.queue = make(chan []sentURL, NotifyQueueBuffer)
+	n.done = make(chan struct{})
+	go func() {
+		defer close(n.done)
+		for urls := range n.queue {
+			n.publish(context.Background(), urls)
+		}
+	}()
+}
+
+// stop waits for the sender goroutine to publish what is queued. Like
+// stopErrorQueueSender, it must be called from the goroutine that sends,
+// once it is done polling.
+func (n *queueNotifier) stop() {
+	if n.queue == nil {
+		return
+	}
+	close(n.queue)
+	<-n.done
+}
+
+type urlSentEvent struct {
+	Event     string    `json:"event"`
+	URLID     uint      `json:"url_id"`
+	Table     string    `json:"table,omitempty"`
+	URL       string    `json:"url"`
+	MessageID string    `json:"message_id"`
+	SentAt    time.Time `json:"sent_at"`
+}
+
+type batchSentEvent struct {
+	Event  string    `json:"event"`
+	URLIDs []uint    `json:"url_ids"`
+	Table  string    `json:"table,omitempty"`
+	SentAt time.Time `json:"sent_at"`
+}
+
+func (n *queueNotifier) onSent(ctx context.Context, urls []sentURL) {
+	if len(urls) == 0 {
+		return
+	}
+	if n.queue != nil {
+		select {
+		case n.queue <- urls:
+		default:
+			log.Printf("Notify queue sender is %d batches behind, not publishing %d sent notifications", NotifyQueueBuffer, len(urls))
+		}
+		return
+	}
+	n.publish(ctx, urls)
+}
+
+// publish sends the events for urls to the notify queue in batches.
+func (n *queueNotifier) publish(ctx context.Context, urls []sentURL) {
+	now := time.Now()
+	fifo := isFIFOQueue(n.queueURL)
+	var entries []types.SendMessageBatchRequestEntry
+	if n.mode == NotifyPerBatch {
+		ids := make([]uint, len(urls))
+		for i, u := range urls {
+			ids[i] = u.ID
+		}
+		e := notifyEntry(batchSentEvent{Event: "batch_sent", URLIDs: ids, Table: urls[0].Table, SentAt: now}, 0)
+		if fifo {
+			// The first message id is unique to the batch.
+			e.MessageGroupId = aws.String("batches")
+			e.MessageDeduplicationId = aws.String("batch-" + urls[0].MessageID)
+		}
+		entries = append(entries, e)
+	} else {
+		for i, u := range urls {
+			e := notifyEntry(urlSentEvent{Event: "url_sent", URLID: u.ID, Table: u.Table, URL: u.URL, MessageID: u.MessageID, SentAt: now}, i)
+			if fifo {
+				e.MessageGroupId = aws.String(fmt.Sprintf("url-%d", u.ID))
+				e.MessageDeduplicationId = aws.String("url-" + u.MessageID)
+			}
+			entries = append(entries, e)
+		}
+	}
+
+	// Like the send itself, a notification for messages SQS accepted is
+	// not abandoned when the poll is cut short.
+	for start := 0; start < len(entries); start += MaxSQSBatchEntries {
+		chunk := entries[start:min(start+MaxSQSBatchEntries, len(entries))]
+		n.limit.wait(context.WithoutCancel(ctx), len(chunk))
+		out, err := n.client.SendMessageBatch(context.WithoutCancel(ctx), &sqs.SendMessageBatchInput{
+			QueueUrl: aws.String(n.queueURL),
+			Entries:  chunk,
+		})
+		if err != nil {
+			log.Printf("Failed to publish %d sent notifications: %v", len(chunk), err)
+			continue
+		}
+		for _, f := range out.Failed {
+			log.Printf("Failed to publish a sent notification: %s: %s", aws.ToString(f.Code), aws.ToString(f.Message))
+		}
+	}
+}
+
+func notifyEntry(event any, i int) types.SendMessageBatchRequestEntry {
+	body, _ := json.Marshal(event)
+	return types.SendMessageBatchRequestEntry{
+		Id:          aws.String(fmt.Sprintf("sent-%d", i)),
+		MessageBody: aws.String(string(body)),
+	}
+}
+
+// notifySent tells the notifier about the entries of batch in successful.
+func (p *producer) notifySent(ctx context.Context, batch outboundBatch, successful []types.SendMessageBatchResultEntry) {
+	if p.notifier == nil || len(successful) == 0 {
+		return
+	}
+	index := make(map[string]int, len(batch.entries))
+	for i, entry := range batch.entries {
+		index[aws.ToString(entry.Id)] = i
+	}
+	table := p.db.Statement.Table
+	urls := make([]sentURL, 0, len(successful))
+	for _, s := range successful {
+		if i, ok := index[aws.ToString(s.Id)]; ok {
+			urls = append(urls, sentURL{ID: batch.ids[i], Table: table, URL: batch.urls[i], MessageID: aws.ToString(s.MessageId)})
+		}
+	}
+	p.notifier.onSent(ctx, urls)
+}
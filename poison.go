@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/ofjangra/sqsURLProducer/models"
+)
+
+// failureTracker catches rows that fail intermittently. Every failed send
+// returns a row to pending, so a row SQS fails now and then is retried
+// forever; the tracker remembers in which polls each row failed and reports
+// a row once it has failed in threshold distinct polls within window.
+//
+// Only failures of entries SQS failed while accepting others from the same
+// request count. A request that failed as a whole, or was never sent, says
+// nothing about its rows, and counting it would quarantine every row during
+// an SQS outage. The history lives in memory, so it is per process and
+// starts over on restart.
+//
+// Rows are tracked by table and id, since the tables of SOURCE_TABLES
+// number their rows separately but share the poll count.
+type failureTracker struct {
+	threshold int
+	window    time.Duration
+	failures  map[trackedRow][]pollFailure
+}
+
+// trackedRow is a row of table, "" for the urls table without
+// SOURCE_TABLES.
+type trackedRow struct {
+	table string
+	id    uint
+}
+
+type pollFailure struct {
+	poll int
+	at   time.Time
+}
+
+// newFailureTracker returns nil, which tracks nothing, for a threshold of 0.
+func newFailureTracker(threshold int, window time.Duration) *failureTracker {
+	if threshold <= 0 {
+		return nil
+	}
+	return &failureTracker{threshold: threshold, window: window, failures: map[trackedRow][]pollFailure{}}
+}
+
+// record notes that the rows of table in ids failed in poll and returns
+// those that have now failed in threshold distinct polls within the window.
+// Those are forgotten, as are failures that fell out of the window.
+func (t *failureTracker) record(table string, ids []uint, poll int, now time.Time) (poison []uint) {
+	if t == nil {
+		return nil
+	}
+	cutoff := now.Add(-t.window)
+	for row, failures := range t.failures {
+		if failures[len(failures)-1].at.Before(cutoff) {
+			delete(t.failures, row)
+		}
+	}
+	for _, id := range ids {
+		row := trackedRow{table, id}
+		failures := t.failures[row]
+		for len(failures) > 0 && failures[0].at.Before(cutoff) {
+			failures = failures[1:]
+		}
+		if len(failures) == 0 || failures[len(failures)-1].poll != poll {
+			failures = append(failures, pollFailure{poll: poll, at: now})
+		}
+		if len(failures) >= t.threshold {
+			poison = append(poison, id)
+			delete(t.failures, row)
+			continue
+		}
+		t.failures[row] = failures
+	}
+	return poison
+}
+
+// forget drops the history of the rows of table in ids, which were sent.
+func (t *failureTracker) forget(table string, ids []uint) {
+	if t == nil {
+		return
+	}
+	for _, id := range ids {
+		delete(t.failures, trackedRow{table, id})
+	}
+}
+
+// quarantine marks the rows in ids, which kept failing across polls, failed
+// and forwards them to the error queue.
+func (p *producer) quarantine(ctx context.Context, batch outboundBatch, ids []uint, sendErr error) {
+	if len(ids) == 0 {
+		return
+	}
+	reason := fmt.Sprintf("failed in %d polls within POISON_WINDOW %s, last with: %v", p.failures.threshold, p.failures.window, sendErr)
+	log.Printf("Quarantining %d URLs that %s", len(ids), reason)
+	poisonQuarantined.Add(uint64(len(ids)))
+	if p.errorQueueURL != "" {
+		urls := make(map[uint]string, len(batch.ids))
+		for i, id := range batch.ids {
+			urls[id] = batch.urls[i]
+		}
+		rows := make([]poisonRow, len(ids))
+		for i, id := range ids {
+			rows[i] = poisonRow{id: id, url: urls[id], reason: reason}
+		}
+		p.forwardPoison(ctx, rows)
+	}
+	p.setStatus(ids, models.StatusFailed)
+}
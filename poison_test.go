@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+func TestFailureTracker(t *testing.T) {
+	start := time.Now()
+	type failure struct {
+		ids  []uint
+		poll int
+		// after is the time since the first failure.
+		after time.Duration
+	}
+	tests := []struct {
+		name     string
+		failures []failure
+		want     [][]uint
+	}{
+		{
+			name:     "poison after threshold polls",
+			failures: []failure{{[]uint{1, 2}, 1, 0}, {[]uint{1}, 2, time.Minute}, {[]uint{1, 2}, 3, 2 * time.Minute}},
+			want:     [][]uint{nil, nil, {1}},
+		},
+		{
+			name:     "one poll counts once",
+			failures: []failure{{[]uint{1}, 1, 0}, {[]uint{1}, 1, time.Second}, {[]uint{1}, 1, 2 * time.Second}},
+			want:     [][]uint{nil, nil, nil},
+		},
+		{
+			name:     "failures fall out of the window",
+			failures: []failure{{[]uint{1}, 1, 0}, {[]uint{1}, 2, time.Minute}, {[]uint{1}, 3, 11 * time.Minute}},
+			want:     [][]uint{nil, nil, nil},
+		},
+		{
+			name:     "poisoned rows start over",
+			failures: []failure{{[]uint{1}, 1, 0}, {[]uint{1}, 2, 0}, {[]uint{1}, 3, 0}, {[]uint{1}, 4, 0}, {[]uint{1}, 5, 0}, {[]uint{1}, 6, 0}},
+			want:     [][]uint{nil, nil, {1}, nil, nil, {1}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracker := newFailureTracker(3, 10*time.Minute)
+			for i, f := range tt.failures {
+				if got := tracker.record("", f.ids, f.poll, start.Add(f.after)); !slices.Equal(got, tt.want[i]) {
+					t.Fatalf("failure %d: got poison %v, want %v", i+1, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestFailureTrackerForget(t *testing.T) {
+	tracker := newFailureTracker(2, time.Hour)
+	tracker.record("", []uint{1}, 1, time.Now())
+	tracker.forget("", []uint{1})
+	if got := tracker.record("", []uint{1}, 2, time.Now()); got != nil {
+		t.Fatalf("got poison %v after forget, want none", got)
+	}
+	if newFailureTracker(0, time.Hour).record("", []uint{1}, 1, time.Now()) != nil {
+		t.Fatal("POISON_POLLS=0 must track nothing")
+	}
+}
+
+func TestFailureTrackerSourceTables(t *testing.T) {
+	now := time.Now()
+	tracker := newFailureTracker(2, time.Hour)
+	tracker.record("urls", []uint{5}, 1, now)
+	if got := tracker.record("urls_news", []uint{5}, 2, now); got != nil {
+		t.Fatalf("got poison %v for row 5 failing once in each table, want none", got)
+	}
+	tracker.forget("urls_news", []uint{5})
+	if got := tracker.record("urls", []uint{5}, 3, now); !slices.Equal(got, []uint{5}) {
+		t.Fatalf("got poison %v after row 5 of urls failed twice, want [5]", got)
+	}
+}
+
+// TestDeliverBatchPoisonCandidates sends a batch of three chunks, of which
+// the second gives up, and checks which rows count towards POISON_POLLS.
+func TestDeliverBatchPoisonCandidates(t *testing.T) {
+	tests := []struct {
+		name       string
+		fail       func(call int, body string) (string, bool, bool)
+		requestErr func(call int) error
+		// retries allows the one retry the case needs, which takes
+		// RetryBackoff.
+		retries bool
+		want    []uint
+	}{
+		{
+			name: "entries failed while others were accepted",
+			fail: func(call int, body string) (string, bool, bool) {
+				return "InternalError", false, body == "url-11" || body == "url-12"
+			},
+			want: []uint{11, 12},
+		},
+		{
+			name: "chunk failed whole",
+			requestErr: func(call int) error {
+				if call >= 2 {
+					return errors.New("connection reset")
+				}
+				return nil
+			},
+		},
+		{
+			name: "chunk failed whole after a partial failure",
+			fail: func(call int, body string) (string, bool, bool) {
+				return "InternalError", false, call == 2 && body == "url-11"
+			},
+			requestErr: func(call int) error {
+				if call >= 3 {
+					return errors.New("connection reset")
+				}
+				return nil
+			},
+			retries: true,
+		},
+		{
+			name: "sender faults are rejected, not tracked",
+			fail: func(call int, body string) (string, bool, bool) {
+				return "InvalidParameterValue", true, body == "url-11"
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestProducer(dryRunDB(t, nil), &fakeSQS{fail: tt.fail, requestErr: tt.requestErr})
+			p.batchSize = 30
+			p.failures = newFailureTracker(2, time.Hour)
+			p.pollCount = 1
+			p.retryBudget = time.Nanosecond
+			if tt.retries {
+				p.retryBudget = RetryBackoff + time.Second
+			}
+			batches, _ := p.buildBatches(testRows(30))
+
+			var result ProcessResult
+			p.deliverBatch(context.Background(), batches[0], &result)
+
+			var tracked []uint
+			for row := range p.failures.failures {
+				tracked = append(tracked, row.id)
+			}
+			slices.Sort(tracked)
+			if !slices.Equal(tracked, tt.want) {
+				t.Errorf("got %v tracked, want %v", tracked, tt.want)
+			}
+			if result.Sent < 10 {
+				t.Errorf("got %d sent, want the first chunk of 10 at least", result.Sent)
+			}
+		})
+	}
+}
+
+func TestSendChunkFailedEntries(t *testing.T) {
+	client := &fakeSQS{fail: func(call int, body string) (string, bool, bool) {
+		return "InternalError", false, body == "url-2"
+	}}
+	p := newTestProducer(dryRunDB(t, nil), client)
+	p.retryBudget = time.Nanosecond
+	batches, _ := p.buildBatches(testRows(3))
+
+	sr, err := p.sendBatch(context.Background(), batches[0].entries)
+	if err == nil {
+		t.Fatal("want an error")
+	}
+	ids := batches[0].urlIDs()
+	if len(sr.failed) != 1 || ids[aws.ToString(sr.failed[0].Id)] != 2 {
+		t.Fatalf("got failed %v, want the entry of row 2", sr.failed)
+	}
+}
@@ -0,0 +1,1036 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/aws/smithy-go"
+	"github.com/ofjangra/sqsURLProducer/app"
+	"github.com/ofjangra/sqsURLProducer/models"
+	"gorm.io/gorm"
+)
+
+// DeliverySemantics controls whether URLs are marked processed before or
+// after they are handed to SQS.
+//
+// AtLeastOnce (the default) sends a batch first and marks its URLs processed
+// only once SQS accepted it. A crash or failed update between the two steps
+// re-sends those URLs on the next poll, so consumers may see duplicates but
+// never miss a URL.
+//
+// AtMostOnce marks a batch processed first and sends it afterwards. If the
+// send then fails the mark is not reverted, so those URLs are lost, but a URL
+// is never delivered twice.
+type DeliverySemantics string
+
+const (
+	AtLeastOnce DeliverySemantics = "at_least_once"
+	AtMostOnce  DeliverySemantics = "at_most_once"
+)
+
+func parseDeliverySemantics(value string) (DeliverySemantics, error) {
+	switch s := DeliverySemantics(value); s {
+	case AtLeastOnce, AtMostOnce:
+		return s, nil
+	}
+	return "", fmt.Errorf("invalid delivery semantics %q, expected %s or %s", value, AtLeastOnce, AtMostOnce)
+}
+
+type producer struct {
+	db                *gorm.DB
+	sqsClient         sqsAPI
+	queueURL          string
+	errorQueueURL     string
+	queueLimit        *tokenBucket
+	errorQueueLimit   *tokenBucket
+	batchSize         int
+	fetchLimit        int
+	fetchChunkSize    int
+	maxFetchBytes     int
+	fetchFilter       fetchFilter
+	updateChunkSize   int
+	maxPerInterval    int
+	semantics         DeliverySemantics
+	marker            processedMarker
+	batchStatusUpdate bool
+	transactionScope  TransactionScope
+	dedupScope        DedupScope
+	groupStrategy     GroupStrategy
+	groupBuckets      int
+	groupSkewWarn     float64
+	entryRetryDelay   time.Duration
+	retryBudget       time.Duration
+	// maxDelay is how far ahead scheduled rows are fetched and sent with a delay.
+	maxDelay          time.Duration
+	retention         time.Duration // the queue's retention period, 0 if unknown
+	processingTime    time.Duration
+	claimTimeout      time.Duration
+	lockTimeout       time.Duration
+	pollDeadline      time.Duration
+	failureHook       *failureWebhook
+	notifier          sentNotifier
+	failures          *failureTracker
+	sequenceAttribute bool
+	batchPositions    bool
+	producerID        string
+	sourceHost        string
+	sourceNode        string
+	messageTags       map[string]string
+	readReplica       bool
+	bodyPrefix        string
+	bodySuffix        string
+	maxMessageBytes   int
+	oversizePolicy    OversizePolicy
+	exitOnPanic       bool
+	minBatchSize      int
+	minBatchMaxWait   time.Duration
+	heldSince         map[string]time.Time
+	strictPoll        bool
+	startupJitter     time.Duration
+	sendOnly          bool
+	storeMessageID    bool
+	correlationIDs    bool
+	storeCorrelation  bool
+	logLevel          LogLevel
+	name              string
+	adaptiveFetch     *adaptiveFetchSize
+	auditor           auditor
+	messageCount      int
+	entryIDPrefix     string
+	pollCount         int
+	sources           []string
+	sourceIndex       int
+	// draining is set by drain, which sends everything pending.
+	draining bool
+
+	// deferredSent holds the rows of this poll waiting for flushSent, and
+	// deferredColumns the values to store on them.
+	deferredSent    []uint
+	deferredColumns sentColumns
+	// strictFailures collects, during a STRICT_POLL poll, the rows
+	// retryLater and setStatus wrote, to write them again after a rollback.
+	strictFailures *pollFailures
+	// ready is set once the first poll starts, see /ready.
+	ready atomic.Bool
+	// reconnectNeeded is set by runPing when the database stopped answering.
+	reconnectNeeded atomic.Bool
+	// lastPoll is the summary of the most recent poll, see /summary.
+	lastPoll atomic.Pointer[pollSummaryLog]
+	// errorQueue feeds the error queue's own sender with SendPerQueue.
+	errorQueue     chan []poisonRow
+	errorQueueDone chan struct{}
+}
+
+// run polls until ctx is cancelled, sleeping between polls for as long as
+// scheduler says. A poll that is in progress when ctx is cancelled is left to
+// wind down on its own: it stops sending and returns its unsent rows. run
+// only returns an error for a panic with EXIT_ON_PANIC set.
+func (p *producer) run(ctx context.Context, scheduler *pollScheduler) error {
+	if !p.waitJitter(ctx) {
+		log.Println("Shutting down producer...")
+		return nil
+	}
+	for {
+		p.ready.Store(true)
+		if p.reconnectNeeded.Swap(false) {
+			p.reconnect(ctx)
+		}
+		interval := scheduler.idle
+		start := time.Now()
+		result, err := p.poll(ctx)
+		p.recordPoll(result, time.Since(start), err)
+		if errors.Is(err, errPollPanicked) {
+			// Already logged with its stack trace by poll.
+			if p.exitOnPanic {
+				return err
+			}
+		} else if errors.Is(err, errStrictPollFailed) {
+			interval = scheduler.failed()
+			log.Printf("Poll rolled back by STRICT_POLL, retrying in %s", interval)
+		} else if err != nil {
+			interval = scheduler.failed()
+			log.Printf("Database query failed, retrying in %s: %v", interval, err)
+			if app.IsConnectionError(err) {
+				p.reconnect(ctx)
+			}
+		} else if result.Fetched == 0 && result.Held > 0 {
+			interval = scheduler.held()
+		} else {
+			interval = scheduler.next(result.Fetched)
+		}
+		if p.adaptiveFetch != nil {
+			p.adaptiveFetch.update(result.Sent, result.Failed)
+		}
+
+		select {
+		case <-ctx.Done():
+			log.Println("Shutting down producer...")
+			return nil
+		case <-time.After(interval):
+		}
+	}
+}
+
+var errPollPanicked = errors.New("poll panicked")
+
+// errStrictPollFailed rolls back the poll transaction of a STRICT_POLL poll
+// in which a batch failed. The poll counts as failed: run backs off as after
+// a database error and drain stops.
+var errStrictPollFailed = errors.New("a batch failed with STRICT_POLL")
+
+// waitJitter sleeps for a random time of up to STARTUP_JITTER before the
+// first poll, so instances started together by a rollout do not all hit the
+// database at once. It reports false if ctx ended first.
+func (p *producer) waitJitter(ctx context.Context) bool {
+	if p.startupJitter <= 0 {
+		return true
+	}
+	delay := rand.N(p.startupJitter)
+	log.Printf("Waiting %s of STARTUP_JITTER before the first poll", delay.Round(time.Millisecond))
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(delay):
+		return true
+	}
+}
+
+// drain polls until a poll finds no more rows to claim, for RUN_MODE=once,
+// and returns the totals of all its polls. Every poll flushes its deferred
+// status updates before it returns, so nothing it sent is left unmarked when
+// drain does. Rows put back for a retry later wait for the next run; unlike
+// run, drain stops at the first poll that fails, including one STRICT_POLL
+// rolled back.
+func (p *producer) drain(ctx context.Context) (ProcessResult, error) {
+	var total ProcessResult
+	if !p.waitJitter(ctx) {
+		return total, nil
+	}
+	// Nothing polls after drain, so MIN_BATCH_SIZE must not hold rows back.
+	p.draining = true
+	p.ready.Store(true)
+	for ctx.Err() == nil {
+		start := time.Now()
+		result, err := p.poll(ctx)
+		p.recordPoll(result, time.Since(start), err)
+		total.add(result)
+		if err != nil {
+			return total, err
+		}
+		if result.Fetched == 0 {
+			break
+		}
+	}
+	return total, nil
+}
+
+// poll runs processURLs, turning a panic into errPollPanicked so that a bug
+// in one poll cannot silently kill the producer goroutine while /status keeps
+// reporting it as running. Rows the poll had claimed stay claimed until the
+// recovery sweep returns them after CLAIM_TIMEOUT. With EXIT_ON_PANIC run
+// then stops, shutting the process down for the supervisor to restart.
+func (p *producer) poll(ctx context.Context) (result ProcessResult, err error) {
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		producerPanics.Inc()
+		log.Printf("Poll panicked: %v\n%s", r, debug.Stack())
+		err = fmt.Errorf("%w: %v", errPollPanicked, r)
+	}()
+	return p.processURLs(ctx)
+}
+
+// runStats refreshes the urls_pending gauge every interval until ctx is
+// cancelled.
+func (p *producer) runStats(ctx context.Context, interval time.Duration) {
+	for {
+		p.refreshStats(app.GetDB())
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// refreshStats sets the urls_pending gauge to the pending rows of all
+// SOURCE_TABLES in db.
+func (p *producer) refreshStats(db *gorm.DB) {
+	counts, _, err := countSources(db, sourceTableNames(p.sources), p.marker)
+	if err != nil {
+		log.Printf("Failed to refresh URL stats: %v", err)
+		return
+	}
+	urlsPending.Set(float64(counts[models.StatusPending]))
+}
+
+// DBPingTimeout bounds a single keepalive ping.
+const DBPingTimeout = 5 * time.Second
+
+// runPing pings the database every interval until ctx is cancelled. Pinging
+// keeps an idle connection from being dropped by the database or a proxy
+// unnoticed, and a ping that fails on the connection flags a reconnect that
+// run makes before its next poll, instead of that poll failing first. The
+// reconnect itself is left to run so the pool is never swapped mid-poll.
+func (p *producer) runPing(ctx context.Context, interval time.Duration) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+
+		pingCtx, cancel := context.WithTimeout(ctx, DBPingTimeout)
+		err := app.Ping(pingCtx)
+		cancel()
+		if err == nil || ctx.Err() != nil {
+			continue
+		}
+		dbPingFailures.Inc()
+		log.Printf("Database ping failed: %v", err)
+		if app.IsConnectionError(err) || errors.Is(err, context.DeadlineExceeded) {
+			p.reconnectNeeded.Store(true)
+		}
+	}
+}
+
+// reconnect reopens the database pool after a lost connection, retrying with
+// exponential backoff. If every attempt fails the old pool is kept and the
+// next poll tries again.
+func (p *producer) reconnect(ctx context.Context) {
+	backoff := ReconnectBackoff
+	for attempt := 1; attempt <= ReconnectAttempts; attempt++ {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+
+		db, err := app.Reconnect()
+		if err == nil {
+			log.Printf("Reconnected to the database after %d attempts", attempt)
+			p.db = db
+			return
+		}
+		log.Printf("Database reconnect attempt %d failed: %v", attempt, err)
+		backoff *= 2
+	}
+	log.Printf("Giving up reconnecting after %d attempts, will retry on the next poll", ReconnectAttempts)
+}
+
+// outboundBatch pairs the entries of a SendMessageBatch request with the ids
+// of the rows they were built from.
+type outboundBatch struct {
+	entries []types.SendMessageBatchRequestEntry
+	ids     []uint
+	urls    []string
+	bytes   int
+}
+
+// pollFailures are the rows of a poll sent back for a retry later and the
+// rows marked failed.
+type pollFailures struct {
+	retry  []uint
+	failed []uint
+}
+
+// ProcessResult summarises a single poll.
+type ProcessResult struct {
+	// Fetched is the number of rows claimed.
+	Fetched int
+	// Sent and Failed count messages SQS accepted and messages it could not
+	// be made to accept, respectively.
+	Sent   int
+	Failed int
+	// Skipped counts rows that were never sent because they cannot form a
+	// valid message.
+	Skipped int
+	// BatchesSucceeded and BatchesFailed count batches by whether every
+	// message SQS did not reject was sent. A batch the poll's end cut short
+	// counts as neither.
+	BatchesSucceeded int
+	BatchesFailed    int
+	// Held counts pending rows MIN_BATCH_SIZE left for a later poll. A poll
+	// that held rows found work, even though it fetched none.
+	Held int
+}
+
+// add adds the counts of other to r.
+func (r *ProcessResult) add(other ProcessResult) {
+	r.Fetched += other.Fetched
+	r.Sent += other.Sent
+	r.Failed += other.Failed
+	r.Skipped += other.Skipped
+	r.BatchesSucceeded += other.BatchesSucceeded
+	r.BatchesFailed += other.BatchesFailed
+	r.Held += other.Held
+}
+
+// countBatch counts a delivered batch as failed if sending it returned err.
+func (r *ProcessResult) countBatch(err error) {
+	if err != nil {
+		r.BatchesFailed++
+	} else {
+		r.BatchesSucceeded++
+	}
+}
+
+// processURLs runs a single poll and reports what it did.
+//
+// With SOURCE_TABLES every poll works on the next table of the weighted
+// rotation. A table with nothing to send hands the poll on to the next
+// table it has not tried yet, so an empty table does not cost a poll
+// interval while another has a backlog.
+func (p *producer) processURLs(ctx context.Context) (ProcessResult, error) {
+	p.pollCount++
+	if len(p.sources) == 0 {
+		return p.processSource(ctx)
+	}
+
+	db := p.db
+	defer func() { p.db = db }()
+	var total ProcessResult
+	tried := make(map[string]bool, len(p.sources))
+	for range p.sources {
+		table := p.sources[p.sourceIndex]
+		p.sourceIndex = (p.sourceIndex + 1) % len(p.sources)
+		if tried[table] {
+			continue
+		}
+		tried[table] = true
+		p.db = db.Table(table).Session(&gorm.Session{})
+		p.debugf("Polling source table %s", table)
+		result, err := p.processSource(ctx)
+		total.add(result)
+		if err != nil || result.Fetched > 0 {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// processSource polls the table p.db refers to.
+//
+// With sendOnly the rows are read without being claimed and no status is
+// ever written, so every poll sends the same pending rows again.
+//
+// Up to fetchLimit rows are claimed per poll. When the limit is larger than
+// fetchChunkSize, rows are claimed and sent one chunk at a time, so only a
+// chunk's worth of rows is held in memory however high the limit is set.
+// Claiming in chunks rather than streaming with FindInBatches keeps every
+// row claimed (and locked against other producers) before it is read.
+func (p *producer) processSource(ctx context.Context) (ProcessResult, error) {
+	var result ProcessResult
+	if err := p.recoverStaleClaims(); err != nil {
+		return result, err
+	}
+
+	if p.pollDeadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.pollDeadline)
+		defer cancel()
+	}
+
+	if p.transactionScope == TransactionPoll {
+		// The sweep above stays outside, so a poll that rolls back does
+		// not undo it.
+		var failures pollFailures
+		if p.strictPoll {
+			p.strictFailures = &failures
+		}
+		result, err := p.inPollTransaction(func() (ProcessResult, error) {
+			result, err := p.claimAndSend(ctx)
+			if err == nil && p.strictPoll && result.BatchesFailed > 0 {
+				err = errStrictPollFailed
+			}
+			return result, err
+		})
+		p.strictFailures = nil
+		if errors.Is(err, errStrictPollFailed) {
+			log.Printf("STRICT_POLL rolled back the poll after %d of %d batches failed, all its %d URLs are pending again, including the %d already sent", result.BatchesFailed, result.BatchesFailed+result.BatchesSucceeded, result.Fetched, result.Sent)
+			// The rollback also undid the retry delays and failed
+			// statuses of the rows that failed. Without them the next
+			// poll would send those rows again straight away, and rows
+			// the failure tracker quarantined would come back.
+			p.retryLater(failures.retry)
+			p.setStatus(failures.failed, models.StatusFailed)
+		}
+		return result, err
+	}
+	return p.claimAndSend(ctx)
+}
+
+// claimAndSend claims and sends the rows of one poll, in chunks of
+// fetchChunkSize up to the poll's limit.
+func (p *producer) claimAndSend(ctx context.Context) (ProcessResult, error) {
+	var result ProcessResult
+	defer p.flushSent()
+
+	limit := p.fetchLimit
+	if p.adaptiveFetch != nil {
+		limit = p.adaptiveFetch.current
+	}
+	if p.maxPerInterval > 0 {
+		// Bounds the adaptive size too, so a growing fetch never drains a
+		// backlog faster than the downstream was promised.
+		limit = min(limit, p.maxPerInterval)
+	}
+	if p.minBatchSize > 1 && !p.draining {
+		held, err := p.holdForMinBatch()
+		if err != nil {
+			return result, err
+		}
+		if held > 0 {
+			result.Held = held
+			return result, nil
+		}
+	}
+	var after uint
+	for result.Fetched < limit && ctx.Err() == nil {
+		size := min(p.fetchChunkSize, limit-result.Fetched)
+		fetchStart := time.Now()
+		var urls []models.URLs
+		var trimmed bool
+		var err error
+		if p.sendOnly {
+			urls, trimmed, err = p.peekURLs(size, after)
+		} else {
+			urls, trimmed, err = p.claimURLs(size)
+		}
+		dbFetchDuration.Observe(time.Since(fetchStart).Seconds())
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			err = nil
+		}
+		if app.IsLockTimeout(err) {
+			// Another transaction holds the rows; they are left to it
+			// and this poll ends with what it has sent so far.
+			log.Printf("Claim gave up waiting for row locks after DB_LOCK_TIMEOUT %s, skipping the rest of this poll", p.lockTimeout)
+			break
+		}
+		if err != nil {
+			return result, err
+		}
+		if len(urls) == 0 {
+			break
+		}
+
+		result.Fetched += len(urls)
+		after = urls[len(urls)-1].ID
+		p.debugf("Processing %d URLs...", len(urls))
+		if trimmed {
+			p.debugf("MAX_FETCH_BYTES limited this chunk to %d URLs", len(urls))
+		}
+		if !p.sendURLs(ctx, urls, &result) || len(urls) < size && !trimmed {
+			break
+		}
+	}
+
+	if result.Fetched == 0 {
+		p.debugf("No URLs found, sleeping...")
+	}
+	if p.sendOnly && result.Sent > 0 {
+		log.Printf("WARNING: SEND_ONLY left the %d URLs sent in this poll pending, the next poll sends them again", result.Sent)
+	}
+	return result, nil
+}
+
+// sendURLs delivers claimed rows batch by batch. If ctx ends first, the rows
+// not yet sent are returned to pending and sendURLs reports false.
+func (p *producer) sendURLs(ctx context.Context, urls []models.URLs, result *ProcessResult) bool {
+	batches, rejected := p.buildBatches(urls)
+	if len(rejected) > 0 {
+		p.forwardPoison(ctx, rejected)
+		ids := make([]uint, len(rejected))
+		for i, row := range rejected {
+			ids[i] = row.id
+		}
+		p.setStatus(ids, models.StatusFailed)
+		result.Skipped += len(rejected)
+	}
+
+	if len(batches) > 0 {
+		skew, messages := groupSkew(batches)
+		sqsGroupSkew.Set(skew)
+		if p.groupSkewWarn > 0 && skew >= p.groupSkewWarn && messages > p.batchSize {
+			log.Printf("WARNING: %.0f%% of %d messages share one message group, a FIFO queue delivers them strictly one after another; consider a GROUP_ID_STRATEGY or group_key values that spread them", skew*100, messages)
+		}
+	}
+
+	// Batches are sent one at a time, so there is a single sender for now.
+	sqsActiveWorkers.Add(1)
+	defer sqsActiveWorkers.Add(-1)
+	for i, batch := range batches {
+		if ctx.Err() != nil {
+			var remaining []uint
+			for _, b := range batches[i:] {
+				remaining = append(remaining, b.ids...)
+			}
+			log.Printf("Poll stopped early (%v), returning %d unsent URLs to pending for the next poll", ctx.Err(), len(remaining))
+			p.releaseClaims(remaining)
+			return false
+		}
+		p.deliverBatch(ctx, batch, result)
+	}
+	return true
+}
+
+// buildBatches turns claimed rows into SendMessageBatch entries, grouped into
+// batches of at most the configured size. A message whose body and
+// attributes would push its batch past MaxSQSBatchBytes starts a new batch,
+// or is rejected with OversizeSkip. Rows that can never be sent as a
+// message are left out and returned as rejected, for the caller to forward
+// to the error queue and mark failed.
+func (p *producer) buildBatches(urls []models.URLs) (batches []outboundBatch, rejected []poisonRow) {
+	var batch outboundBatch
+	now := time.Now()
+	idPrefix := strings.ReplaceAll(p.entryIDPrefix, EntryIDPollPlaceholder, strconv.Itoa(p.pollCount)) + "msg-"
+	for _, url := range urls {
+		body, err := p.messageBody(url.URL)
+		if err != nil {
+			log.Printf("Skipping URL %d: %v", url.ID, err)
+			rejected = append(rejected, poisonRow{id: url.ID, url: url.URL, reason: err.Error()})
+			continue
+		}
+
+		p.messageCount++
+		entry := types.SendMessageBatchRequestEntry{
+			Id:             aws.String(idPrefix + strconv.Itoa(p.messageCount)),
+			MessageBody:    aws.String(body),
+			MessageGroupId: aws.String(p.groupID(url, p.messageCount)),
+		}
+		if attrs := p.messageAttributes(url); attrs != nil {
+			entry.MessageAttributes = attrs
+		}
+		if delay := delaySeconds(url.ScheduledAt, now); delay > 0 {
+			// Retention counts from the send, so a message delayed for
+			// longer than the queue keeps it expires before it is consumed.
+			if p.retention > 0 && time.Duration(delay)*time.Second+p.processingTime > p.retention {
+				reason := fmt.Sprintf("its delay of %ds plus SCHEDULE_PROCESSING_TIME %s exceeds the queue's retention of %s", delay, p.processingTime, p.retention)
+				log.Printf("Skipping URL %d: %s", url.ID, reason)
+				rejected = append(rejected, poisonRow{id: url.ID, url: url.URL, reason: reason})
+				continue
+			}
+			entry.DelaySeconds = delay
+		}
+		if id := dedupID(p.dedupScope, p.db.Statement.Table, url, now); id != "" {
+			entry.MessageDeduplicationId = aws.String(id)
+		}
+		size := messageSize(entry)
+		if p.batchPositions {
+			size += batchPositionBytes(p.batchSize)
+		}
+		if size > MaxSQSMessageBytes {
+			// Only possible with attributes, the body alone is capped by
+			// MAX_MESSAGE_BYTES.
+			reason := fmt.Sprintf("its body and attributes are %d bytes, more than the %d byte SQS limit", size, MaxSQSMessageBytes)
+			log.Printf("Skipping URL %d: %s", url.ID, reason)
+			rejected = append(rejected, poisonRow{id: url.ID, url: url.URL, reason: reason})
+			continue
+		}
+		if batch.bytes+size > MaxSQSBatchBytes {
+			if p.oversizePolicy == OversizeSkip {
+				reason := fmt.Sprintf("its %d bytes would push the batch past the %d byte SQS limit", size, MaxSQSBatchBytes)
+				log.Printf("Skipping URL %d: %s", url.ID, reason)
+				rejected = append(rejected, poisonRow{id: url.ID, url: url.URL, reason: reason})
+				continue
+			}
+			batches = append(batches, batch)
+			batch = outboundBatch{}
+		}
+		batch.entries = append(batch.entries, entry)
+		batch.ids = append(batch.ids, url.ID)
+		batch.urls = append(batch.urls, url.URL)
+		batch.bytes += size
+
+		// Close the batch when batch size is reached
+		if len(batch.entries) == p.batchSize {
+			batches = append(batches, batch)
+			batch = outboundBatch{} // Reset batch
+		}
+	}
+	if len(batch.entries) > 0 {
+		batches = append(batches, batch)
+	}
+	if p.batchPositions {
+		for _, batch := range batches {
+			setBatchPositions(batch)
+		}
+	}
+	return batches, rejected
+}
+
+// deliverBatch sends a batch and marks its URLs sent in the order dictated by
+// the configured delivery semantics. Only the entries SQS reported as
+// successful count as sent. Entries SQS rejected as the sender's fault are
+// marked failed, since sending them again cannot succeed; the rest are
+// retried on a later poll once ENTRY_RETRY_DELAY has passed.
+func (p *producer) deliverBatch(ctx context.Context, batch outboundBatch, result *ProcessResult) {
+	if len(batch.entries) == 0 {
+		return
+	}
+	if p.semantics == AtMostOnce {
+		p.setStatus(batch.ids, models.StatusSent)
+		sr, err := p.sendBatch(ctx, batch.entries)
+		p.audit(batch, sr.successful)
+		p.logSent(batch, sr.successful)
+		p.notifySent(ctx, batch, sr.successful)
+		sent, rejected, unsent := batch.partition(sr)
+		if columns := p.sentColumns(batch, sr.successful); columns != nil && len(sent) > 0 {
+			p.setSent(sent, columns)
+		}
+		p.rejectEntries(ctx, batch, rejected, sr.rejected, result)
+		if err != nil {
+			log.Printf("Failed to send batch, %d URLs already marked sent are lost: %v", len(unsent), err)
+			p.setStatus(unsent, models.StatusFailed)
+			p.failureHook.notify(p.queueURL, p.db.Statement.Table, unsent, err)
+			result.Failed += len(unsent)
+		}
+		result.Sent += len(sent)
+		result.countBatch(err)
+		return
+	}
+
+	sr, err := p.sendBatch(ctx, batch.entries)
+	p.audit(batch, sr.successful)
+	p.logSent(batch, sr.successful)
+	p.notifySent(ctx, batch, sr.successful)
+	sent, rejected, unsent := batch.partition(sr)
+	p.rejectEntries(ctx, batch, rejected, sr.rejected, result)
+	switch {
+	case err != nil && ctx.Err() != nil && errors.Is(err, ctx.Err()):
+		// The poll ended, at POLL_DEADLINE or a shutdown, while waiting to
+		// send. That says nothing about the rows, which go back to pending
+		// for the next poll like those of the batches never attempted, and
+		// the batch counts as neither succeeded nor failed.
+		log.Printf("Poll stopped early (%v), returning %d unsent URLs of the batch to pending for the next poll", ctx.Err(), len(unsent))
+		p.releaseClaims(unsent)
+	case err != nil:
+		log.Printf("Failed to send %d of %d messages in batch: %v", len(unsent), len(batch.ids), err)
+		var failed []uint
+		ids := batch.urlIDs()
+		for _, f := range sr.failed {
+			failed = append(failed, ids[aws.ToString(f.Id)])
+		}
+		poison := p.failures.record(p.db.Statement.Table, failed, p.pollCount, time.Now())
+		p.retryLater(slices.DeleteFunc(slices.Clone(unsent), func(id uint) bool { return slices.Contains(poison, id) }))
+		p.quarantine(ctx, batch, poison, err)
+		p.failureHook.notify(p.queueURL, p.db.Statement.Table, unsent, err)
+		result.Failed += len(unsent)
+		result.countBatch(err)
+	default:
+		result.countBatch(nil)
+	}
+	if len(sent) == 0 {
+		return
+	}
+	p.failures.forget(p.db.Statement.Table, sent)
+	columns := p.sentColumns(batch, sr.successful)
+	if p.batchStatusUpdate {
+		p.deferredSent = append(p.deferredSent, sent...)
+		if columns != nil {
+			if p.deferredColumns == nil {
+				p.deferredColumns = sentColumns{}
+			}
+			p.deferredColumns.add(columns)
+		}
+	} else {
+		p.setSent(sent, columns)
+	}
+	result.Sent += len(sent)
+}
+
+// rejectEntries marks the rows whose entries SQS rejected as the sender's
+// fault failed.
+func (p *producer) rejectEntries(ctx context.Context, batch outboundBatch, ids []uint, entries []types.BatchResultErrorEntry, result *ProcessResult) {
+	if len(ids) == 0 {
+		return
+	}
+	first := entries[0]
+	err := fmt.Errorf("%d entries rejected, first with %s: %s", len(entries), aws.ToString(first.Code), aws.ToString(first.Message))
+	log.Printf("Marking %d URLs failed: %v", len(ids), err)
+	if p.errorQueueURL != "" {
+		index := make(map[string]int, len(batch.entries))
+		for i, entry := range batch.entries {
+			index[aws.ToString(entry.Id)] = i
+		}
+		var rows []poisonRow
+		for _, e := range entries {
+			if i, ok := index[aws.ToString(e.Id)]; ok {
+				rows = append(rows, poisonRow{id: batch.ids[i], url: batch.urls[i], reason: aws.ToString(e.Code) + ": " + aws.ToString(e.Message)})
+			}
+		}
+		p.forwardPoison(ctx, rows)
+	}
+	p.setStatus(ids, models.StatusFailed)
+	p.failureHook.notify(p.queueURL, p.db.Statement.Table, ids, err)
+	result.Failed += len(ids)
+}
+
+// urlIDs maps the entry ids of the batch to the ids of their rows.
+func (b outboundBatch) urlIDs() map[string]uint {
+	ids := make(map[string]uint, len(b.entries))
+	for i, entry := range b.entries {
+		ids[aws.ToString(entry.Id)] = b.ids[i]
+	}
+	return ids
+}
+
+// partition splits the batch's row ids into those whose entries SQS
+// accepted, those it rejected as the sender's fault, and the rest.
+func (b outboundBatch) partition(sr sendResult) (sent, rejected, unsent []uint) {
+	accepted := make(map[string]bool, len(sr.successful))
+	for _, s := range sr.successful {
+		accepted[aws.ToString(s.Id)] = true
+	}
+	senderFault := make(map[string]bool, len(sr.rejected))
+	for _, f := range sr.rejected {
+		senderFault[aws.ToString(f.Id)] = true
+	}
+	for i, entry := range b.entries {
+		switch id := aws.ToString(entry.Id); {
+		case accepted[id]:
+			sent = append(sent, b.ids[i])
+		case senderFault[id]:
+			rejected = append(rejected, b.ids[i])
+		default:
+			unsent = append(unsent, b.ids[i])
+		}
+	}
+	return sent, rejected, unsent
+}
+
+// sentColumns returns the values to store on the rows of the batch's entries
+// in successful when they are marked sent, or nil when neither
+// STORE_MESSAGE_ID nor STORE_CORRELATION_ID is set.
+func (p *producer) sentColumns(b outboundBatch, successful []types.SendMessageBatchResultEntry) sentColumns {
+	if !p.storeMessageID && !p.storeCorrelation {
+		return nil
+	}
+	index := make(map[string]int, len(b.entries))
+	for i, entry := range b.entries {
+		index[aws.ToString(entry.Id)] = i
+	}
+	columns := sentColumns{}
+	for _, s := range successful {
+		i, ok := index[aws.ToString(s.Id)]
+		if !ok {
+			continue
+		}
+		if p.storeMessageID {
+			columns.set("message_id", b.ids[i], aws.ToString(s.MessageId))
+		}
+		if p.storeCorrelation {
+			columns.set("correlation_id", b.ids[i], aws.ToString(b.entries[i].MessageAttributes["correlation_id"].StringValue))
+		}
+	}
+	return columns
+}
+
+// sendResult is what SQS made of the entries of a batch.
+type sendResult struct {
+	successful []types.SendMessageBatchResultEntry
+	// rejected are the entries SQS failed with SenderFault set, which no
+	// retry can fix.
+	rejected []types.BatchResultErrorEntry
+	// failed are the entries still failing with a retryable error when a
+	// chunk gave up after SQS accepted others from it. Entries of a chunk
+	// that failed as a whole, or was never sent, are not in it.
+	failed []types.BatchResultErrorEntry
+}
+
+func (r *sendResult) add(other sendResult) {
+	r.successful = append(r.successful, other.successful...)
+	r.rejected = append(r.rejected, other.rejected...)
+	r.failed = append(r.failed, other.failed...)
+}
+
+// sendBatch sends entries in chunks of at most MaxSQSBatchEntries, since
+// SendMessageBatch rejects larger requests outright. It stops at the first
+// chunk that still fails after retries. An empty batch is a no-op: SQS
+// would reject it with EmptyBatchRequest, and retrying cannot help. What SQS
+// reported is returned even on failure, since earlier chunks were already
+// sent.
+func (p *producer) sendBatch(ctx context.Context, batch []types.SendMessageBatchRequestEntry) (sendResult, error) {
+	var result sendResult
+	if len(batch) == 0 {
+		return result, nil
+	}
+	for start := 0; start < len(batch); start += MaxSQSBatchEntries {
+		end := min(start+MaxSQSBatchEntries, len(batch))
+		chunk, err := p.sendChunk(ctx, batch[start:end])
+		result.add(chunk)
+		if err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// sendChunk sends one SendMessageBatch request. When SQS fails some of its
+// entries, only those are sent again, so transient per-entry failures recover
+// within the same poll; a failed request is retried whole. Both count towards
+// RetryAttempts. Entries failed with SenderFault are not retried but
+// reported as rejected. What SQS reported so far is returned even on failure.
+//
+// With a retry budget, no retry starts whose backoff would end more than
+// retryBudget after the first attempt started, even if attempts remain.
+func (p *producer) sendChunk(ctx context.Context, batch []types.SendMessageBatchRequestEntry) (sendResult, error) {
+	var result sendResult
+	var lastErr error
+	// retryable are the entries the last response failed, nil when the last
+	// request failed as a whole.
+	var retryable []types.BatchResultErrorEntry
+	giveUp := func(err error) (sendResult, error) {
+		if len(result.successful) > 0 {
+			result.failed = retryable
+		}
+		return result, err
+	}
+	start := time.Now()
+	for attempt := 0; attempt < RetryAttempts; attempt++ {
+		if attempt > 0 {
+			backoff := RetryBackoff * time.Duration(attempt)
+			if p.retryBudget > 0 && time.Since(start)+backoff > p.retryBudget {
+				return giveUp(fmt.Errorf("failed to send %d messages after %d attempts, retrying would exceed BATCH_RETRY_BUDGET %s: %w", len(batch), attempt, p.retryBudget, lastErr))
+			}
+			select {
+			case <-ctx.Done():
+				return giveUp(fmt.Errorf("gave up sending %d messages after %d attempts: %w", len(batch), attempt, ctx.Err()))
+			case <-time.After(backoff):
+			}
+		}
+
+		if err := p.queueLimit.wait(ctx, len(batch)); err != nil {
+			return giveUp(fmt.Errorf("gave up sending %d messages after %d attempts: %w", len(batch), attempt, err))
+		}
+
+		// A request that is already in flight is allowed to finish when the
+		// poll is cut short, so a shutdown or POLL_DEADLINE never abandons a
+		// batch SQS may already have accepted; only the retry waits stop early.
+		sqsInflightBatches.Add(1)
+		out, err := p.sqsClient.SendMessageBatch(context.WithoutCancel(ctx), &sqs.SendMessageBatchInput{
+			QueueUrl: aws.String(p.queueURL),
+			Entries:  batch,
+		})
+		sqsInflightBatches.Add(-1)
+		if err != nil {
+			log.Printf("Send batch attempt %d failed: %v", attempt+1, err)
+			sqsSendErrors.Inc(errorCode(err))
+			lastErr = err
+			retryable = nil
+			continue
+		}
+
+		successful, failed := matchResults(batch, out)
+		result.successful = append(result.successful, successful...)
+		retryable = nil
+		for _, f := range failed {
+			sqsSendErrors.Inc(aws.ToString(f.Code))
+			if f.SenderFault {
+				result.rejected = append(result.rejected, f)
+			} else {
+				retryable = append(retryable, f)
+			}
+		}
+		if len(retryable) == 0 {
+			p.debugf("Successfully sent batch of %d messages.", len(successful))
+			return result, nil
+		}
+		first := retryable[0]
+		lastErr = fmt.Errorf("%d entries failed, first with %s: %s", len(retryable), aws.ToString(first.Code), aws.ToString(first.Message))
+		log.Printf("Send batch attempt %d: %d of %d messages failed: %v", attempt+1, len(retryable), len(batch), lastErr)
+		batch = failedEntries(batch, retryable)
+	}
+
+	return giveUp(fmt.Errorf("failed to send %d messages after %d attempts: %w", len(batch), RetryAttempts, lastErr))
+}
+
+// matchResults checks a SendMessageBatch response against the entries that
+// were sent, so a malformed one cannot corrupt the status updates: results
+// for unknown ids, and any further results for an id already reported, are
+// logged and dropped, and entries the response does not mention at all are
+// reported as retryable failures.
+func matchResults(batch []types.SendMessageBatchRequestEntry, out *sqs.SendMessageBatchOutput) (successful []types.SendMessageBatchResultEntry, failed []types.BatchResultErrorEntry) {
+	reported := make(map[string]bool, len(batch))
+	for _, entry := range batch {
+		reported[aws.ToString(entry.Id)] = false
+	}
+	accept := func(id string) bool {
+		done, known := reported[id]
+		switch {
+		case !known:
+			log.Printf("Ignoring a SendMessageBatch result for unknown entry id %q", id)
+		case done:
+			log.Printf("Ignoring a second SendMessageBatch result for entry id %q", id)
+		default:
+			reported[id] = true
+		}
+		return known && !done
+	}
+
+	for _, s := range out.Successful {
+		if accept(aws.ToString(s.Id)) {
+			successful = append(successful, s)
+		}
+	}
+	for _, f := range out.Failed {
+		if accept(aws.ToString(f.Id)) {
+			failed = append(failed, f)
+		}
+	}
+	for _, entry := range batch {
+		if !reported[aws.ToString(entry.Id)] {
+			failed = append(failed, types.BatchResultErrorEntry{
+				Id:      entry.Id,
+				Code:    aws.String("MissingFromResponse"),
+				Message: aws.String("SendMessageBatch reported no result for this entry"),
+			})
+		}
+	}
+	return successful, failed
+}
+
+// errorCode returns the AWS error code of err, "network" when the request did
+// not get a response, or "unknown".
+func errorCode(err error) string {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.ErrorCode()
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return "network"
+	}
+	return "unknown"
+}
+
+// failedEntries returns the entries of batch that SQS reported in failed.
+func failedEntries(batch []types.SendMessageBatchRequestEntry, failed []types.BatchResultErrorEntry) []types.SendMessageBatchRequestEntry {
+	ids := make(map[string]bool, len(failed))
+	for _, f := range failed {
+		ids[aws.ToString(f.Id)] = true
+	}
+	var retry []types.SendMessageBatchRequestEntry
+	for _, entry := range batch {
+		if ids[aws.ToString(entry.Id)] {
+			retry = append(retry, entry)
+		}
+	}
+	return retry
+}
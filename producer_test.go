@@ -0,0 +1,776 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/ofjangra/sqsURLProducer/models"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// fakeSQS stands in for SQS. It accepts every entry unless fail or
+// requestErr say otherwise and records the requests it was sent.
+type fakeSQS struct {
+	mu       sync.Mutex
+	calls    int
+	requests []*sqs.SendMessageBatchInput
+	log      *eventLog
+
+	// fail decides, for the nth SendMessageBatch call (from 1), whether the
+	// entry with the given body fails, with which code and whether as the
+	// sender's fault.
+	fail func(call int, body string) (code string, senderFault, failed bool)
+	// requestErr fails the nth call as a whole when it returns an error.
+	requestErr func(call int) error
+	// attributesErr fails GetQueueAttributes.
+	attributesErr error
+	// retention is the MessageRetentionPeriod GetQueueAttributes reports,
+	// in seconds, the SQS default of 4 days when empty.
+	retention string
+	// panicOn makes the nth SendMessageBatch call panic.
+	panicOn int
+	// purged are the queues PurgeQueue was called for, and purgeErr fails
+	// it.
+	purged   []string
+	purgeErr error
+}
+
+func (f *fakeSQS) SendMessageBatch(ctx context.Context, in *sqs.SendMessageBatchInput, _ ...func(*sqs.Options)) (*sqs.SendMessageBatchOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls++
+	f.requests = append(f.requests, in)
+	f.log.add("send %s %d", aws.ToString(in.QueueUrl), len(in.Entries))
+	if f.calls == f.panicOn {
+		panic("fake SQS panicked")
+	}
+	if f.requestErr != nil {
+		if err := f.requestErr(f.calls); err != nil {
+			return nil, err
+		}
+	}
+	out := &sqs.SendMessageBatchOutput{}
+	for _, e := range in.Entries {
+		if f.fail != nil {
+			if code, sender, failed := f.fail(f.calls, aws.ToString(e.MessageBody)); failed {
+				out.Failed = append(out.Failed, types.BatchResultErrorEntry{Id: e.Id, Code: aws.String(code), Message: aws.String("fake failure"), SenderFault: sender})
+				continue
+			}
+		}
+		out.Successful = append(out.Successful, types.SendMessageBatchResultEntry{Id: e.Id, MessageId: aws.String("m-" + aws.ToString(e.MessageBody))})
+	}
+	return out, nil
+}
+
+func (f *fakeSQS) GetQueueAttributes(ctx context.Context, in *sqs.GetQueueAttributesInput, _ ...func(*sqs.Options)) (*sqs.GetQueueAttributesOutput, error) {
+	if f.attributesErr != nil {
+		return nil, f.attributesErr
+	}
+	retention := f.retention
+	if retention == "" {
+		retention = "345600"
+	}
+	return &sqs.GetQueueAttributesOutput{Attributes: map[string]string{"MessageRetentionPeriod": retention}}, nil
+}
+
+func (f *fakeSQS) PurgeQueue(ctx context.Context, in *sqs.PurgeQueueInput, _ ...func(*sqs.Options)) (*sqs.PurgeQueueOutput, error) {
+	f.purged = append(f.purged, aws.ToString(in.QueueUrl))
+	if f.purgeErr != nil {
+		return nil, f.purgeErr
+	}
+	return &sqs.PurgeQueueOutput{}, nil
+}
+
+// eventLog interleaves the SQS requests and SQL statements of a test, so
+// tests can check the order they happened in. A nil log records nothing.
+type eventLog struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (l *eventLog) add(format string, args ...any) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events = append(l.events, fmt.Sprintf(format, args...))
+}
+
+// matching returns the events containing substr.
+func (l *eventLog) matching(substr string) []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var events []string
+	for _, e := range l.events {
+		if strings.Contains(e, substr) {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+// sqlRecorder is a gorm logger that adds every statement to an eventLog.
+type sqlRecorder struct{ log *eventLog }
+
+func (r sqlRecorder) LogMode(logger.LogLevel) logger.Interface      { return r }
+func (r sqlRecorder) Info(context.Context, string, ...interface{})  {}
+func (r sqlRecorder) Warn(context.Context, string, ...interface{})  {}
+func (r sqlRecorder) Error(context.Context, string, ...interface{}) {}
+func (r sqlRecorder) Trace(_ context.Context, _ time.Time, fc func() (string, int64), _ error) {
+	sql, _ := fc()
+	r.log.add("sql %s", sql)
+}
+
+// dryRunDB returns a database that builds statements without running them
+// and records them in log, for tests of what the producer writes.
+func dryRunDB(t *testing.T, log *eventLog) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open(postgres.New(postgres.Config{DSN: "host=localhost"}), &gorm.Config{
+		DryRun:                 true,
+		SkipDefaultTransaction: true,
+		DisableAutomaticPing:   true,
+		Logger:                 sqlRecorder{log: log},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// testDB connects to the Postgres database in TEST_DATABASE_URL, skipping
+// the test when it is not set. The urls table and the further tables given,
+// with its columns, are created afresh.
+func testDB(t *testing.T, tables ...string) *gorm.DB {
+	t.Helper()
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, table := range append([]string{"urls"}, tables...) {
+		if err := db.Migrator().DropTable(table); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Table(table).AutoMigrate(&models.URLs{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Cleanup(func() {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	return db
+}
+
+// insertRows adds rows to table with the given statuses, with ids from 1
+// and URLs url-1, url-2 and so on.
+func insertRows(t *testing.T, db *gorm.DB, table string, statuses ...models.URLStatus) {
+	t.Helper()
+	for i, status := range statuses {
+		row := models.URLs{ID: uint(i + 1), URL: fmt.Sprintf("url-%d", i+1), Status: status}
+		if err := db.Table(table).Create(&row).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+const testQueueURL = "https://sqs.us-east-1.amazonaws.com/123456789012/urls"
+
+// newTestProducer returns a producer with the defaults main would give it,
+// sending to client and writing to db.
+func newTestProducer(db *gorm.DB, client sqsAPI) *producer {
+	return &producer{
+		db:              db,
+		sqsClient:       client,
+		queueURL:        testQueueURL,
+		batchSize:       BatchSize,
+		fetchLimit:      DatabaseLimit,
+		fetchChunkSize:  FetchChunkSize,
+		updateChunkSize: StatusUpdateChunkSize,
+		semantics:       AtLeastOnce,
+		marker:          processedMarker{kind: MarkerStatus, column: "status"},
+		groupStrategy:   GroupPerMessage,
+		entryRetryDelay: time.Minute,
+		claimTimeout:    5 * time.Minute,
+		maxMessageBytes: MaxSQSMessageBytes,
+		oversizePolicy:  OversizeSplit,
+		logLevel:        LogInfo,
+	}
+}
+
+// testRows returns n rows with ids from 1 and URLs url-1, url-2 and so on.
+func testRows(n int) []models.URLs {
+	rows := make([]models.URLs, n)
+	for i := range rows {
+		rows[i] = models.URLs{ID: uint(i + 1), URL: fmt.Sprintf("url-%d", i+1), Status: models.StatusClaimed}
+	}
+	return rows
+}
+
+func TestDeliverBatchOrdering(t *testing.T) {
+	tests := []struct {
+		semantics DeliverySemantics
+		first     string
+	}{
+		{AtLeastOnce, "send"},
+		{AtMostOnce, "sql UPDATE"},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.semantics), func(t *testing.T) {
+			log := &eventLog{}
+			p := newTestProducer(dryRunDB(t, log), &fakeSQS{log: log})
+			p.semantics = tt.semantics
+			batches, _ := p.buildBatches(testRows(3))
+
+			var result ProcessResult
+			p.deliverBatch(context.Background(), batches[0], &result)
+
+			if result.Sent != 3 || result.Failed != 0 {
+				t.Fatalf("got %d sent and %d failed, want 3 and 0", result.Sent, result.Failed)
+			}
+			if len(log.events) == 0 || !strings.HasPrefix(log.events[0], tt.first) {
+				t.Fatalf("want the first event to start with %q, got %q", tt.first, log.events)
+			}
+			if sent := log.matching(`"status"='sent'`); len(sent) != 1 {
+				t.Errorf("got %d updates to sent, want 1: %q", len(sent), log.events)
+			}
+		})
+	}
+}
+
+func TestQueueNotifier(t *testing.T) {
+	const notifyURL = "https://sqs.us-east-1.amazonaws.com/123456789012/notify"
+	urls := []sentURL{{ID: 1, URL: "url-1", MessageID: "m-1"}, {ID: 2, URL: "url-2", MessageID: "m-2"}}
+	tests := []struct {
+		name     string
+		mode     NotifyMode
+		perQueue bool
+		want     int
+	}{
+		{"per url", NotifyPerURL, false, 2},
+		{"per batch", NotifyPerBatch, false, 1},
+		{"per url from its own sender", NotifyPerURL, true, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &fakeSQS{}
+			n := newQueueNotifier(client, notifyURL, tt.mode, newTokenBucket(100)).(*queueNotifier)
+			if tt.perQueue {
+				n.start()
+			}
+			n.onSent(context.Background(), urls)
+			n.stop()
+
+			if len(client.requests) != 1 || aws.ToString(client.requests[0].QueueUrl) != notifyURL {
+				t.Fatalf("got %d requests, want 1 to the notify queue", len(client.requests))
+			}
+			if got := len(client.requests[0].Entries); got != tt.want {
+				t.Errorf("got %d events, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeliverBatchCutShort(t *testing.T) {
+	log := &eventLog{}
+	client := &fakeSQS{log: log, fail: func(call int, body string) (string, bool, bool) {
+		return "InternalError", false, body == "url-2"
+	}}
+	p := newTestProducer(dryRunDB(t, log), client)
+	p.failures = newFailureTracker(1, time.Hour)
+	batches, _ := p.buildBatches(testRows(3))
+
+	// The deadline passes during the backoff before the retry of url-2.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	var result ProcessResult
+	p.deliverBatch(ctx, batches[0], &result)
+
+	if result.Sent != 2 || result.Failed != 0 || result.BatchesFailed != 0 {
+		t.Fatalf("got %d sent, %d failed and %d failed batches, want 2, 0 and 0", result.Sent, result.Failed, result.BatchesFailed)
+	}
+	if len(log.matching("next_attempt_at")) != 0 || len(log.matching(`'failed'`)) != 0 {
+		t.Errorf("want no retry delay or failed status for a batch cut short, got %q", log.events)
+	}
+	released := log.matching(`"status"='pending'`)
+	if len(released) != 1 || !strings.Contains(released[0], "IN (2)") {
+		t.Errorf("want url-2 released to pending, got %q", log.events)
+	}
+}
+
+func TestSendChunkRetries(t *testing.T) {
+	tests := []struct {
+		name       string
+		fail       func(call int, body string) (string, bool, bool)
+		requestErr func(call int) error
+		// requests are the bodies sent by each SendMessageBatch call.
+		requests [][]string
+		sent     int
+		rejected int
+	}{
+		{
+			name: "only failed entries are retried",
+			fail: func(call int, body string) (string, bool, bool) {
+				return "InternalError", false, call == 1 && body == "url-2"
+			},
+			requests: [][]string{{"url-1", "url-2", "url-3"}, {"url-2"}},
+			sent:     3,
+		},
+		{
+			name: "sender faults are not retried",
+			fail: func(call int, body string) (string, bool, bool) {
+				return "InvalidParameterValue", true, body == "url-2"
+			},
+			requests: [][]string{{"url-1", "url-2", "url-3"}},
+			sent:     2,
+			rejected: 1,
+		},
+		{
+			name: "failed requests are retried whole",
+			requestErr: func(call int) error {
+				if call == 1 {
+					return fmt.Errorf("connection reset")
+				}
+				return nil
+			},
+			requests: [][]string{{"url-1", "url-2", "url-3"}, {"url-1", "url-2", "url-3"}},
+			sent:     3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &fakeSQS{fail: tt.fail, requestErr: tt.requestErr}
+			p := newTestProducer(dryRunDB(t, nil), client)
+			batches, _ := p.buildBatches(testRows(3))
+
+			sr, err := p.sendBatch(context.Background(), batches[0].entries)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(sr.successful) != tt.sent || len(sr.rejected) != tt.rejected {
+				t.Errorf("got %d successful and %d rejected, want %d and %d", len(sr.successful), len(sr.rejected), tt.sent, tt.rejected)
+			}
+			if len(client.requests) != len(tt.requests) {
+				t.Fatalf("got %d requests, want %d", len(client.requests), len(tt.requests))
+			}
+			for i, req := range client.requests {
+				var bodies []string
+				for _, e := range req.Entries {
+					bodies = append(bodies, aws.ToString(e.MessageBody))
+				}
+				if !slices.Equal(bodies, tt.requests[i]) {
+					t.Errorf("request %d: got %q, want %q", i+1, bodies, tt.requests[i])
+				}
+			}
+		})
+	}
+}
+
+func TestMaxPerInterval(t *testing.T) {
+	db := testDB(t)
+	insertRows(t, db, "urls", slices.Repeat([]models.URLStatus{pending}, 30)...)
+	client := &fakeSQS{}
+	p := newTestProducer(db, client)
+	p.fetchChunkSize = 4
+	p.maxPerInterval = 7
+	// The cap also bounds an adaptive fetch size above it.
+	p.adaptiveFetch = newAdaptiveFetchSize(10, 20, 10, 0)
+
+	for poll, want := range []int{7, 7, 7, 7, 2, 0} {
+		client.requests = nil
+		result, err := p.processURLs(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var sent int
+		for _, req := range client.requests {
+			sent += len(req.Entries)
+		}
+		if result.Fetched != want || sent != want {
+			t.Errorf("poll %d: got %d fetched and %d sent, want %d of the 30 per poll", poll+1, result.Fetched, sent, want)
+		}
+	}
+}
+
+func TestBatchStatusUpdate(t *testing.T) {
+	tests := []struct {
+		name      string
+		chunkSize int
+		updates   []string
+	}{
+		{"one update", StatusUpdateChunkSize, []string{"IN (1,2,3,4,5,6,7,8,9)"}},
+		{"chunked", 4, []string{"IN (1,2,3,4)", "IN (5,6,7,8)", "IN (9)"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			log := &eventLog{}
+			p := newTestProducer(dryRunDB(t, log), &fakeSQS{log: log})
+			p.batchSize = 3
+			p.updateChunkSize = tt.chunkSize
+			p.batchStatusUpdate = true
+			batches, _ := p.buildBatches(testRows(9))
+
+			var result ProcessResult
+			for _, batch := range batches {
+				p.deliverBatch(context.Background(), batch, &result)
+			}
+			if len(log.matching("sql UPDATE")) != 0 {
+				t.Fatalf("want no update before the poll ends, got %q", log.events)
+			}
+			p.flushSent()
+
+			updates := log.matching(`"status"='sent'`)
+			if len(updates) != len(tt.updates) {
+				t.Fatalf("got %d updates to sent, want %d: %q", len(updates), len(tt.updates), updates)
+			}
+			for i, update := range updates {
+				if !strings.Contains(update, tt.updates[i]) {
+					t.Errorf("update %d: got %q, want it to contain %q", i+1, update, tt.updates[i])
+				}
+			}
+			if sends := log.matching("send "); len(sends) != 3 {
+				t.Errorf("got %d sends, want 3", len(sends))
+			}
+		})
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	tests := []struct {
+		budget   time.Duration
+		requests int
+	}{
+		// The first retry waits RetryBackoff, the second twice as long.
+		{RetryBackoff / 2, 1},
+		{RetryBackoff + RetryBackoff/2, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.budget.String(), func(t *testing.T) {
+			client := &fakeSQS{requestErr: func(call int) error { return fmt.Errorf("connection reset") }}
+			p := newTestProducer(dryRunDB(t, nil), client)
+			p.retryBudget = tt.budget
+			batches, _ := p.buildBatches(testRows(3))
+
+			start := time.Now()
+			_, err := p.sendBatch(context.Background(), batches[0].entries)
+			if err == nil || !strings.Contains(err.Error(), "BATCH_RETRY_BUDGET") {
+				t.Fatalf("want an error naming BATCH_RETRY_BUDGET, got %v", err)
+			}
+			if elapsed := time.Since(start); elapsed > tt.budget {
+				t.Errorf("gave up after %s, more than the budget of %s", elapsed, tt.budget)
+			}
+			if len(client.requests) != tt.requests || tt.requests >= RetryAttempts {
+				t.Errorf("got %d requests, want %d of the %d attempts", len(client.requests), tt.requests, RetryAttempts)
+			}
+		})
+	}
+}
+
+func TestSendOnly(t *testing.T) {
+	db := testDB(t)
+	insertRows(t, db, "urls", pending, pending, pending, pending)
+	log := &eventLog{}
+	client := &fakeSQS{fail: func(call int, body string) (string, bool, bool) {
+		switch body {
+		case "url-2":
+			return "InternalError", false, true
+		case "url-3":
+			return "InvalidParameterValue", true, true
+		}
+		return "", false, false
+	}}
+	p := newTestProducer(db.Session(&gorm.Session{Logger: sqlRecorder{log: log}}), client)
+	p.sendOnly = true
+	p.storeMessageID = true
+	p.retryBudget = time.Nanosecond
+
+	// Every poll sends the same rows again, since none is marked.
+	for poll := 1; poll <= 2; poll++ {
+		result, err := p.processURLs(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Sent != 2 || result.Failed != 2 {
+			t.Errorf("poll %d: got %d sent and %d failed, want 2 and 2", poll, result.Sent, result.Failed)
+		}
+	}
+	if len(client.requests) != 2 {
+		t.Errorf("got %d requests, want one per poll", len(client.requests))
+	}
+	for _, event := range log.events {
+		if !strings.HasPrefix(event, "sql SELECT") {
+			t.Errorf("want only SELECTs, got %q", event)
+		}
+	}
+	if got, want := statuses(t, db, "urls"), []models.URLStatus{pending, pending, pending, pending}; !slices.Equal(got, want) {
+		t.Errorf("got statuses %v, want %v", got, want)
+	}
+}
+
+func TestWaitJitter(t *testing.T) {
+	const jitter = 20 * time.Millisecond
+	p := newTestProducer(dryRunDB(t, nil), &fakeSQS{})
+	p.startupJitter = jitter
+	waiting := regexp.MustCompile(`Waiting (\S+) of STARTUP_JITTER`)
+
+	var delays []time.Duration
+	for range 20 {
+		out := captureLog(t)
+		start := time.Now()
+		if !p.waitJitter(context.Background()) {
+			t.Fatal("waitJitter gave up without a cancelled context")
+		}
+		elapsed := time.Since(start)
+		m := waiting.FindStringSubmatch(out.String())
+		if m == nil {
+			t.Fatalf("got log %q, want the jitter logged", out.String())
+		}
+		delay, err := time.ParseDuration(m[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The logged delay is rounded to the millisecond.
+		if delay < 0 || delay > jitter || elapsed < delay-time.Millisecond {
+			t.Errorf("got a delay of %s after waiting %s, want it within %s and waited out", delay, elapsed, jitter)
+		}
+		delays = append(delays, delay)
+	}
+	if slices.Min(delays) == slices.Max(delays) {
+		t.Errorf("got the same delay %s every time, want it random", delays[0])
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	p.startupJitter = time.Hour
+	if p.waitJitter(ctx) {
+		t.Error("waitJitter waited out an hour of jitter after the context was cancelled")
+	}
+}
+
+func TestDrainFlushes(t *testing.T) {
+	const notifyURL = "https://sqs.us-east-1.amazonaws.com/123456789012/notify"
+	db := testDB(t)
+	insertRows(t, db, "urls", slices.Repeat([]models.URLStatus{pending}, 25)...)
+	client := &fakeSQS{}
+	p := newTestProducer(db, client)
+	p.fetchLimit = 10
+	p.batchStatusUpdate = true
+	p.notifier = newQueueNotifier(client, notifyURL, NotifyPerURL, newTokenBucket(0))
+	p.startQueueSenders()
+
+	// As RUN_MODE=once does before it exits.
+	total, err := p.drain(context.Background())
+	p.stopQueueSenders()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total.Fetched != 25 || total.Sent != 25 {
+		t.Errorf("got %d fetched and %d sent, want 25 and 25", total.Fetched, total.Sent)
+	}
+	if len(p.deferredSent) != 0 {
+		t.Errorf("got %d rows left deferred", len(p.deferredSent))
+	}
+	if got, want := statuses(t, db, "urls"), slices.Repeat([]models.URLStatus{sent}, 25); !slices.Equal(got, want) {
+		t.Errorf("got statuses %v, want all sent", got)
+	}
+	var events int
+	for _, req := range requestsTo(client, notifyURL) {
+		events += len(req.Entries)
+	}
+	if events != 25 {
+		t.Errorf("got %d sent notifications, want 25", events)
+	}
+}
+
+func TestSendBatchChunks(t *testing.T) {
+	client := &fakeSQS{}
+	p := newTestProducer(dryRunDB(t, nil), client)
+	p.batchSize = 25
+	batches, _ := p.buildBatches(testRows(25))
+	if len(batches) != 1 {
+		t.Fatalf("got %d batches, want 1", len(batches))
+	}
+
+	sr, err := p.sendBatch(context.Background(), batches[0].entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sr.successful) != 25 {
+		t.Errorf("got %d successful, want 25", len(sr.successful))
+	}
+	var sizes []int
+	for _, req := range client.requests {
+		sizes = append(sizes, len(req.Entries))
+	}
+	if !slices.Equal(sizes, []int{10, 10, 5}) {
+		t.Errorf("got SendMessageBatch calls of %v entries, want [10 10 5]", sizes)
+	}
+}
+
+func TestRunSurvivesPanic(t *testing.T) {
+	db := testDB(t)
+	insertRows(t, db, "urls", pending, pending)
+	client := &fakeSQS{panicOn: 1}
+	p := newTestProducer(db, client)
+	p.fetchLimit, p.fetchChunkSize = 1, 1
+	panics := producerPanics.Value()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- p.run(ctx, newPollScheduler(time.Millisecond, time.Millisecond, time.Millisecond, 1, time.Millisecond))
+	}()
+	deadline := time.After(5 * time.Second)
+	for {
+		client.mu.Lock()
+		calls := client.calls
+		client.mu.Unlock()
+		if calls >= 2 {
+			break
+		}
+		select {
+		case <-deadline:
+			t.Fatalf("got %d sends, want the poll after the panic to send as well", calls)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("run returned %v, want it to keep polling after a panic", err)
+	}
+
+	if got := producerPanics.Value() - panics; got != 1 {
+		t.Errorf("counted %d panics, want 1", got)
+	}
+	// The panicked poll's row stays claimed for the recovery sweep.
+	if got, want := statuses(t, db, "urls"), []models.URLStatus{claimed, sent}; !slices.Equal(got, want) {
+		t.Errorf("got statuses %v, want %v", got, want)
+	}
+}
+
+func TestRunExitsOnPanic(t *testing.T) {
+	db := testDB(t)
+	insertRows(t, db, "urls", pending)
+	p := newTestProducer(db, &fakeSQS{panicOn: 1})
+	p.exitOnPanic = true
+
+	err := p.run(context.Background(), newPollScheduler(time.Millisecond, time.Millisecond, time.Millisecond, 1, time.Millisecond))
+	if !errors.Is(err, errPollPanicked) {
+		t.Fatalf("got %v, want errPollPanicked with EXIT_ON_PANIC", err)
+	}
+}
+
+func TestMatchResults(t *testing.T) {
+	entry := func(id string) types.SendMessageBatchRequestEntry {
+		return types.SendMessageBatchRequestEntry{Id: aws.String(id), MessageBody: aws.String("url-" + id)}
+	}
+	ok := func(id string) types.SendMessageBatchResultEntry {
+		return types.SendMessageBatchResultEntry{Id: aws.String(id), MessageId: aws.String("m-" + id)}
+	}
+	fail := func(id string) types.BatchResultErrorEntry {
+		return types.BatchResultErrorEntry{Id: aws.String(id), Code: aws.String("InternalError")}
+	}
+	batch := []types.SendMessageBatchRequestEntry{entry("1"), entry("2"), entry("3")}
+	tests := []struct {
+		name       string
+		out        *sqs.SendMessageBatchOutput
+		successful []string
+		failed     []string
+	}{
+		{"every entry reported", &sqs.SendMessageBatchOutput{Successful: []types.SendMessageBatchResultEntry{ok("1"), ok("2")}, Failed: []types.BatchResultErrorEntry{fail("3")}}, []string{"1", "2"}, []string{"3"}},
+		{"unknown failed id", &sqs.SendMessageBatchOutput{Successful: []types.SendMessageBatchResultEntry{ok("1"), ok("2")}, Failed: []types.BatchResultErrorEntry{fail("bogus")}}, []string{"1", "2"}, []string{"3"}},
+		{"unknown successful id", &sqs.SendMessageBatchOutput{Successful: []types.SendMessageBatchResultEntry{ok("1"), ok("2"), ok("99")}}, []string{"1", "2"}, []string{"3"}},
+		{"entry reported twice", &sqs.SendMessageBatchOutput{Successful: []types.SendMessageBatchResultEntry{ok("1"), ok("2"), ok("3")}, Failed: []types.BatchResultErrorEntry{fail("2")}}, []string{"1", "2", "3"}, nil},
+		{"empty response", &sqs.SendMessageBatchOutput{}, nil, []string{"1", "2", "3"}},
+		{"nil ids", &sqs.SendMessageBatchOutput{Successful: []types.SendMessageBatchResultEntry{{}}, Failed: []types.BatchResultErrorEntry{{}}}, nil, []string{"1", "2", "3"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			successful, failed := matchResults(batch, tt.out)
+			var gotOK, gotFailed []string
+			for _, s := range successful {
+				gotOK = append(gotOK, aws.ToString(s.Id))
+			}
+			for _, f := range failed {
+				gotFailed = append(gotFailed, aws.ToString(f.Id))
+				if f.SenderFault {
+					t.Errorf("entry %s failed as the sender's fault, want it retryable", aws.ToString(f.Id))
+				}
+			}
+			if !slices.Equal(gotOK, tt.successful) || !slices.Equal(gotFailed, tt.failed) {
+				t.Errorf("got successful %q and failed %q, want %q and %q", gotOK, gotFailed, tt.successful, tt.failed)
+			}
+		})
+	}
+}
+
+// bogusSQS answers every SendMessageBatch with results for entry ids it was
+// never sent.
+type bogusSQS struct{ fakeSQS }
+
+func (b *bogusSQS) SendMessageBatch(ctx context.Context, in *sqs.SendMessageBatchInput, opts ...func(*sqs.Options)) (*sqs.SendMessageBatchOutput, error) {
+	b.fakeSQS.SendMessageBatch(ctx, in, opts...)
+	return &sqs.SendMessageBatchOutput{
+		Successful: []types.SendMessageBatchResultEntry{{Id: aws.String("bogus-1"), MessageId: aws.String("m-1")}},
+		Failed:     []types.BatchResultErrorEntry{{Id: aws.String("bogus-2"), Code: aws.String("InternalError")}},
+	}, nil
+}
+
+func TestDeliverBatchBogusResults(t *testing.T) {
+	log := &eventLog{}
+	p := newTestProducer(dryRunDB(t, log), &bogusSQS{fakeSQS{log: log}})
+	p.retryBudget = time.Nanosecond
+	batches, _ := p.buildBatches(testRows(2))
+
+	var result ProcessResult
+	p.deliverBatch(context.Background(), batches[0], &result)
+
+	if result.Sent != 0 || result.Failed != 2 || result.BatchesFailed != 1 {
+		t.Fatalf("got %d sent, %d failed and %d failed batches, want 0, 2 and 1", result.Sent, result.Failed, result.BatchesFailed)
+	}
+	retried := log.matching("next_attempt_at")
+	if len(retried) != 1 || !strings.Contains(retried[0], "IN (1,2)") {
+		t.Errorf("want both rows put back for a retry, got %q", log.events)
+	}
+	if len(log.matching(`'sent'`)) != 0 || len(log.matching(`'failed'`)) != 0 {
+		t.Errorf("want no row marked sent or failed, got %q", log.events)
+	}
+}
+
+func TestEmptyBatch(t *testing.T) {
+	log := &eventLog{}
+	client := &fakeSQS{log: log}
+	p := newTestProducer(dryRunDB(t, log), client)
+
+	if sr, err := p.sendBatch(context.Background(), nil); err != nil || len(sr.successful) != 0 {
+		t.Fatalf("got %d successful and error %v for an empty batch, want none", len(sr.successful), err)
+	}
+	var result ProcessResult
+	p.deliverBatch(context.Background(), outboundBatch{}, &result)
+	p.sendURLs(context.Background(), nil, &result)
+
+	if client.calls != 0 || len(log.events) != 0 {
+		t.Errorf("got %d SendMessageBatch calls and events %q, want none", client.calls, log.events)
+	}
+	if result != (ProcessResult{}) {
+		t.Errorf("got result %+v, want nothing counted", result)
+	}
+}
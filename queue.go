@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"github.com/ofjangra/sqsURLProducer/app"
+)
+
+// resolveQueueURL returns the destination queue URL: the value of the SSM
+// parameter named by SQS_URL_SSM_PARAM when that is set, so deployments can
+// share one parameter per environment, and SQS_URL otherwise. region only
+// names the region in errors.
+func resolveQueueURL(ctx context.Context, client parameterAPI, region string) (string, error) {
+	name := os.Getenv("SQS_URL_SSM_PARAM")
+	if name == "" {
+		return getEnv("SQS_URL"), nil
+	}
+	if os.Getenv("SQS_URL") != "" {
+		log.Println("Both SQS_URL and SQS_URL_SSM_PARAM are set, using the SSM parameter")
+	}
+	out, err := client.GetParameter(ctx, &ssm.GetParameterInput{
+		Name:           aws.String(name),
+		WithDecryption: aws.Bool(true),
+	})
+	var notFound *ssmtypes.ParameterNotFound
+	if errors.As(err, &notFound) {
+		return "", fmt.Errorf("SSM parameter %s does not exist in %s", name, region)
+	}
+	if err != nil {
+		return "", fmt.Errorf("reading SSM parameter %s: %w", name, err)
+	}
+	value := strings.TrimSpace(aws.ToString(out.Parameter.Value))
+	if value == "" {
+		return "", fmt.Errorf("SSM parameter %s is empty", name)
+	}
+	log.Printf("Using the queue URL from SSM parameter %s", name)
+	return value, nil
+}
+
+// parameterAPI is the part of the SSM client resolveQueueURL uses, so that
+// tests can stand in for Parameter Store.
+type parameterAPI interface {
+	GetParameter(ctx context.Context, params *ssm.GetParameterInput, optFns ...func(*ssm.Options)) (*ssm.GetParameterOutput, error)
+}
+
+// sqsAPI is the part of the SQS client the producer and the HTTP server
+// use, so that tests can stand in for SQS.
+type sqsAPI interface {
+	SendMessageBatch(ctx context.Context, params *sqs.SendMessageBatchInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageBatchOutput, error)
+	GetQueueAttributes(ctx context.Context, params *sqs.GetQueueAttributesInput, optFns ...func(*sqs.Options)) (*sqs.GetQueueAttributesOutput, error)
+	PurgeQueue(ctx context.Context, params *sqs.PurgeQueueInput, optFns ...func(*sqs.Options)) (*sqs.PurgeQueueOutput, error)
+}
+
+// queueRetention reads the queue's MessageRetentionPeriod, the time after
+// which SQS deletes messages nobody has consumed.
+func queueRetention(ctx context.Context, client sqsAPI, queueURL string) (time.Duration, error) {
+	out, err := client.GetQueueAttributes(ctx, &sqs.GetQueueAttributesInput{
+		QueueUrl:       aws.String(queueURL),
+		AttributeNames: []types.QueueAttributeName{types.QueueAttributeNameMessageRetentionPeriod},
+	})
+	if err != nil {
+		return 0, err
+	}
+	value, ok := out.Attributes[string(types.QueueAttributeNameMessageRetentionPeriod)]
+	if !ok {
+		return 0, fmt.Errorf("queue did not report %s", types.QueueAttributeNameMessageRetentionPeriod)
+	}
+	seconds, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %w", types.QueueAttributeNameMessageRetentionPeriod, value, err)
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// checkRetention logs the queue's retention period and warns when it is
+// shorter than threshold, since messages then expire if consumers are down
+// for longer than that. It returns the retention, or 0 if it is unknown.
+func checkRetention(ctx context.Context, client sqsAPI, queueURL string, threshold time.Duration) time.Duration {
+	retention, err := queueRetention(ctx, client, queueURL)
+	if err != nil {
+		log.Printf("Could not read the queue's message retention period: %v", err)
+		return 0
+	}
+	if retention < threshold {
+		log.Printf("WARNING: queue retains messages for only %s (threshold %s), messages will be lost if consumers are down for longer", retention, threshold)
+	} else {
+		log.Printf("Queue retains messages for %s", retention)
+	}
+	return retention
+}
+
+// waitForQueue calls GetQueueAttributes until it succeeds, retrying with
+// exponential backoff for up to wait, so the producer does not start polling
+// before the queue is reachable. A zero wait returns at once.
+func waitForQueue(ctx context.Context, client sqsAPI, queueURL string, wait time.Duration) error {
+	if wait <= 0 {
+		return nil
+	}
+	deadline := time.Now().Add(wait)
+	backoff := time.Second
+	for {
+		_, err := queueRetention(ctx, client, queueURL)
+		if err == nil {
+			return nil
+		}
+		if time.Now().Add(backoff).After(deadline) {
+			return fmt.Errorf("queue still not reachable after %s: %w", wait, err)
+		}
+		log.Printf("Queue not reachable yet, retrying in %s: %v", backoff, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, app.MaxWaitBackoff)
+	}
+}
+
+// purgeQueue deletes every message on the queue, for PURGE_ON_START. SQS
+// allows one purge per queue every 60 seconds, so a purge refused because
+// the previous one is still in progress is only logged: the queue is being
+// emptied either way.
+func purgeQueue(ctx context.Context, client sqsAPI, queueURL string) error {
+	log.Printf("WARNING: PURGE_ON_START is set, deleting every message on %s", queueURL)
+	_, err := client.PurgeQueue(ctx, &sqs.PurgeQueueInput{QueueUrl: aws.String(queueURL)})
+	var inProgress *types.PurgeQueueInProgress
+	if errors.As(err, &inProgress) {
+		log.Printf("Queue is still being purged by an earlier purge: %v", err)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	log.Println("Queue purged")
+	return nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+)
+
+// fakeSSM serves the parameters in params and reports any other as missing.
+type fakeSSM struct {
+	params map[string]string
+	asked  []*ssm.GetParameterInput
+}
+
+func (f *fakeSSM) GetParameter(ctx context.Context, in *ssm.GetParameterInput, _ ...func(*ssm.Options)) (*ssm.GetParameterOutput, error) {
+	f.asked = append(f.asked, in)
+	value, ok := f.params[aws.ToString(in.Name)]
+	if !ok {
+		return nil, &ssmtypes.ParameterNotFound{Message: aws.String("not found")}
+	}
+	return &ssm.GetParameterOutput{Parameter: &ssmtypes.Parameter{Value: aws.String(value)}}, nil
+}
+
+func TestResolveQueueURL(t *testing.T) {
+	client := &fakeSSM{params: map[string]string{
+		"/prod/queue": " https://sqs.eu-west-1.amazonaws.com/1/prod.fifo\n",
+		"/prod/empty": "",
+	}}
+	tests := []struct {
+		name  string
+		param string
+		url   string
+		err   string
+	}{
+		{"SQS_URL without a parameter", "", "https://sqs.eu-west-1.amazonaws.com/1/env.fifo", ""},
+		{"parameter found", "/prod/queue", "https://sqs.eu-west-1.amazonaws.com/1/prod.fifo", ""},
+		{"parameter missing", "/prod/missing", "", "SSM parameter /prod/missing does not exist in eu-west-1"},
+		{"parameter empty", "/prod/empty", "", "SSM parameter /prod/empty is empty"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("SQS_URL", "https://sqs.eu-west-1.amazonaws.com/1/env.fifo")
+			t.Setenv("SQS_URL_SSM_PARAM", tt.param)
+			url, err := resolveQueueURL(context.Background(), client, "eu-west-1")
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if url != tt.url {
+				t.Errorf("got %q, want %q", url, tt.url)
+			}
+		})
+	}
+	for _, in := range client.asked {
+		if !aws.ToBool(in.WithDecryption) {
+			t.Errorf("parameter %s read without decryption", aws.ToString(in.Name))
+		}
+	}
+}
+
+func TestCheckRetention(t *testing.T) {
+	tests := []struct {
+		name      string
+		client    *fakeSQS
+		retention time.Duration
+		output    string
+	}{
+		{"below the threshold", &fakeSQS{retention: "3600"}, time.Hour, "WARNING: queue retains messages for only 1h0m0s (threshold 24h0m0s)"},
+		{"at the threshold", &fakeSQS{retention: "86400"}, 24 * time.Hour, "Queue retains messages for 24h0m0s"},
+		{"unreadable", &fakeSQS{attributesErr: errors.New("access denied")}, 0, "Could not read the queue's message retention period: access denied"},
+		{"invalid", &fakeSQS{retention: "four days"}, 0, `invalid MessageRetentionPeriod "four days"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := captureLog(t)
+
+			retention := checkRetention(context.Background(), tt.client, testQueueURL, 24*time.Hour)
+			if retention != tt.retention {
+				t.Errorf("got retention %s, want %s", retention, tt.retention)
+			}
+			if !strings.Contains(out.String(), tt.output) {
+				t.Errorf("got log %q, want it to contain %q", out.String(), tt.output)
+			}
+			if tt.retention >= 24*time.Hour && strings.Contains(out.String(), "WARNING") {
+				t.Errorf("got a warning for a retention of %s", tt.retention)
+			}
+		})
+	}
+}
+
+func TestPurgeQueue(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		fails  bool
+		output string
+	}{
+		{"purged", nil, false, "Queue purged"},
+		{"purge in progress", &types.PurgeQueueInProgress{Message: aws.String("only one purge every 60 seconds")}, false, "Queue is still being purged by an earlier purge"},
+		{"purge refused", errors.New("access denied"), true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := captureLog(t)
+			client := &fakeSQS{purgeErr: tt.err}
+
+			err := purgeQueue(context.Background(), client, testQueueURL)
+			if (err != nil) != tt.fails {
+				t.Fatalf("got error %v, want failure %v", err, tt.fails)
+			}
+			if len(client.purged) != 1 || client.purged[0] != testQueueURL {
+				t.Errorf("got purges of %q, want one of %s", client.purged, testQueueURL)
+			}
+			if !strings.Contains(out.String(), tt.output) {
+				t.Errorf("got log %q, want it to contain %q", out.String(), tt.output)
+			}
+		})
+	}
+}
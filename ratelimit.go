@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tokenBucket caps the rate of messages sent to one queue. It holds up to
+// burst tokens, refilled at rate per second, and every message takes one. A
+// nil bucket does not limit anything.
+type tokenBucket struct {
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns a bucket for rate messages per second, or nil for a
+// rate of 0. The burst leaves room for a full SendMessageBatch, so a rate
+// below MaxSQSBatchEntries still lets whole batches through, only less often.
+func newTokenBucket(rate float64) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	burst := max(rate, MaxSQSBatchEntries)
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// wait takes n tokens, blocking until the bucket has refilled enough for
+// them or ctx ends. Tokens are reserved before waiting, so concurrent
+// senders queue up behind each other rather than racing for the refill.
+func (b *tokenBucket) wait(ctx context.Context, n int) error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens -= float64(n)
+	delay := time.Duration(-b.tokens / b.rate * float64(time.Second))
+	b.mu.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+
+	select {
+	case <-ctx.Done():
+		// The messages are not sent after all.
+		b.mu.Lock()
+		b.tokens += float64(n)
+		b.mu.Unlock()
+		return ctx.Err()
+	case <-time.After(delay):
+		return nil
+	}
+}
+
+// rateEnvKey is the RATE_<queuename> variable that caps the send rate of
+// queueURL, with the characters of the queue name that cannot appear in an
+// environment variable name, '-' and '.', replaced by '_'. It is
+// RATE_url_queue_fifo for a queue named url-queue.fifo.
+func rateEnvKey(queueURL string) string {
+	return "RATE_" + strings.NewReplacer("-", "_", ".", "_").Replace(path.Base(queueURL))
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	tests := []struct {
+		name string
+		rate float64
+		// takes are the tokens taken one after another.
+		takes []int
+		// wait is roughly how long the last take should block.
+		wait time.Duration
+	}{
+		{"burst of a full batch", 1, []int{MaxSQSBatchEntries}, 0},
+		{"beyond the burst", 100, []int{100, 10}, 100 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTokenBucket(tt.rate)
+			var last time.Duration
+			for _, n := range tt.takes {
+				start := time.Now()
+				if err := b.wait(context.Background(), n); err != nil {
+					t.Fatal(err)
+				}
+				last = time.Since(start)
+			}
+			if last < tt.wait-20*time.Millisecond || last > tt.wait+50*time.Millisecond {
+				t.Errorf("last take waited %s, want about %s", last, tt.wait)
+			}
+		})
+	}
+}
+
+func TestTokenBucketConcurrentWaits(t *testing.T) {
+	b := newTokenBucket(100)
+	b.wait(context.Background(), 100)
+
+	// Both takes reserve their tokens up front, so the second one waits
+	// behind the first instead of both waiting for the same refill.
+	start := time.Now()
+	var wg sync.WaitGroup
+	for range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b.wait(context.Background(), 10)
+		}()
+	}
+	wg.Wait()
+	if waited := time.Since(start); waited < 180*time.Millisecond {
+		t.Errorf("two takes of 10 at 100 per second were done after %s, want about 200ms", waited)
+	}
+}
+
+func TestTokenBucketCancel(t *testing.T) {
+	b := newTokenBucket(10)
+	b.wait(context.Background(), MaxSQSBatchEntries)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := b.wait(ctx, 10); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want the deadline", err)
+	}
+	// The cancelled take gave its tokens back, so one token is due after
+	// a tenth of a second rather than after a whole one.
+	start := time.Now()
+	b.wait(context.Background(), 1)
+	if waited := time.Since(start); waited > 150*time.Millisecond {
+		t.Errorf("got a wait of %s after a cancelled take, want about 100ms", waited)
+	}
+}
+
+func TestNilTokenBucket(t *testing.T) {
+	if b := newTokenBucket(0); b != nil {
+		t.Fatal("want no bucket for a rate of 0")
+	}
+	var b *tokenBucket
+	if err := b.wait(context.Background(), 1000); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRateEnvKey(t *testing.T) {
+	tests := []struct{ queueURL, want string }{
+		{"https://sqs.us-east-1.amazonaws.com/123456789012/urls", "RATE_urls"},
+		{"https://sqs.us-east-1.amazonaws.com/123456789012/url-queue.fifo", "RATE_url_queue_fifo"},
+	}
+	for _, tt := range tests {
+		if got := rateEnvKey(tt.queueURL); got != tt.want {
+			t.Errorf("rateEnvKey(%q) = %q, want %q", tt.queueURL, got, tt.want)
+		}
+	}
+}
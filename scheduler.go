@@ -0,0 +1,100 @@
+package main
+
+import "time"
+
+// pollScheduler decides how long to sleep between polls: busy after a poll
+// that found work, so a backlog drains quickly, and idle after an empty one.
+// After threshold consecutive empty polls the idle interval doubles on every
+// further empty poll, up to max, and drops back as soon as a poll finds
+// work. Polls that fail on the database back off separately, doubling from
+// idle up to errorMax, so a database outage is not hammered every interval.
+type pollScheduler struct {
+	busy       time.Duration
+	idle       time.Duration
+	max        time.Duration
+	threshold  int
+	emptyPolls int
+	current    time.Duration
+
+	errorMax time.Duration
+	failures int
+}
+
+func newPollScheduler(busy, idle, max time.Duration, threshold int, errorMax time.Duration) *pollScheduler {
+	if max < idle {
+		max = idle
+	}
+	if errorMax < idle {
+		errorMax = idle
+	}
+	return &pollScheduler{busy: busy, idle: idle, max: max, threshold: threshold, current: idle, errorMax: errorMax}
+}
+
+// next records the number of URLs found by the last poll and returns the
+// interval to wait before the next one.
+func (s *pollScheduler) next(found int) time.Duration {
+	s.failures = 0
+	if found > 0 {
+		s.emptyPolls = 0
+		s.current = s.idle
+		return s.busy
+	}
+
+	s.emptyPolls++
+	if s.emptyPolls > s.threshold {
+		s.current = min(s.current*2, s.max)
+	}
+	return s.current
+}
+
+// held records a poll that MIN_BATCH_SIZE held back. Its rows are pending,
+// so the poll does not count as empty: the empty-poll backoff resets and the
+// next poll follows after idle, keeping a hold within MIN_BATCH_MAX_WAIT plus
+// one idle interval.
+func (s *pollScheduler) held() time.Duration {
+	s.failures = 0
+	s.emptyPolls = 0
+	s.current = s.idle
+	return s.idle
+}
+
+// failed records a poll that failed on the database and returns the interval
+// to wait before retrying: idle after the first failure, doubling with every
+// consecutive one up to errorMax.
+func (s *pollScheduler) failed() time.Duration {
+	s.failures++
+	interval := s.idle
+	for i := 1; i < s.failures && interval < s.errorMax; i++ {
+		interval *= 2
+	}
+	return min(interval, s.errorMax)
+}
+
+// adaptiveFetchSize adjusts how many rows a poll claims based on how many of
+// the last poll's messages failed to send, in the style of TCP congestion
+// control: a failure rate above threshold halves the size (never below min),
+// anything else grows it by step (never above max). Polls that sent nothing
+// leave it unchanged.
+type adaptiveFetchSize struct {
+	min, max, step int
+	threshold      float64
+	current        int
+}
+
+func newAdaptiveFetchSize(lower, upper, step int, threshold float64) *adaptiveFetchSize {
+	return &adaptiveFetchSize{min: lower, max: upper, step: step, threshold: threshold, current: upper}
+}
+
+func (a *adaptiveFetchSize) update(sent, failed int) int {
+	attempted := sent + failed
+	if attempted == 0 {
+		return a.current
+	}
+
+	if float64(failed)/float64(attempted) > a.threshold {
+		a.current = max(a.min, a.current/2)
+	} else {
+		a.current = min(a.max, a.current+a.step)
+	}
+	return a.current
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPollScheduler(t *testing.T) {
+	const (
+		busy = time.Second
+		idle = 10 * time.Second
+	)
+	// Each step is a poll: the rows it found, or -1 for a failed poll and
+	// -2 for one MIN_BATCH_SIZE held back.
+	tests := []struct {
+		name  string
+		polls []int
+		want  []time.Duration
+	}{
+		{"busy after work", []int{5, 5}, []time.Duration{busy, busy}},
+		{"backoff after threshold", []int{0, 0, 0, 0, 0}, []time.Duration{idle, idle, 20 * time.Second, 40 * time.Second, 40 * time.Second}},
+		{"work resets backoff", []int{0, 0, 0, 1, 0}, []time.Duration{idle, idle, 20 * time.Second, busy, idle}},
+		{"errors back off separately", []int{-1, -1, -1, 0}, []time.Duration{idle, 20 * time.Second, 30 * time.Second, idle}},
+		{"held polls never back off", []int{-2, -2, -2, -2}, []time.Duration{idle, idle, idle, idle}},
+		{"held poll resets the empty backoff", []int{0, 0, 0, -2, 0}, []time.Duration{idle, idle, 20 * time.Second, idle, idle}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newPollScheduler(busy, idle, 40*time.Second, 2, 30*time.Second)
+			for i, found := range tt.polls {
+				var got time.Duration
+				switch found {
+				case -1:
+					got = s.failed()
+				case -2:
+					got = s.held()
+				default:
+					got = s.next(found)
+				}
+				if got != tt.want[i] {
+					t.Fatalf("poll %d: got %s, want %s", i+1, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestAdaptiveFetchSize(t *testing.T) {
+	a := newAdaptiveFetchSize(10, 100, 10, 0.2)
+	steps := []struct {
+		sent, failed int
+		want         int
+	}{
+		{10, 0, 100},
+		{5, 5, 50},
+		{0, 0, 50},
+		{8, 1, 60},
+		{0, 10, 30},
+		{0, 10, 15},
+		{0, 10, 10},
+	}
+	for i, step := range steps {
+		if got := a.update(step.sent, step.failed); got != step.want {
+			t.Fatalf("step %d: got %d, want %d", i+1, got, step.want)
+		}
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/ofjangra/sqsURLProducer/metrics"
+	"github.com/ofjangra/sqsURLProducer/models"
+	"gorm.io/gorm"
+)
+
+type errorDetail struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type errorResponse struct {
+	Error errorDetail `json:"error"`
+}
+
+// server holds what the HTTP handlers need to answer requests.
+type server struct {
+	settings *settings
+	// db returns the database the handlers read, app.GetDB outside tests.
+	db     func() *gorm.DB
+	region string
+	// retention is the queue's message retention period, 0 if unknown.
+	retention time.Duration
+	// sqsClient is used by the optional SQS health check.
+	sqsClient sqsAPI
+	// ready is set by the producer once its first poll has started.
+	ready *atomic.Bool
+	// lastPoll is the producer's most recent poll summary, nil before the
+	// first poll finished.
+	lastPoll *atomic.Pointer[pollSummaryLog]
+}
+
+func (s *server) routes() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", withCORS(allowMethods(s.statusHandler, http.MethodGet)))
+	mux.HandleFunc("/healthz", allowMethods(s.healthzHandler, http.MethodGet))
+	mux.HandleFunc("/ready", allowMethods(s.readyHandler, http.MethodGet))
+	mux.Handle("/metrics", metrics.Default.Handler())
+	mux.HandleFunc("/summary", allowMethods(s.summaryHandler, http.MethodGet))
+	mux.HandleFunc("/version", withCORS(allowMethods(versionHandler, http.MethodGet)))
+	mux.HandleFunc("/urls", s.requireAPIKey(allowMethods(s.urlsHandler, http.MethodGet, http.MethodPost)))
+	mux.HandleFunc("/debug/config", s.requireAPIKey(allowMethods(s.debugConfigHandler, http.MethodGet)))
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		writeJSONError(w, http.StatusNotFound, "not_found", "no route for "+r.URL.Path)
+	})
+	return mux
+}
+
+type statusResponse struct {
+	Status           string                     `json:"status"`
+	Producer         string                     `json:"producer,omitempty"`
+	URLs             map[models.URLStatus]int64 `json:"urls,omitempty"`
+	Error            string                     `json:"urls_error,omitempty"`
+	RetentionSeconds int64                      `json:"queue_retention_seconds,omitempty"`
+
+	// Tables holds the counts of each table with SOURCE_TABLES, which urls
+	// sums up.
+	Tables map[string]map[models.URLStatus]int64 `json:"tables,omitempty"`
+}
+
+// statusHandler reports that the producer is running along with the number
+// of rows in each pipeline status, over all SOURCE_TABLES. A failing count
+// query is reported in the body rather than the status code, since the
+// producer itself is still up.
+func (s *server) statusHandler(w http.ResponseWriter, r *http.Request) {
+	resp := statusResponse{Status: "SQS Producer is running", Producer: s.settings.ProducerName, RetentionSeconds: int64(s.retention / time.Second)}
+	counts, tables, err := countSources(s.db(), sourceTableNames(s.settings.SourceTables), s.settings.Marker)
+	if err != nil {
+		resp.Error = err.Error()
+	} else {
+		resp.URLs = counts
+		resp.Tables = tables
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+type probeResponse struct {
+	Status string `json:"status"`
+	// Dependencies maps each checked dependency to "ok" or its error.
+	Dependencies map[string]string `json:"dependencies,omitempty"`
+}
+
+// healthzHandler is the liveness probe: it answers as long as the process is
+// serving HTTP at all. With HEALTHCHECK_SQS it also calls GetQueueAttributes
+// on the queue, and answers 503 with the error under dependencies.sqs when
+// that fails within HEALTHCHECK_SQS_TIMEOUT.
+func (s *server) healthzHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.settings.HealthcheckSQS || s.sqsClient == nil {
+		writeJSON(w, http.StatusOK, probeResponse{Status: "ok"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), s.settings.HealthcheckSQSTimeout)
+	defer cancel()
+	if _, err := queueRetention(ctx, s.sqsClient, s.settings.QueueURL); err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, probeResponse{Status: "unhealthy", Dependencies: map[string]string{"sqs": err.Error()}})
+		return
+	}
+	writeJSON(w, http.StatusOK, probeResponse{Status: "ok", Dependencies: map[string]string{"sqs": "ok"}})
+}
+
+// readyHandler is the readiness probe. The database is connected and
+// migrated before the server starts, so readiness only waits for the
+// producer to begin its first poll.
+func (s *server) readyHandler(w http.ResponseWriter, r *http.Request) {
+	if s.ready == nil || !s.ready.Load() {
+		writeJSON(w, http.StatusServiceUnavailable, probeResponse{Status: "starting"})
+		return
+	}
+	writeJSON(w, http.StatusOK, probeResponse{Status: "ready"})
+}
+
+type summaryResponse struct {
+	MessagesSent     uint64          `json:"messages_sent"`
+	MessagesFailed   uint64          `json:"messages_failed"`
+	URLsSkipped      uint64          `json:"urls_skipped"`
+	URLsPending      int64           `json:"urls_pending"`
+	DBUpdateFailures uint64          `json:"db_update_failures"`
+	ProducerPanics   uint64          `json:"producer_panics"`
+	LastPoll         *pollSummaryLog `json:"last_poll"`
+}
+
+// summaryHandler reports the main counters of /metrics as JSON, for setups
+// without a Prometheus scraper. Counts are totals since the process started;
+// urls_pending is as of the last stats refresh.
+func (s *server) summaryHandler(w http.ResponseWriter, r *http.Request) {
+	resp := summaryResponse{
+		MessagesSent:     messagesSent.Value(),
+		MessagesFailed:   messagesFailed.Value(),
+		URLsSkipped:      urlsSkipped.Value(),
+		URLsPending:      int64(urlsPending.Value()),
+		DBUpdateFailures: dbUpdateFailures.Value(),
+		ProducerPanics:   producerPanics.Value(),
+	}
+	if s.lastPoll != nil {
+		resp.LastPoll = s.lastPoll.Load()
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, versionResponse{Version: Version, Commit: Commit, BuildTime: BuildTime})
+}
+
+// debugConfig is the effective configuration reported by /debug/config.
+// Secrets are only reported as set or not set.
+type debugConfig struct {
+	QueueURL            string `json:"queue_url"`
+	Region              string `json:"region"`
+	Port                string `json:"port"`
+	ListenAddr          string `json:"listen_addr"`
+	BatchSize           int    `json:"batch_size"`
+	FetchLimit          int    `json:"fetch_limit"`
+	FetchChunkSize      int    `json:"fetch_chunk_size"`
+	PollInterval        string `json:"poll_interval"`
+	RetryAttempts       int    `json:"retry_attempts"`
+	RetryBackoff        string `json:"retry_backoff"`
+	RunMode             string `json:"run_mode"`
+	DeliverySemantics   string `json:"delivery_semantics"`
+	DedupScope          string `json:"dedup_scope"`
+	ClaimTimeout        string `json:"claim_timeout"`
+	PollDeadline        string `json:"poll_deadline"`
+	EmptyPollThreshold  int    `json:"empty_poll_threshold"`
+	EmptyPollBackoffMax string `json:"empty_poll_backoff_max"`
+	FailureWebhookURL   string `json:"failure_webhook_url"`
+	AWSProfile          string `json:"aws_profile"`
+	IAMAccessKey        string `json:"iam_access_key"`
+	IAMSecret           string `json:"iam_secret"`
+	DBHost              string `json:"db_host"`
+	DBName              string `json:"db_name"`
+	DBUser              string `json:"db_user"`
+	DBPassword          string `json:"db_password"`
+	APIKey              string `json:"api_key"`
+}
+
+func (s *server) debugConfigHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, debugConfig{
+		QueueURL:            s.settings.QueueURL,
+		Region:              s.region,
+		Port:                s.settings.Port,
+		ListenAddr:          s.settings.ListenAddr,
+		BatchSize:           s.settings.BatchSize,
+		FetchLimit:          s.settings.FetchLimit,
+		FetchChunkSize:      s.settings.FetchChunkSize,
+		PollInterval:        s.settings.IdlePollInterval.String(),
+		RetryAttempts:       RetryAttempts,
+		RetryBackoff:        RetryBackoff.String(),
+		RunMode:             string(s.settings.RunMode),
+		DeliverySemantics:   string(s.settings.Semantics),
+		DedupScope:          string(s.settings.DedupScope),
+		ClaimTimeout:        s.settings.ClaimTimeout.String(),
+		PollDeadline:        s.settings.PollDeadline.String(),
+		EmptyPollThreshold:  s.settings.EmptyPollThreshold,
+		EmptyPollBackoffMax: s.settings.EmptyPollBackoffMax.String(),
+		FailureWebhookURL:   redact(s.settings.FailureWebhookURL),
+		AWSProfile:          os.Getenv("AWS_PROFILE"),
+		IAMAccessKey:        redact(cmp.Or(os.Getenv("IAM_ACCESS_KEY_FILE"), os.Getenv("IAM_ACCESS_KEY"))),
+		IAMSecret:           redact(cmp.Or(os.Getenv("IAM_SECRET_FILE"), os.Getenv("IAM_SECRET"))),
+		DBHost:              os.Getenv("DB_HOST"),
+		DBName:              os.Getenv("DB_NAME"),
+		DBUser:              os.Getenv("DB_USER"),
+		DBPassword:          redact(os.Getenv("DB_PASSWORD")),
+		APIKey:              redact(s.settings.APIKey),
+	})
+}
+
+// redact hides a secret value while still showing whether it is set.
+func redact(value string) string {
+	if value == "" {
+		return ""
+	}
+	return "[redacted]"
+}
+
+// requireAPIKey only lets requests through that present the configured
+// API_KEY in the X-API-Key header. Without an API_KEY the guarded endpoints
+// are disabled entirely.
+func (s *server) requireAPIKey(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.settings.APIKey == "" {
+			writeJSONError(w, http.StatusForbidden, "disabled", "set API_KEY to enable this endpoint")
+			return
+		}
+		key := r.Header.Get("X-API-Key")
+		if subtle.ConstantTimeCompare([]byte(key), []byte(s.settings.APIKey)) != 1 {
+			writeJSONError(w, http.StatusUnauthorized, "unauthorized", "missing or invalid X-API-Key header")
+			return
+		}
+		next(w, r)
+	}
+}
+
+func withCORS(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// allowMethods rejects requests whose method is not in methods with a 405.
+func allowMethods(next http.HandlerFunc, methods ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		for _, m := range methods {
+			if r.Method == m {
+				next(w, r)
+				return
+			}
+		}
+		w.Header().Set("Allow", strings.Join(methods, ", "))
+		writeJSONError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method "+r.Method+" is not allowed")
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Failed to write response: %v", err)
+	}
+}
+
+// writeJSONError writes the error envelope shared by all handlers:
+// {"error": {"code": "...", "message": "..."}}
+func writeJSONError(w http.ResponseWriter, status int, code, msg string) {
+	writeJSON(w, status, errorResponse{Error: errorDetail{Code: code, Message: msg}})
+}
+
+// listen opens the HTTP server's listener on addr, a host:port, or
+// unix:// followed by a socket path for sidecars that share a volume rather
+// than a network. A socket left behind by a process that did not shut down
+// cleanly is removed first, one still answering is not. The listener
+// removes its socket again when it is closed on shutdown.
+func listen(addr string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, "unix://")
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("unix socket %s is in use by another process", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("removing stale unix socket: %w", err)
+		}
+	}
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,481 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ofjangra/sqsURLProducer/models"
+	"gorm.io/gorm"
+)
+
+// serve sends a request for target through the server's routes.
+func serve(s *server, method, target string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, nil)
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	rec := httptest.NewRecorder()
+	s.routes().ServeHTTP(rec, req)
+	return rec
+}
+
+func TestDebugConfigHandler(t *testing.T) {
+	tests := []struct {
+		name   string
+		apiKey string
+		header http.Header
+		code   int
+	}{
+		{"disabled without API_KEY", "", nil, http.StatusForbidden},
+		{"missing key", "secret", nil, http.StatusUnauthorized},
+		{"wrong key", "secret", http.Header{"X-Api-Key": {"guess"}}, http.StatusUnauthorized},
+		{"valid key", "secret", http.Header{"X-Api-Key": {"secret"}}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &server{settings: &settings{
+				QueueURL:          testQueueURL,
+				APIKey:            tt.apiKey,
+				RunMode:           RunOnce,
+				Semantics:         AtLeastOnce,
+				FailureWebhookURL: "https://hooks.example.com/token",
+			}}
+			rec := serve(s, http.MethodGet, "/debug/config", tt.header)
+			if rec.Code != tt.code {
+				t.Fatalf("got status %d, want %d: %s", rec.Code, tt.code, rec.Body)
+			}
+			if tt.code != http.StatusOK {
+				return
+			}
+			var got debugConfig
+			if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			if got.RunMode != string(RunOnce) || got.QueueURL != testQueueURL {
+				t.Errorf("got run_mode %q and queue_url %q, want %q and %q", got.RunMode, got.QueueURL, RunOnce, testQueueURL)
+			}
+			if got.APIKey != "[redacted]" || got.FailureWebhookURL != "[redacted]" {
+				t.Errorf("want secrets redacted, got api_key %q and failure_webhook_url %q", got.APIKey, got.FailureWebhookURL)
+			}
+		})
+	}
+}
+
+func TestJSONErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		target string
+		code   int
+		error  string
+		allow  string
+	}{
+		{"unknown route", http.MethodGet, "/nowhere", http.StatusNotFound, "not_found", ""},
+		{"wrong method", http.MethodPost, "/version", http.StatusMethodNotAllowed, "method_not_allowed", "GET"},
+		{"guarded without API_KEY", http.MethodGet, "/urls", http.StatusForbidden, "disabled", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := serve(&server{settings: &settings{}}, tt.method, tt.target, nil)
+			if rec.Code != tt.code {
+				t.Fatalf("got status %d, want %d", rec.Code, tt.code)
+			}
+			if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+				t.Errorf("got Content-Type %q, want application/json", ct)
+			}
+			if allow := rec.Header().Get("Allow"); allow != tt.allow {
+				t.Errorf("got Allow %q, want %q", allow, tt.allow)
+			}
+			var got errorResponse
+			if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			if got.Error.Code != tt.error || got.Error.Message == "" {
+				t.Errorf("got error %+v, want code %q with a message", got.Error, tt.error)
+			}
+		})
+	}
+}
+
+func TestVersionHandler(t *testing.T) {
+	rec := serve(&server{settings: &settings{}}, http.MethodGet, "/version", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, want 200", rec.Code)
+	}
+	var got versionResponse
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got != (versionResponse{Version: Version, Commit: Commit, BuildTime: BuildTime}) {
+		t.Errorf("got %+v, want the build info", got)
+	}
+	if origin := rec.Header().Get("Access-Control-Allow-Origin"); origin != "*" {
+		t.Errorf("got Access-Control-Allow-Origin %q, want *", origin)
+	}
+}
+
+func TestReadyHandler(t *testing.T) {
+	tests := []struct {
+		name   string
+		ready  *atomic.Bool
+		code   int
+		status string
+	}{
+		{"before the producer starts", nil, http.StatusServiceUnavailable, "starting"},
+		{"before the first poll", &atomic.Bool{}, http.StatusServiceUnavailable, "starting"},
+		{"after the first poll started", readyFlag(), http.StatusOK, "ready"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := serve(&server{settings: &settings{}, ready: tt.ready}, http.MethodGet, "/ready", nil)
+			if rec.Code != tt.code {
+				t.Fatalf("got status %d, want %d", rec.Code, tt.code)
+			}
+			var got probeResponse
+			if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			if got.Status != tt.status {
+				t.Errorf("got status %q, want %q", got.Status, tt.status)
+			}
+		})
+	}
+}
+
+func readyFlag() *atomic.Bool {
+	ready := &atomic.Bool{}
+	ready.Store(true)
+	return ready
+}
+
+func TestSummaryHandler(t *testing.T) {
+	p := newTestProducer(nil, &fakeSQS{})
+	p.recordPoll(ProcessResult{Fetched: 3, Sent: 2, Failed: 1, BatchesSucceeded: 1}, time.Second, nil)
+
+	rec := serve(&server{settings: &settings{}, lastPoll: &p.lastPoll}, http.MethodGet, "/summary", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, want 200", rec.Code)
+	}
+	var got summaryResponse
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got.MessagesSent != messagesSent.Value() || got.MessagesFailed != messagesFailed.Value() || got.MessagesSent < 2 {
+		t.Errorf("got %d sent and %d failed, want the counters %d and %d", got.MessagesSent, got.MessagesFailed, messagesSent.Value(), messagesFailed.Value())
+	}
+	if got.LastPoll == nil || got.LastPoll.Fetched != 3 || got.LastPoll.Sent != 2 || got.LastPoll.Failed != 1 {
+		t.Errorf("got last poll %+v, want the poll just recorded", got.LastPoll)
+	}
+}
+
+func TestSummaryStatusCounts(t *testing.T) {
+	db := testDB(t, "urls_news")
+	insertRows(t, db, "urls", pending, sent, pending, failed)
+	insertRows(t, db, "urls_news", pending, claimed, sent)
+	marker := processedMarker{kind: MarkerStatus, column: "status"}
+	p := newTestProducer(db, &fakeSQS{})
+	p.sources = []string{"urls", "urls_news"}
+	p.refreshStats(db)
+
+	s := &server{
+		settings: &settings{SourceTables: p.sources, Marker: marker},
+		db:       func() *gorm.DB { return db },
+		lastPoll: &p.lastPoll,
+	}
+	rec := serve(s, http.MethodGet, "/summary", nil)
+	var summary summaryResponse
+	if err := json.NewDecoder(rec.Body).Decode(&summary); err != nil {
+		t.Fatal(err)
+	}
+	if summary.URLsPending != 3 {
+		t.Errorf("got urls_pending %d, want the 3 pending rows of both tables", summary.URLsPending)
+	}
+
+	rec = serve(s, http.MethodGet, "/status", nil)
+	var status statusResponse
+	if err := json.NewDecoder(rec.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	want := map[models.URLStatus]int64{pending: 3, claimed: 1, sent: 2, failed: 1}
+	if status.Error != "" || !maps.Equal(status.URLs, want) {
+		t.Errorf("got counts %v (%s), want %v", status.URLs, status.Error, want)
+	}
+	if news := status.Tables["urls_news"]; news[pending] != 1 || news[claimed] != 1 || news[sent] != 1 {
+		t.Errorf("got counts %v for urls_news, want one pending, claimed and sent", news)
+	}
+}
+
+func TestHealthzHandler(t *testing.T) {
+	tests := []struct {
+		name    string
+		check   bool
+		client  sqsAPI
+		code    int
+		depends map[string]string
+	}{
+		{"without the SQS check", false, &fakeSQS{attributesErr: errors.New("unreachable")}, http.StatusOK, nil},
+		{"SQS reachable", true, &fakeSQS{}, http.StatusOK, map[string]string{"sqs": "ok"}},
+		{"SQS unreachable", true, &fakeSQS{attributesErr: errors.New("unreachable")}, http.StatusServiceUnavailable, map[string]string{"sqs": "unreachable"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &server{
+				settings:  &settings{QueueURL: testQueueURL, HealthcheckSQS: tt.check, HealthcheckSQSTimeout: time.Second},
+				sqsClient: tt.client,
+			}
+			rec := serve(s, http.MethodGet, "/healthz", nil)
+			if rec.Code != tt.code {
+				t.Fatalf("got status %d, want %d", rec.Code, tt.code)
+			}
+			var got probeResponse
+			if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			if !maps.Equal(got.Dependencies, tt.depends) {
+				t.Errorf("got dependencies %v, want %v", got.Dependencies, tt.depends)
+			}
+		})
+	}
+}
+
+func TestURLsTableParameter(t *testing.T) {
+	tests := []struct {
+		name    string
+		sources []string
+		target  string
+	}{
+		{"table without SOURCE_TABLES", nil, "/urls?table=urls"},
+		{"table not among SOURCE_TABLES", []string{"urls", "urls_news"}, "/urls?table=users"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &server{settings: &settings{APIKey: "secret", SourceTables: tt.sources}}
+			for _, method := range []string{http.MethodGet, http.MethodPost} {
+				rec := serve(s, method, tt.target, http.Header{"X-Api-Key": {"secret"}})
+				if rec.Code != http.StatusBadRequest {
+					t.Errorf("%s: got status %d, want 400: %s", method, rec.Code, rec.Body)
+				}
+			}
+		})
+	}
+}
+
+func TestListURLs(t *testing.T) {
+	db := testDB(t)
+	insertRows(t, db, "urls", pending, sent, pending, failed, pending)
+	s := &server{
+		settings: &settings{APIKey: "secret", Marker: processedMarker{kind: MarkerStatus, column: "status"}},
+		db:       func() *gorm.DB { return db },
+	}
+
+	tests := []struct {
+		name   string
+		query  string
+		total  int64
+		limit  int
+		ids    []uint
+		status int
+	}{
+		{"first page", "?limit=2", 5, 2, []uint{1, 2}, http.StatusOK},
+		{"next page", "?limit=2&offset=2", 5, 2, []uint{3, 4}, http.StatusOK},
+		{"last page", "?limit=2&offset=4", 5, 2, []uint{5}, http.StatusOK},
+		{"past the end", "?offset=10", 5, DefaultURLsPageSize, nil, http.StatusOK},
+		{"status filter", "?status=pending&limit=2&offset=1", 3, 2, []uint{3, 5}, http.StatusOK},
+		{"limit capped", "?limit=100000", 5, MaxURLsPageSize, []uint{1, 2, 3, 4, 5}, http.StatusOK},
+		{"unknown status", "?status=done", 0, 0, nil, http.StatusBadRequest},
+		{"negative offset", "?offset=-1", 0, 0, nil, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := serve(s, http.MethodGet, "/urls"+tt.query, http.Header{"X-Api-Key": {"secret"}})
+			if rec.Code != tt.status {
+				t.Fatalf("got status %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			var page urlsPage
+			if err := json.NewDecoder(rec.Body).Decode(&page); err != nil {
+				t.Fatal(err)
+			}
+			var ids []uint
+			for _, u := range page.URLs {
+				ids = append(ids, u.ID)
+			}
+			if page.Total != tt.total || page.Limit != tt.limit || !slices.Equal(ids, tt.ids) {
+				t.Errorf("got total %d, limit %d and ids %v, want %d, %d and %v", page.Total, page.Limit, ids, tt.total, tt.limit, tt.ids)
+			}
+		})
+	}
+}
+
+// postURLs sends body to POST /urls through the server's routes.
+func postURLs(s *server, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/urls", strings.NewReader(body))
+	req.Header.Set("X-Api-Key", "secret")
+	rec := httptest.NewRecorder()
+	s.routes().ServeHTTP(rec, req)
+	return rec
+}
+
+// urlsBody returns a POST /urls body adding urls.
+func urlsBody(urls ...string) string {
+	rows := make([]newURL, len(urls))
+	for i, url := range urls {
+		rows[i] = newURL{URL: url}
+	}
+	body, _ := json.Marshal(rows)
+	return string(body)
+}
+
+func TestCreateURLs(t *testing.T) {
+	tests := []struct {
+		name   string
+		unique bool
+		// results are what the second request, adding url-b and url-c
+		// after url-a and url-b, inserted and skipped.
+		inserted, duplicates int64
+		urls                 []string
+	}{
+		{"with URL_UNIQUE_INDEX", true, 1, 1, []string{"url-a", "url-b", "url-c"}},
+		{"without URL_UNIQUE_INDEX", false, 2, 0, []string{"url-a", "url-b", "url-b", "url-c"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := testDB(t)
+			if tt.unique {
+				execSQL(t, db, "CREATE UNIQUE INDEX idx_urls_url_unique ON urls (url)")
+			}
+			s := &server{
+				settings: &settings{APIKey: "secret", Marker: processedMarker{kind: MarkerStatus, column: "status"}},
+				db:       func() *gorm.DB { return db },
+			}
+
+			var results []insertResult
+			for _, body := range []string{urlsBody("url-a", "url-b"), urlsBody("url-b", "url-c")} {
+				rec := postURLs(s, body)
+				if rec.Code != http.StatusOK {
+					t.Fatalf("got status %d, want 200: %s", rec.Code, rec.Body)
+				}
+				var result insertResult
+				if err := json.NewDecoder(rec.Body).Decode(&result); err != nil {
+					t.Fatal(err)
+				}
+				results = append(results, result)
+			}
+			if results[0] != (insertResult{Inserted: 2}) {
+				t.Errorf("got %+v for the first request, want 2 inserted", results[0])
+			}
+			if want := (insertResult{Inserted: tt.inserted, Duplicates: tt.duplicates}); results[1] != want {
+				t.Errorf("got %+v for the second request, want %+v", results[1], want)
+			}
+			var urls []string
+			if err := db.Model(&models.URLs{}).Order("id").Pluck("url", &urls).Error; err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(urls, tt.urls) {
+				t.Errorf("got rows %q, want %q", urls, tt.urls)
+			}
+		})
+	}
+}
+
+func TestCreateURLsLimits(t *testing.T) {
+	many := make([]string, MaxURLsPerInsert+1)
+	for i := range many {
+		many[i] = fmt.Sprintf("url-%d", i)
+	}
+	tests := []struct {
+		name    string
+		body    string
+		status  int
+		message string
+	}{
+		{"no URLs", "[]", http.StatusBadRequest, "between 1 and 500 URLs"},
+		{"most URLs per request", urlsBody(many[:MaxURLsPerInsert]...), http.StatusOK, ""},
+		{"too many URLs", urlsBody(many...), http.StatusBadRequest, "between 1 and 500 URLs"},
+		{"largest body", urlsBody(strings.Repeat("a", MaxURLsRequestBytes-len(urlsBody("")))), http.StatusOK, ""},
+		{"body too large", urlsBody(strings.Repeat("a", MaxURLsRequestBytes-len(urlsBody(""))+1)), http.StatusBadRequest, "request body too large"},
+		{"empty URL", urlsBody("url-1", " "), http.StatusBadRequest, "URL 1 is empty"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := dryRunDB(t, nil)
+			s := &server{
+				settings: &settings{APIKey: "secret", Marker: processedMarker{kind: MarkerStatus, column: "status"}},
+				db:       func() *gorm.DB { return db },
+			}
+			rec := postURLs(s, tt.body)
+			if rec.Code != tt.status {
+				t.Fatalf("got status %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			if !strings.Contains(rec.Body.String(), tt.message) {
+				t.Errorf("got %s, want it to contain %q", rec.Body, tt.message)
+			}
+		})
+	}
+}
+
+// unixClient returns an HTTP client that connects to the socket at path.
+func unixClient(path string) *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		},
+	}}
+}
+
+func TestListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "producer.sock")
+	// A socket left behind by a process that was killed is replaced.
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	ln, err := listen("unix://" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: (&server{settings: &settings{}}).routes()}
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(ln) }()
+
+	resp, err := unixClient(path).Get("http://producer/version")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("got status %d over the socket, want 200", resp.StatusCode)
+	}
+	if _, err := listen("unix://" + path); err == nil || !strings.Contains(err.Error(), "in use by another process") {
+		t.Errorf("got %v listening on a socket in use, want it refused", err)
+	}
+
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-served; !errors.Is(err, http.ErrServerClosed) {
+		t.Errorf("got %v from Serve, want http.ErrServerClosed", err)
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("want the socket removed on shutdown, got %v", err)
+	}
+}
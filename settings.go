@@ -0,0 +1,447 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// settings is the configuration read from the environment at startup.
+type settings struct {
+	QueueURL            string
+	ErrorQueueURL       string
+	NotifyQueueURL      string
+	NotifyMode          NotifyMode
+	QueueRate           float64
+	ErrorQueueRate      float64
+	NotifyQueueRate     float64
+	Port                string
+	ListenAddr          string
+	ProducerName        string
+	APIKey              string
+	BatchSize           int
+	FetchLimit          int
+	FetchChunkSize      int
+	MaxFetchBytes       int
+	UpdateChunkSize     int
+	FetchFilter         fetchFilter
+	Semantics           DeliverySemantics
+	BatchStatusUpdate   bool
+	TransactionScope    TransactionScope
+	StrictPoll          bool
+	Marker              processedMarker
+	DedupScope          DedupScope
+	GroupStrategy       GroupStrategy
+	GroupSkewWarn       float64
+	GroupBuckets        int
+	EntryRetryDelay     time.Duration
+	RetryBudget         time.Duration
+	ClaimTimeout        time.Duration
+	LockTimeout         time.Duration
+	PollDeadline        time.Duration
+	StartupJitter       time.Duration
+	MinBatchSize        int
+	MinBatchMaxWait     time.Duration
+	BusyPollInterval    time.Duration
+	IdlePollInterval    time.Duration
+	EmptyPollThreshold  int
+	EmptyPollBackoffMax time.Duration
+	DBErrorBackoffMax   time.Duration
+	DBPingInterval      time.Duration
+	SequenceAttribute   bool
+	BatchPositions      bool
+	ProducerID          string
+	SourceHost          string
+	SourceNode          string
+	MessageTags         map[string]string
+	BodyPrefix          string
+	BodySuffix          string
+	MaxMessageBytes     int
+	OversizePolicy      OversizePolicy
+	ExitOnPanic         bool
+	SendOnly            bool
+	PurgeOnStart        bool
+	EntryIDPrefix       string
+	SourceTables        []string
+	StoreMessageID      bool
+	CorrelationID       bool
+	StoreCorrelationID  bool
+	PoisonPolls         int
+	PoisonWindow        time.Duration
+	LogLevel            LogLevel
+	WaitForDeps         time.Duration
+	ShutdownTimeout     time.Duration
+	StatsInterval       time.Duration
+	StrictConfig        bool
+	RunMode             RunMode
+	SendMode            SendMode
+
+	MaxMessagesPerInterval int
+	RetentionWarnThreshold time.Duration
+	ScheduleProcessingTime time.Duration
+
+	AdaptiveFetch          bool
+	AdaptiveFetchMin       int
+	AdaptiveFetchStep      int
+	AdaptiveFetchThreshold float64
+
+	FailureWebhookURL      string
+	FailureWebhookDebounce time.Duration
+
+	AuditSink AuditSink
+	AuditFile string
+
+	HealthcheckSQS        bool
+	HealthcheckSQSTimeout time.Duration
+}
+
+func loadSettings(queueURL string) *settings {
+	s := &settings{
+		QueueURL:            queueURL,
+		ErrorQueueURL:       os.Getenv("ERROR_QUEUE_URL"),
+		NotifyQueueURL:      os.Getenv("NOTIFY_QUEUE_URL"),
+		Port:                os.Getenv("PORT"),
+		ListenAddr:          os.Getenv("LISTEN_ADDR"),
+		ProducerName:        os.Getenv("PRODUCER_NAME"),
+		APIKey:              os.Getenv("API_KEY"),
+		BatchSize:           getEnvInt("SQS_BATCH_SIZE", BatchSize),
+		FetchLimit:          getEnvInt("DB_FETCH_LIMIT", DatabaseLimit),
+		FetchChunkSize:      getEnvInt("DB_FETCH_CHUNK_SIZE", FetchChunkSize),
+		MaxFetchBytes:       getEnvInt("MAX_FETCH_BYTES", 0),
+		UpdateChunkSize:     getEnvInt("DB_UPDATE_CHUNK_SIZE", StatusUpdateChunkSize),
+		BatchStatusUpdate:   getEnvBool("BATCH_STATUS_UPDATE", false),
+		EntryRetryDelay:     getEnvDuration("ENTRY_RETRY_DELAY", time.Minute),
+		GroupSkewWarn:       getEnvFloat("GROUP_SKEW_WARN", 0),
+		GroupBuckets:        getEnvInt("GROUP_BUCKETS", 16),
+		RetryBudget:         getEnvDuration("BATCH_RETRY_BUDGET", 0),
+		ClaimTimeout:        getEnvDuration("CLAIM_TIMEOUT", 5*time.Minute),
+		LockTimeout:         getEnvDuration("DB_LOCK_TIMEOUT", 0),
+		PollDeadline:        getEnvDuration("POLL_DEADLINE", 0),
+		StartupJitter:       getEnvDuration("STARTUP_JITTER", 0),
+		MinBatchSize:        getEnvInt("MIN_BATCH_SIZE", 0),
+		MinBatchMaxWait:     getEnvDuration("MIN_BATCH_MAX_WAIT", time.Minute),
+		BusyPollInterval:    getEnvDuration("BUSY_POLL_INTERVAL", PollingInterval),
+		IdlePollInterval:    getEnvDuration("IDLE_POLL_INTERVAL", PollingInterval),
+		EmptyPollThreshold:  getEnvInt("EMPTY_POLL_THRESHOLD", 3),
+		EmptyPollBackoffMax: getEnvDuration("EMPTY_POLL_BACKOFF_MAX", PollingInterval),
+		DBErrorBackoffMax:   getEnvDuration("DB_ERROR_BACKOFF_MAX", 5*time.Minute),
+		DBPingInterval:      getEnvDuration("DB_PING_INTERVAL", 0),
+		SequenceAttribute:   getEnvBool("SEQUENCE_ATTRIBUTE", false),
+		BatchPositions:      getEnvBool("BATCH_POSITION_ATTRIBUTES", false),
+		BodyPrefix:          os.Getenv("BODY_PREFIX"),
+		BodySuffix:          os.Getenv("BODY_SUFFIX"),
+		MaxMessageBytes:     getEnvInt("MAX_MESSAGE_BYTES", MaxSQSMessageBytes),
+		ExitOnPanic:         getEnvBool("EXIT_ON_PANIC", false),
+		SendOnly:            getEnvBool("SEND_ONLY", false),
+		StrictPoll:          getEnvBool("STRICT_POLL", false),
+		PurgeOnStart:        getEnvBool("PURGE_ON_START", false),
+		EntryIDPrefix:       os.Getenv("ENTRY_ID_PREFIX"),
+		StoreMessageID:      getEnvBool("STORE_MESSAGE_ID", false),
+		CorrelationID:       getEnvBool("CORRELATION_ID", false),
+		StoreCorrelationID:  getEnvBool("STORE_CORRELATION_ID", false),
+		PoisonPolls:         getEnvInt("POISON_POLLS", 0),
+		PoisonWindow:        getEnvDuration("POISON_WINDOW", time.Hour),
+		WaitForDeps:         getEnvDuration("WAIT_FOR_DEPS", 0),
+		ShutdownTimeout:     getEnvDuration("SHUTDOWN_TIMEOUT", 30*time.Second),
+		StatsInterval:       getEnvDuration("STATS_INTERVAL", 30*time.Second),
+		StrictConfig:        getEnvBool("STRICT_CONFIG", false),
+
+		MaxMessagesPerInterval: getEnvInt("MAX_MESSAGES_PER_INTERVAL", 0),
+		RetentionWarnThreshold: getEnvDuration("RETENTION_WARN_THRESHOLD", 24*time.Hour),
+		ScheduleProcessingTime: getEnvDuration("SCHEDULE_PROCESSING_TIME", 0),
+
+		AdaptiveFetch:          getEnvBool("ADAPTIVE_FETCH", false),
+		AdaptiveFetchMin:       getEnvInt("ADAPTIVE_FETCH_MIN", BatchSize),
+		AdaptiveFetchStep:      getEnvInt("ADAPTIVE_FETCH_STEP", BatchSize),
+		AdaptiveFetchThreshold: getEnvFloat("ADAPTIVE_FETCH_FAILURE_RATE", 0.2),
+
+		FailureWebhookURL:      os.Getenv("FAILURE_WEBHOOK_URL"),
+		FailureWebhookDebounce: getEnvDuration("FAILURE_WEBHOOK_DEBOUNCE", time.Minute),
+
+		AuditFile: getEnvDefault("AUDIT_FILE", "dispatch_audit.log"),
+
+		HealthcheckSQS:        getEnvBool("HEALTHCHECK_SQS", false),
+		HealthcheckSQSTimeout: getEnvDuration("HEALTHCHECK_SQS_TIMEOUT", 2*time.Second),
+	}
+
+	if getEnvBool("PRODUCER_ID_ATTRIBUTE", false) {
+		s.ProducerID = producerInstanceID()
+		log.Printf("Tagging messages with producer_id %q", s.ProducerID)
+	}
+	if getEnvBool("SOURCE_ATTRIBUTES", false) {
+		s.SourceHost, s.SourceNode = sourceHost(), os.Getenv("NODE_NAME")
+		log.Printf("Tagging messages with source_host %q and source_node %q", s.SourceHost, s.SourceNode)
+	}
+
+	if s.ListenAddr == "" {
+		s.ListenAddr = ":" + getEnv("PORT")
+	} else if s.Port != "" {
+		s.warn("PORT has no effect with LISTEN_ADDR set, listening on %s", s.ListenAddr)
+	}
+	if s.PoisonPolls < 0 || s.PoisonWindow <= 0 {
+		log.Fatal("POISON_POLLS must not be negative and POISON_WINDOW must be positive")
+	}
+	if s.StoreCorrelationID && !s.CorrelationID {
+		log.Fatal("STORE_CORRELATION_ID requires CORRELATION_ID")
+	}
+	if s.PurgeOnStart && os.Getenv("ALLOW_PURGE") != "yes" {
+		// A purge cannot be undone, so a PURGE_ON_START copied into a
+		// production environment must not be enough on its own.
+		log.Fatalf("REFUSING TO START: PURGE_ON_START would delete every message on %s; set ALLOW_PURGE=yes as well if this really is a test queue", s.QueueURL)
+	}
+	if s.SendOnly {
+		log.Println("WARNING: SEND_ONLY is set, URLs are sent without ever being marked sent or failed, so every poll sends all pending URLs again. Only point this at a test queue.")
+	}
+	if strings.ContainsFunc(s.ProducerName, unicode.IsSpace) {
+		log.Fatalf("PRODUCER_NAME must not contain whitespace, got %q", s.ProducerName)
+	}
+	if s.BatchSize < 1 {
+		log.Fatalf("SQS_BATCH_SIZE must be at least 1, got %d", s.BatchSize)
+	}
+	if s.BatchSize > MaxSQSBatchEntries {
+		log.Printf("SQS_BATCH_SIZE %d exceeds the SQS limit of %d, batches will be split into requests of %d", s.BatchSize, MaxSQSBatchEntries, MaxSQSBatchEntries)
+	}
+
+	if s.BusyPollInterval <= 0 || s.IdlePollInterval <= 0 {
+		log.Fatalf("BUSY_POLL_INTERVAL and IDLE_POLL_INTERVAL must be positive, got %s and %s", s.BusyPollInterval, s.IdlePollInterval)
+	}
+	if s.MinBatchSize < 0 || s.MinBatchSize > s.BatchSize {
+		log.Fatalf("MIN_BATCH_SIZE must be between 0 and SQS_BATCH_SIZE %d, got %d", s.BatchSize, s.MinBatchSize)
+	}
+	if s.MaxFetchBytes < 0 {
+		log.Fatalf("MAX_FETCH_BYTES must not be negative, got %d", s.MaxFetchBytes)
+	}
+	if s.FetchLimit < 1 || s.FetchChunkSize < 1 || s.UpdateChunkSize < 1 {
+		log.Fatalf("DB_FETCH_LIMIT, DB_FETCH_CHUNK_SIZE and DB_UPDATE_CHUNK_SIZE must be at least 1, got %d, %d and %d", s.FetchLimit, s.FetchChunkSize, s.UpdateChunkSize)
+	}
+	if s.MaxMessagesPerInterval < 0 {
+		log.Fatalf("MAX_MESSAGES_PER_INTERVAL must not be negative, got %d", s.MaxMessagesPerInterval)
+	}
+	if s.MaxMessageBytes < 1 || s.MaxMessageBytes > MaxSQSMessageBytes {
+		log.Fatalf("MAX_MESSAGE_BYTES must be between 1 and the SQS limit of %d, got %d", MaxSQSMessageBytes, s.MaxMessageBytes)
+	}
+	if len(s.BodyPrefix)+len(s.BodySuffix) >= s.MaxMessageBytes {
+		log.Fatalf("BODY_PREFIX and BODY_SUFFIX are %d bytes together, leaving no room for a URL within MAX_MESSAGE_BYTES of %d", len(s.BodyPrefix)+len(s.BodySuffix), s.MaxMessageBytes)
+	}
+	if err := validMessageText(s.BodyPrefix + s.BodySuffix); err != nil {
+		log.Fatalf("BODY_PREFIX and BODY_SUFFIX must only hold characters SQS accepts: %v", err)
+	}
+	if s.AdaptiveFetch && (s.AdaptiveFetchMin < 1 || s.AdaptiveFetchMin > s.FetchLimit || s.AdaptiveFetchStep < 1) {
+		log.Fatalf("ADAPTIVE_FETCH_MIN must be between 1 and DB_FETCH_LIMIT (%d) and ADAPTIVE_FETCH_STEP at least 1", s.FetchLimit)
+	}
+	if s.GroupSkewWarn < 0 || s.GroupSkewWarn > 1 {
+		log.Fatalf("GROUP_SKEW_WARN must be between 0 and 1, got %g", s.GroupSkewWarn)
+	}
+	if s.LockTimeout < 0 || (s.LockTimeout > 0 && s.LockTimeout < time.Millisecond) {
+		log.Fatalf("DB_LOCK_TIMEOUT must be unset or at least 1ms, got %s", s.LockTimeout)
+	}
+	if s.HealthcheckSQS && s.HealthcheckSQSTimeout <= 0 {
+		log.Fatalf("HEALTHCHECK_SQS_TIMEOUT must be positive, got %s", s.HealthcheckSQSTimeout)
+	}
+	if s.ScheduleProcessingTime < 0 {
+		log.Fatalf("SCHEDULE_PROCESSING_TIME must not be negative, got %s", s.ScheduleProcessingTime)
+	}
+	if s.RetryBudget < 0 {
+		log.Fatalf("BATCH_RETRY_BUDGET must not be negative, got %s", s.RetryBudget)
+	}
+	if s.PollDeadline >= s.ClaimTimeout {
+		s.warn("POLL_DEADLINE %s is not below CLAIM_TIMEOUT %s, a slow poll's claims may be recovered while it is still sending", s.PollDeadline, s.ClaimTimeout)
+	}
+
+	var err error
+	if s.RunMode, err = parseRunMode(getEnvDefault("RUN_MODE", string(RunService))); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	if s.SendMode, err = parseSendMode(getEnvDefault("SEND_MODE", string(SendShared))); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	if s.QueueRate = getEnvFloat(rateEnvKey(s.QueueURL), 0); s.QueueRate < 0 {
+		log.Fatalf("%s must not be negative, got %g", rateEnvKey(s.QueueURL), s.QueueRate)
+	}
+	if s.ErrorQueueURL != "" {
+		if s.ErrorQueueRate = getEnvFloat(rateEnvKey(s.ErrorQueueURL), 0); s.ErrorQueueRate < 0 {
+			log.Fatalf("%s must not be negative, got %g", rateEnvKey(s.ErrorQueueURL), s.ErrorQueueRate)
+		}
+	}
+	if s.NotifyQueueURL != "" {
+		if s.NotifyQueueRate = getEnvFloat(rateEnvKey(s.NotifyQueueURL), 0); s.NotifyQueueRate < 0 {
+			log.Fatalf("%s must not be negative, got %g", rateEnvKey(s.NotifyQueueURL), s.NotifyQueueRate)
+		}
+	}
+	if s.NotifyMode, err = parseNotifyMode(getEnvDefault("NOTIFY_MODE", string(NotifyPerURL))); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	if s.NotifyQueueURL == s.QueueURL {
+		log.Fatal("NOTIFY_QUEUE_URL must not be SQS_URL, every notification would be delivered as a URL")
+	}
+	if s.SendMode == SendPerQueue && s.ErrorQueueURL == "" && s.NotifyQueueURL == "" {
+		s.warn("SEND_MODE=%s has no effect without ERROR_QUEUE_URL or NOTIFY_QUEUE_URL, SQS_URL is the only destination", SendPerQueue)
+	}
+	if s.LogLevel, err = parseLogLevel(getEnvDefault("LOG_LEVEL", string(LogInfo))); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	if s.Semantics, err = parseDeliverySemantics(getEnvDefault("DELIVERY_SEMANTICS", string(AtLeastOnce))); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	if s.PoisonPolls > 0 && s.Semantics == AtMostOnce {
+		s.warn("POISON_POLLS has no effect with %s delivery, which never retries a failed row", AtMostOnce)
+	}
+	if s.PoisonPolls > 0 && s.SendOnly {
+		s.warn("POISON_POLLS has no effect with SEND_ONLY, which never marks a row failed")
+	}
+	if s.BatchStatusUpdate && s.Semantics == AtMostOnce {
+		s.warn("BATCH_STATUS_UPDATE has no effect with %s delivery, which marks each batch sent before sending it", AtMostOnce)
+	}
+	if s.TransactionScope, err = parseTransactionScope(getEnvDefault("TRANSACTION_SCOPE", string(TransactionStatement))); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	if s.TransactionScope == TransactionPoll && s.Semantics == AtMostOnce {
+		// Rolling back would un-mark rows that were already sent.
+		log.Fatalf("TRANSACTION_SCOPE=%s cannot be combined with %s delivery", TransactionPoll, AtMostOnce)
+	}
+	if s.StrictPoll && s.TransactionScope != TransactionPoll {
+		log.Fatalf("STRICT_POLL needs TRANSACTION_SCOPE=%s to roll back a poll's updates", TransactionPoll)
+	}
+	if s.Marker, err = parseProcessedMarker(getEnvDefault("PROCESSED_MARKER", string(MarkerStatus)), os.Getenv("PROCESSED_COLUMN")); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	if s.Marker.legacy() && s.TransactionScope != TransactionPoll {
+		// Without a claimed state only the poll's row locks keep another
+		// poll from sending the same rows.
+		log.Fatalf("PROCESSED_MARKER=%s needs TRANSACTION_SCOPE=%s", s.Marker.kind, TransactionPoll)
+	}
+	if s.OversizePolicy, err = parseOversizePolicy(getEnvDefault("OVERSIZE_POLICY", string(OversizeSplit))); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	if s.SourceTables, err = parseSourceTables(os.Getenv("SOURCE_TABLES")); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	if err := validEntryIDPrefix(s.EntryIDPrefix); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	if s.MessageTags, err = parseMessageTags(os.Getenv("MESSAGE_TAGS")); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	attributes := len(s.MessageTags)
+	if s.SequenceAttribute {
+		attributes++
+	}
+	if s.ProducerID != "" {
+		attributes++
+	}
+	if s.SourceHost != "" {
+		attributes++
+	}
+	if s.SourceNode != "" {
+		attributes++
+	}
+	if s.CorrelationID {
+		attributes++
+	}
+	if s.BatchPositions {
+		attributes += 2
+	}
+	if attributes > MaxMessageAttributes {
+		log.Fatalf("MESSAGE_TAGS and the enabled attributes add up to %d message attributes, SQS allows at most %d", attributes, MaxMessageAttributes)
+	}
+	if s.FetchFilter, err = parseFetchFilter(os.Getenv("FETCH_FILTER")); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	if s.FetchFilter != nil {
+		log.Printf("Only claiming rows matching FETCH_FILTER %s", s.FetchFilter)
+	}
+	if s.AuditSink, err = parseAuditSink(getEnvDefault("AUDIT_SINK", string(AuditNone))); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	if s.GroupStrategy, err = parseGroupStrategy(getEnvDefault("GROUP_ID_STRATEGY", string(GroupPerMessage))); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	if s.GroupBuckets < 1 {
+		log.Fatalf("GROUP_BUCKETS must be at least 1, got %d", s.GroupBuckets)
+	}
+	if s.GroupStrategy != GroupPerMessage && !isFIFOQueue(s.QueueURL) {
+		s.warn("GROUP_ID_STRATEGY=%s has no effect on the standard queue %s, which ignores message groups and does not preserve order", s.GroupStrategy, s.QueueURL)
+	}
+	if s.DedupScope, err = parseDedupScope(os.Getenv("DEDUP_SCOPE")); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	if s.DedupScope != DedupScopeNone && !isFIFOQueue(s.QueueURL) {
+		log.Fatalf("DEDUP_SCOPE is only supported for FIFO queues, %s is a standard queue", s.QueueURL)
+	}
+	return s
+}
+
+// warn logs a configuration mistake that still leaves the producer able to
+// run, or exits when STRICT_CONFIG is set.
+func (s *settings) warn(format string, args ...any) {
+	if s.StrictConfig {
+		log.Fatalf("Invalid configuration (STRICT_CONFIG): "+format, args...)
+	}
+	log.Printf("WARNING: "+format, args...)
+}
+
+func getEnv(key string) string {
+	value := os.Getenv(key)
+	if value == "" {
+		log.Fatalf("Environment variable %s is not set", key)
+	}
+	return value
+}
+
+func getEnvDefault(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+func getEnvInt(key string, fallback int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Fatalf("Environment variable %s must be an integer, got %q", key, value)
+	}
+	return n
+}
+
+func getEnvFloat(key string, fallback float64) float64 {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		log.Fatalf("Environment variable %s must be a number, got %q", key, value)
+	}
+	return f
+}
+
+func getEnvBool(key string, fallback bool) bool {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Fatalf("Environment variable %s must be true or false, got %q", key, value)
+	}
+	return b
+}
+
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Fatalf("Environment variable %s must be a duration such as 30s, got %q", key, value)
+	}
+	return d
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// TestLoadSettingsChild loads the settings in the child process started by
+// loadSettingsIn.
+func TestLoadSettingsChild(t *testing.T) {
+	if os.Getenv("LOAD_SETTINGS_CHILD") != "1" {
+		t.Skip("only run by loadSettingsIn")
+	}
+	loadSettings(testQueueURL)
+}
+
+// loadSettingsIn runs loadSettings with env in a child process, since
+// invalid settings exit the process, and returns what it logged and
+// whether it exited with an error.
+func loadSettingsIn(t *testing.T, env []string) (string, bool) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], "-test.run=^TestLoadSettingsChild$")
+	cmd.Env = append(os.Environ(), "LOAD_SETTINGS_CHILD=1", "PORT=8080")
+	cmd.Env = append(cmd.Env, env...)
+	out, err := cmd.CombinedOutput()
+	var exit *exec.ExitError
+	if err != nil && !errors.As(err, &exit) {
+		t.Fatal(err)
+	}
+	return string(out), err != nil
+}
+
+func TestLoadSettings(t *testing.T) {
+	tests := []struct {
+		name string
+		env  []string
+		// fails is whether loadSettings exits, output what it must log
+		// either way.
+		fails  bool
+		output string
+	}{
+		{"defaults", nil, false, ""},
+		{"STRICT_POLL without a poll transaction", []string{"STRICT_POLL=true"}, true, "STRICT_POLL needs TRANSACTION_SCOPE=poll"},
+		{"STRICT_POLL with a poll transaction", []string{"STRICT_POLL=true", "TRANSACTION_SCOPE=poll"}, false, ""},
+		{"MIN_BATCH_SIZE above SQS_BATCH_SIZE", []string{"SQS_BATCH_SIZE=5", "MIN_BATCH_SIZE=6"}, true, "MIN_BATCH_SIZE must be between 0 and SQS_BATCH_SIZE 5"},
+		{"negative MIN_BATCH_SIZE", []string{"MIN_BATCH_SIZE=-1"}, true, "MIN_BATCH_SIZE must be between"},
+		{"MIN_BATCH_SIZE up to SQS_BATCH_SIZE", []string{"SQS_BATCH_SIZE=5", "MIN_BATCH_SIZE=5"}, false, ""},
+		{"negative rate", []string{"RATE_urls=-1"}, true, "RATE_urls must not be negative"},
+		{"negative error queue rate", []string{"ERROR_QUEUE_URL=https://sqs.us-east-1.amazonaws.com/123456789012/url-errors", "RATE_url_errors=-5"}, true, "RATE_url_errors must not be negative"},
+		{"rates", []string{"RATE_urls=50", "ERROR_QUEUE_URL=https://sqs.us-east-1.amazonaws.com/123456789012/url-errors", "RATE_url_errors=0.5"}, false, ""},
+		{"SEND_MODE=per_queue with SQS_URL alone", []string{"SEND_MODE=per_queue", "STRICT_CONFIG=true"}, true, "without ERROR_QUEUE_URL or NOTIFY_QUEUE_URL"},
+		{"SEND_MODE=per_queue with a notify queue", []string{"SEND_MODE=per_queue", "STRICT_CONFIG=true", "NOTIFY_QUEUE_URL=https://sqs.us-east-1.amazonaws.com/123456789012/notify"}, false, ""},
+		{"negative notify queue rate", []string{"NOTIFY_QUEUE_URL=https://sqs.us-east-1.amazonaws.com/123456789012/notify", "RATE_notify=-1"}, true, "RATE_notify must not be negative"},
+		{"notify queue is SQS_URL", []string{"NOTIFY_QUEUE_URL=" + testQueueURL}, true, "NOTIFY_QUEUE_URL must not be SQS_URL"},
+		{"invalid NOTIFY_MODE", []string{"NOTIFY_MODE=message"}, true, `invalid notify mode "message"`},
+		{"negative POISON_POLLS", []string{"POISON_POLLS=-1"}, true, "POISON_POLLS must not be negative"},
+		{"zero POISON_WINDOW", []string{"POISON_POLLS=3", "POISON_WINDOW=0s"}, true, "POISON_WINDOW must be positive"},
+		{"SOURCE_ATTRIBUTES from the environment", []string{"SOURCE_ATTRIBUTES=true", "HOSTNAME=pod-7", "NODE_NAME=node-3"}, false, `Tagging messages with source_host "pod-7" and source_node "node-3"`},
+		{"POISON_POLLS with SEND_ONLY", []string{"POISON_POLLS=3", "SEND_ONLY=true", "STRICT_CONFIG=true"}, true, "POISON_POLLS has no effect with SEND_ONLY"},
+		{"POISON_POLLS", []string{"POISON_POLLS=3", "POISON_WINDOW=30m"}, false, ""},
+		{"PURGE_ON_START alone", []string{"PURGE_ON_START=true"}, true, "REFUSING TO START: PURGE_ON_START would delete every message on " + testQueueURL},
+		{"PURGE_ON_START without ALLOW_PURGE=yes", []string{"PURGE_ON_START=true", "ALLOW_PURGE=true"}, true, "REFUSING TO START"},
+		{"PURGE_ON_START with ALLOW_PURGE=yes", []string{"PURGE_ON_START=true", "ALLOW_PURGE=yes"}, false, ""},
+		{"ALLOW_PURGE alone", []string{"ALLOW_PURGE=yes"}, false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			output, failed := loadSettingsIn(t, tt.env)
+			if failed != tt.fails {
+				t.Fatalf("got failed %v, want %v: %s", failed, tt.fails, output)
+			}
+			if !strings.Contains(output, tt.output) {
+				t.Errorf("want output containing %q, got %s", tt.output, output)
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// MaxSourceWeight bounds the weight of a SOURCE_TABLES entry, which is
+// expanded into that many slots of the rotation.
+const MaxSourceWeight = 100
+
+// tableNamePattern is a plain table name, optionally qualified by a schema.
+var tableNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+// parseSourceTables parses SOURCE_TABLES, a comma-separated list of tables
+// with the columns of the urls table, each optionally followed by :weight,
+// such as urls:3,urls_news. It returns the poll rotation, in which every
+// table appears weight times (1 by default), interleaved so heavier tables
+// are spread over the rotation rather than polled back to back. An empty
+// value polls the urls table alone.
+func parseSourceTables(value string) ([]string, error) {
+	if value == "" {
+		return nil, nil
+	}
+	var tables []string
+	weights := map[string]int{}
+	for _, entry := range strings.Split(value, ",") {
+		name, weightText, hasWeight := strings.Cut(strings.TrimSpace(entry), ":")
+		if !tableNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("invalid source table %q, expected a table name of letters, digits and '_'", entry)
+		}
+		if _, dup := weights[name]; dup {
+			return nil, fmt.Errorf("source table %q is listed twice", name)
+		}
+		weight := 1
+		if hasWeight {
+			var err error
+			if weight, err = strconv.Atoi(weightText); err != nil || weight < 1 || weight > MaxSourceWeight {
+				return nil, fmt.Errorf("invalid weight %q for source table %s, expected 1 to %d", weightText, name, MaxSourceWeight)
+			}
+		}
+		tables = append(tables, name)
+		weights[name] = weight
+	}
+
+	total := 0
+	for _, w := range weights {
+		total += w
+	}
+	var rotation []string
+	for round := 0; len(rotation) < total; round++ {
+		for _, name := range tables {
+			if weights[name] > round {
+				rotation = append(rotation, name)
+			}
+		}
+	}
+	return rotation, nil
+}
+
+// sourceTableNames returns the distinct tables of a SOURCE_TABLES rotation,
+// sorted, or nil for the urls table alone.
+func sourceTableNames(rotation []string) []string {
+	if len(rotation) == 0 {
+		return nil
+	}
+	return slices.Compact(slices.Sorted(slices.Values(rotation)))
+}
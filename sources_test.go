@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/ofjangra/sqsURLProducer/models"
+)
+
+func TestParseSourceTables(t *testing.T) {
+	tests := []struct {
+		value string
+		want  []string
+		err   string
+	}{
+		{"", nil, ""},
+		{"urls", []string{"urls"}, ""},
+		{"urls:3, urls_news", []string{"urls", "urls_news", "urls", "urls"}, ""},
+		{"a:2,b:2,c", []string{"a", "b", "c", "a", "b"}, ""},
+		{"public.urls", []string{"public.urls"}, ""},
+		{"urls,urls:2", nil, "listed twice"},
+		{"urls;drop", nil, "invalid source table"},
+		{"urls:0", nil, "invalid weight"},
+		{"urls:101", nil, "invalid weight"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := parseSourceTables(tt.value)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want one containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got rotation %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCountSources(t *testing.T) {
+	db := testDB(t, "urls_news")
+	insertRows(t, db, "urls", models.StatusPending, models.StatusPending, models.StatusSent)
+	insertRows(t, db, "urls_news", models.StatusPending, models.StatusFailed)
+	marker := processedMarker{kind: MarkerStatus, column: "status"}
+
+	tests := []struct {
+		name     string
+		tables   []string
+		pending  int64
+		perTable map[string]int64
+	}{
+		{"urls table", nil, 2, nil},
+		{"every source table", sourceTableNames([]string{"urls", "urls_news", "urls"}), 3, map[string]int64{"urls": 2, "urls_news": 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			counts, perTable, err := countSources(db, tt.tables, marker)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if counts[models.StatusPending] != tt.pending {
+				t.Errorf("got %d pending, want %d", counts[models.StatusPending], tt.pending)
+			}
+			if len(perTable) != len(tt.perTable) {
+				t.Fatalf("got counts for %d tables, want %d", len(perTable), len(tt.perTable))
+			}
+			for table, pending := range tt.perTable {
+				if perTable[table][models.StatusPending] != pending {
+					t.Errorf("got %d pending in %s, want %d", perTable[table][models.StatusPending], table, pending)
+				}
+			}
+		})
+	}
+}
+
+func TestSourceTableRotation(t *testing.T) {
+	tests := []struct {
+		name    string
+		sources string
+		pending map[string]int
+		// polls are the table each poll should take a row from, "" for a
+		// poll that takes nothing.
+		polls []string
+	}{
+		{"weighted turns", "urls_a:2,urls_b", map[string]int{"urls_a": 3, "urls_b": 2}, []string{"urls_a", "urls_b", "urls_a", "urls_a", "urls_b", ""}},
+		{"empty table hands the poll on", "urls_a,urls_b", map[string]int{"urls_b": 2}, []string{"urls_b", "urls_b", ""}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := testDB(t, "urls_a", "urls_b")
+			for table, n := range tt.pending {
+				insertRows(t, db, table, slices.Repeat([]models.URLStatus{models.StatusPending}, n)...)
+			}
+			p := newTestProducer(db, &fakeSQS{})
+			p.fetchLimit, p.fetchChunkSize = 1, 1
+			var err error
+			if p.sources, err = parseSourceTables(tt.sources); err != nil {
+				t.Fatal(err)
+			}
+
+			sent := map[string]int{}
+			for i, want := range tt.polls {
+				if _, err := p.processURLs(context.Background()); err != nil {
+					t.Fatal(err)
+				}
+				got := ""
+				for _, table := range []string{"urls_a", "urls_b"} {
+					var n int64
+					if err := db.Table(table).Where("status <> ?", models.StatusPending).Count(&n).Error; err != nil {
+						t.Fatal(err)
+					}
+					if int(n) != sent[table] {
+						got = table
+						sent[table] = int(n)
+					}
+				}
+				if got != want {
+					t.Fatalf("poll %d took a row from %q, want %q", i+1, got, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ofjangra/sqsURLProducer/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/plugin/dbresolver"
+)
+
+const (
+	DefaultURLsPageSize = 50
+	MaxURLsPageSize     = 500
+
+	// MaxURLsPerInsert is the most rows one POST /urls request may add.
+	MaxURLsPerInsert = 500
+	// MaxURLsRequestBytes caps the size of a POST /urls request body.
+	MaxURLsRequestBytes = 1 << 20
+)
+
+type urlsPage struct {
+	Table  string        `json:"table,omitempty"`
+	Total  int64         `json:"total"`
+	Limit  int           `json:"limit"`
+	Offset int           `json:"offset"`
+	URLs   []models.URLs `json:"urls"`
+}
+
+func (s *server) urlsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		s.createURLsHandler(w, r)
+		return
+	}
+	s.listURLsHandler(w, r)
+}
+
+// urlsTable returns the database for the table a /urls request works on.
+// Without SOURCE_TABLES that is the urls table. With it, the table
+// parameter picks one of SOURCE_TABLES, the first in alphabetical order by
+// default, and the name is returned along with it. An unknown table gets a
+// 400 and false. Reads go to the primary, not a DB_REPLICA_DSN replica, so
+// rows just added by POST /urls are listed straight away.
+func (s *server) urlsTable(w http.ResponseWriter, r *http.Request) (*gorm.DB, string, bool) {
+	tables := sourceTableNames(s.settings.SourceTables)
+	table := r.URL.Query().Get("table")
+	switch {
+	case table == "" && len(tables) == 0:
+		return s.db().Clauses(dbresolver.Write), "", true
+	case table == "":
+		table = tables[0]
+	case !slices.Contains(tables, table):
+		writeJSONError(w, http.StatusBadRequest, "invalid_parameter", "table "+strconv.Quote(table)+" is not one of SOURCE_TABLES")
+		return nil, "", false
+	}
+	return s.db().Clauses(dbresolver.Write).Table(table), table, true
+}
+
+// listURLsHandler serves GET /urls?status=pending&limit=50&offset=0. status is
+// optional; limit defaults to DefaultURLsPageSize and is capped at
+// MaxURLsPageSize. total is the number of rows matching the filter. With
+// SOURCE_TABLES, table selects the table listed, see urlsTable.
+func (s *server) listURLsHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	db, table, ok := s.urlsTable(w, r)
+	if !ok {
+		return
+	}
+
+	limit, ok := queryInt(w, query.Get("limit"), "limit", DefaultURLsPageSize)
+	if !ok {
+		return
+	}
+	offset, ok := queryInt(w, query.Get("offset"), "offset", 0)
+	if !ok {
+		return
+	}
+	limit = min(limit, MaxURLsPageSize)
+
+	db = db.Model(&models.URLs{})
+	if status := models.URLStatus(query.Get("status")); status != "" {
+		if !slices.Contains(models.Statuses, status) {
+			writeJSONError(w, http.StatusBadRequest, "invalid_parameter", "unknown status "+strconv.Quote(string(status)))
+			return
+		}
+		switch {
+		case !s.settings.Marker.legacy():
+			db = db.Where("status = ?", status)
+		case status == models.StatusPending:
+			db = s.settings.Marker.unprocessed(db)
+		case status == models.StatusSent:
+			db = db.Where("NOT (?)", s.settings.Marker.pending())
+		default:
+			writeJSONError(w, http.StatusBadRequest, "invalid_parameter", "status "+strconv.Quote(string(status))+" is not tracked with PROCESSED_MARKER="+string(s.settings.Marker.kind))
+			return
+		}
+	}
+	db = db.Session(&gorm.Session{}) // shared by the count and the page query
+
+	page := urlsPage{Table: table, Limit: limit, Offset: offset, URLs: []models.URLs{}}
+	if err := db.Count(&page.Total).Error; err != nil {
+		writeJSONError(w, http.StatusServiceUnavailable, "database_error", err.Error())
+		return
+	}
+	if err := db.Order("id").Limit(limit).Offset(offset).Find(&page.URLs).Error; err != nil {
+		writeJSONError(w, http.StatusServiceUnavailable, "database_error", err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+type newURL struct {
+	URL         string     `json:"url"`
+	GroupKey    *string    `json:"group_key"`
+	ScheduledAt *time.Time `json:"scheduled_at"`
+}
+
+type insertResult struct {
+	Inserted   int64 `json:"inserted"`
+	Duplicates int64 `json:"duplicates"`
+}
+
+// createURLsHandler serves POST /urls with a JSON array of rows to add as
+// pending, each with a url and optionally a group_key and scheduled_at.
+// Inserts use ON CONFLICT DO NOTHING, so with URL_UNIQUE_INDEX set a URL
+// already in the table is counted as a duplicate instead of added again.
+// With SOURCE_TABLES, table selects the table added to, see urlsTable.
+func (s *server) createURLsHandler(w http.ResponseWriter, r *http.Request) {
+	db, _, ok := s.urlsTable(w, r)
+	if !ok {
+		return
+	}
+	var rows []newURL
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, MaxURLsRequestBytes)).Decode(&rows); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_body", "body must be a JSON array of {\"url\": ...} objects: "+err.Error())
+		return
+	}
+	if len(rows) == 0 || len(rows) > MaxURLsPerInsert {
+		writeJSONError(w, http.StatusBadRequest, "invalid_body", "body must hold between 1 and "+strconv.Itoa(MaxURLsPerInsert)+" URLs")
+		return
+	}
+
+	urls := make([]models.URLs, len(rows))
+	for i, row := range rows {
+		if strings.TrimSpace(row.URL) == "" {
+			writeJSONError(w, http.StatusBadRequest, "invalid_body", "URL "+strconv.Itoa(i)+" is empty")
+			return
+		}
+		urls[i] = models.URLs{URL: row.URL, Status: models.StatusPending, GroupKey: row.GroupKey, ScheduledAt: row.ScheduledAt}
+	}
+
+	// message_id and correlation_id are omitted since they are only set
+	// once a row is sent, and only exist with STORE_MESSAGE_ID,
+	// STORE_CORRELATION_ID or AUTO_MIGRATE. Tables with another
+	// PROCESSED_MARKER may have no status columns either.
+	omit := []string{"message_id", "correlation_id"}
+	if s.settings.Marker.legacy() {
+		omit = append(omit, "status", "claimed_at")
+	}
+	created := db.Clauses(clause.OnConflict{DoNothing: true}).Omit(omit...).Create(&urls)
+	if created.Error != nil {
+		writeJSONError(w, http.StatusServiceUnavailable, "database_error", created.Error.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, insertResult{Inserted: created.RowsAffected, Duplicates: int64(len(urls)) - created.RowsAffected})
+}
+
+// queryInt parses a non-negative integer query parameter, writing a 400 and
+// returning false when it is malformed.
+func queryInt(w http.ResponseWriter, value, name string, fallback int) (int, bool) {
+	if value == "" {
+		return fallback, true
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		writeJSONError(w, http.StatusBadRequest, "invalid_parameter", name+" must be a non-negative integer")
+		return 0, false
+	}
+	return n, true
+}
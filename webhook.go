@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// failureWebhook POSTs a JSON description of batches that failed after all
+// retries to FAILURE_WEBHOOK_URL. At most one notification is sent per
+// debounce interval; failures in between are counted and reported with the
+// next notification instead.
+//
+// With once, as under SEND_ONLY where a failed row stays pending and fails
+// again every poll, each row is only reported the first time it fails.
+type failureWebhook struct {
+	url      string
+	debounce time.Duration
+	client   *http.Client
+	once     bool
+
+	mu         sync.Mutex
+	lastSent   time.Time
+	suppressed int
+	reported   map[trackedRow]bool
+}
+
+type failurePayload struct {
+	Event      string    `json:"event"`
+	QueueURL   string    `json:"queue_url"`
+	Table      string    `json:"table,omitempty"`
+	URLIDs     []uint    `json:"url_ids"`
+	Error      string    `json:"error"`
+	Suppressed int       `json:"suppressed"`
+	Time       time.Time `json:"time"`
+}
+
+func newFailureWebhook(url string, debounce time.Duration, once bool) *failureWebhook {
+	if url == "" {
+		return nil
+	}
+	return &failureWebhook{url: url, debounce: debounce, client: &http.Client{Timeout: 10 * time.Second}, once: once, reported: map[trackedRow]bool{}}
+}
+
+// notify reports the failed rows of table, "" for the urls table without
+// SOURCE_TABLES, without blocking the caller. It is a no-op on a nil webhook.
+func (h *failureWebhook) notify(queueURL, table string, ids []uint, sendErr error) {
+	if h == nil {
+		return
+	}
+
+	h.mu.Lock()
+	if h.once {
+		ids = slices.DeleteFunc(slices.Clone(ids), func(id uint) bool { return h.reported[trackedRow{table, id}] })
+		if len(ids) == 0 {
+			h.mu.Unlock()
+			return
+		}
+		for _, id := range ids {
+			h.reported[trackedRow{table, id}] = true
+		}
+	}
+	now := time.Now()
+	if !h.lastSent.IsZero() && now.Sub(h.lastSent) < h.debounce {
+		h.suppressed++
+		h.mu.Unlock()
+		return
+	}
+	payload := failurePayload{
+		Event:      "batch_failed",
+		QueueURL:   queueURL,
+		Table:      table,
+		URLIDs:     ids,
+		Error:      sendErr.Error(),
+		Suppressed: h.suppressed,
+		Time:       now.UTC(),
+	}
+	h.lastSent = now
+	h.suppressed = 0
+	h.mu.Unlock()
+
+	go func() {
+		if err := h.post(payload); err != nil {
+			log.Printf("Failed to call failure webhook: %v", err)
+		}
+	}()
+}
+
+func (h *failureWebhook) post(payload failurePayload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	resp, err := h.client.Post(h.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestFailureWebhook(t *testing.T) {
+	tests := []struct {
+		name     string
+		debounce time.Duration
+		once     bool
+		// failures are the ids of successive failed batches.
+		failures [][]uint
+		want     [][]uint
+	}{
+		{"every failure", 0, false, [][]uint{{1, 2}, {1, 2}}, [][]uint{{1, 2}, {1, 2}}},
+		{"debounced", time.Hour, false, [][]uint{{1}, {2}, {3}}, [][]uint{{1}}},
+		{"each row once", 0, true, [][]uint{{1, 2}, {1, 2}, {2, 3}}, [][]uint{{1, 2}, {3}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			posted := make(chan failurePayload, len(tt.failures))
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var payload failurePayload
+				if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+					t.Error(err)
+				}
+				posted <- payload
+			}))
+			defer srv.Close()
+
+			h := newFailureWebhook(srv.URL, tt.debounce, tt.once)
+			for _, ids := range tt.failures {
+				h.notify(testQueueURL, "", ids, errors.New("send failed"))
+			}
+
+			// Calls are posted from goroutines of their own, so they may
+			// arrive in any order.
+			var got [][]uint
+			for range tt.want {
+				select {
+				case payload := <-posted:
+					got = append(got, payload.URLIDs)
+				case <-time.After(time.Second):
+					t.Fatalf("got %d calls, want %d", len(got), len(tt.want))
+				}
+			}
+			select {
+			case payload := <-posted:
+				t.Fatalf("got an unexpected call with ids %v", payload.URLIDs)
+			case <-time.After(50 * time.Millisecond):
+			}
+			slices.SortFunc(got, slices.Compare)
+			if !slices.EqualFunc(got, tt.want, slices.Equal) {
+				t.Errorf("got calls with ids %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFailureWebhookSourceTables(t *testing.T) {
+	posted := make(chan failurePayload, 3)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload failurePayload
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Error(err)
+		}
+		posted <- payload
+	}))
+	defer srv.Close()
+
+	h := newFailureWebhook(srv.URL, 0, true)
+	h.notify(testQueueURL, "urls", []uint{5}, errors.New("send failed"))
+	h.notify(testQueueURL, "urls_news", []uint{5}, errors.New("send failed"))
+	h.notify(testQueueURL, "urls", []uint{5}, errors.New("send failed"))
+
+	var tables []string
+	for range 2 {
+		select {
+		case payload := <-posted:
+			tables = append(tables, payload.Table)
+		case <-time.After(time.Second):
+			t.Fatalf("got %d calls, want 2", len(tables))
+		}
+	}
+	slices.Sort(tables)
+	if !slices.Equal(tables, []string{"urls", "urls_news"}) {
+		t.Errorf("got calls for tables %q, want row 5 of urls and of urls_news reported once each", tables)
+	}
+}